@@ -0,0 +1,185 @@
+package main
+
+import (
+    "bufio"
+    "config"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// cluster nodes listen from the network's port plus this, two ports each so the admin port sits right after the peer port
+var CLUSTER_PORT_OFFSET int = 100
+
+// the directory under the data directory cluster nodes keep their data in
+var CLUSTER_DIRNAME string = "cluster"
+
+// define one node process of a local cluster
+type clusterNode struct {
+    name string
+    port int
+    cmd *exec.Cmd
+    // closed once the process has exited
+    done chan bool
+    err error
+}
+
+// print lines from a node's output with its name in front, one whole line at a time
+func tailOutput(name string, output io.Reader, printMutex *sync.Mutex) {
+    scanner := bufio.NewScanner(output)
+    for scanner.Scan() {
+        printMutex.Lock()
+        fmt.Println(name + " | " + scanner.Text())
+        printMutex.Unlock()
+    }
+}
+
+// Run nodes node processes on this machine that use each other as seeds, the
+// first miners of them mining. Their output is shown with each node's name in
+// front, and they are all shut down on SIGINT or SIGTERM
+func runCluster(nodeConfig *configPackage.Config, args []string) error {
+    counts, err := positiveArgs(args, []int{3, 1})
+    if err != nil {
+        return err
+    }
+    if counts[1] > counts[0] {
+        return errors.New("a cluster of " + strconv.Itoa(counts[0]) + " nodes can't have " + strconv.Itoa(counts[1]) + " miners")
+    }
+    executable, err := os.Executable()
+    if err != nil {
+        return err
+    }
+
+    params := nodeConfig.Params()
+    basePort := params.DefaultPort + CLUSTER_PORT_OFFSET
+    peerAddress := func(i int) string {
+        return net.JoinHostPort("127.0.0.1", strconv.Itoa(basePort + 2 * i))
+    }
+    clusterDir := filepath.Join(nodeConfig.DataDir, CLUSTER_DIRNAME)
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    var printMutex sync.Mutex
+    nodes := []*clusterNode{}
+    exited := make(chan *clusterNode, counts[0])
+    for i := 0; i < counts[0]; i++ {
+        seeds := []string{}
+        for j := 0; j < counts[0]; j++ {
+            if j != i {
+                seeds = append(seeds, peerAddress(j))
+            }
+        }
+        command := "node"
+        nodeArgs := []string{
+            "-network", params.Name,
+            "-datadir", filepath.Join(clusterDir, "node" + strconv.Itoa(i)),
+            "-listen", peerAddress(i),
+            "-adminlisten", net.JoinHostPort("127.0.0.1", strconv.Itoa(basePort + 2 * i + 1)),
+            "-advertise", peerAddress(i),
+            "-seeds", strings.Join(seeds, ","),
+        }
+        if i < counts[1] {
+            // every miner pays its own wallet, so their blocks never match
+            command = "mine"
+            nodeArgs = append(nodeArgs, "-rotatepayout", "-threads", strconv.Itoa(nodeConfig.MiningThreads))
+            if nodeConfig.NumBlocks > 0 {
+                nodeArgs = append(nodeArgs, "-numblocks", strconv.Itoa(nodeConfig.NumBlocks))
+            }
+        }
+
+        node := &clusterNode{name: "node" + strconv.Itoa(i), port: basePort + 2 * i, done: make(chan bool)}
+        node.cmd = exec.Command(executable, append(nodeArgs, command)...)
+        // the cluster passes signals on itself, so a Ctrl-C in the terminal doesn't hit every node twice
+        node.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+        output, err := node.cmd.StdoutPipe()
+        if err != nil {
+            stopCluster(nodes)
+            return err
+        }
+        node.cmd.Stderr = node.cmd.Stdout
+        err = node.cmd.Start()
+        if err != nil {
+            stopCluster(nodes)
+            return err
+        }
+        fmt.Println("Started " + node.name + " (" + command + ") on " + peerAddress(i) + ", admin on port " +
+                    strconv.Itoa(node.port + 1) + ", pid " + strconv.Itoa(node.cmd.Process.Pid))
+
+        go func(node *clusterNode, output io.Reader) {
+            tailOutput(node.name, output, &printMutex)
+            node.err = node.cmd.Wait()
+            close(node.done)
+            exited <- node
+        }(node, output)
+        nodes = append(nodes, node)
+    }
+    fmt.Println("Cluster data is in " + clusterDir + ", press Ctrl-C to stop every node")
+
+    // run until we're told to stop or every node has exited on its own
+    for running := len(nodes); running > 0 && ctx.Err() == nil; {
+        select {
+        case <-ctx.Done():
+        case node := <-exited:
+            running--
+            message := node.name + " exited"
+            if node.err != nil {
+                message += ": " + node.err.Error()
+            }
+            printMutex.Lock()
+            fmt.Println(message)
+            printMutex.Unlock()
+        }
+    }
+    stop()
+    return stopCluster(nodes)
+}
+
+// Ask every node still running to shut down, and kill the ones that take longer
+// than a node's own shutdown allows
+func stopCluster(nodes []*clusterNode) error {
+    for _, node := range nodes {
+        select {
+        case <-node.done:
+        default:
+            node.cmd.Process.Signal(syscall.SIGTERM)
+        }
+    }
+    timer := time.NewTimer(SHUTDOWN_TIMEOUT + 5 * time.Second)
+    defer timer.Stop()
+    expired := false
+    var failed []string
+    for _, node := range nodes {
+        if !expired {
+            select {
+            case <-node.done:
+                continue
+            case <-timer.C:
+                expired = true
+            }
+        }
+        select {
+        case <-node.done:
+        default:
+            node.cmd.Process.Kill()
+            <-node.done
+            failed = append(failed, node.name)
+        }
+    }
+    if len(failed) > 0 {
+        return errors.New("had to kill " + strings.Join(failed, ", "))
+    }
+    fmt.Println("Every node has stopped")
+    return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func TestClusterArguments(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+    }{
+        {"no nodes", []string{"0"}},
+        {"nodes that aren't a number", []string{"three"}},
+        {"more miners than nodes", []string{"2", "3"}},
+        {"no miners", []string{"2", "0"}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            // these are refused before any node is started
+            if runCluster(newTestConfig(t), test.args) == nil {
+                t.Errorf("%v was accepted", test.args)
+            }
+        })
+    }
+}
+
+func TestTailOutputNamesEachLine(t *testing.T) {
+    read, write, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    stdout := os.Stdout
+    os.Stdout = write
+    var printMutex sync.Mutex
+    tailOutput("node1", strings.NewReader("first\nsecond\nno newline"), &printMutex)
+    os.Stdout = stdout
+    write.Close()
+
+    output, _ := ioutil.ReadAll(read)
+    want := "node1 | first\nnode1 | second\nnode1 | no newline\n"
+    if string(output) != want {
+        t.Errorf("got %q, want %q", output, want)
+    }
+}
+
+func TestStopClusterStopsEveryNode(t *testing.T) {
+    nodes := []*clusterNode{}
+    for _, name := range []string{"node0", "node1"} {
+        node := &clusterNode{name: name, cmd: exec.Command("sleep", "60"), done: make(chan bool)}
+        err := node.cmd.Start()
+        if err != nil {
+            t.Skip("can't start a process to stop: " + err.Error())
+        }
+        go func(node *clusterNode) {
+            node.err = node.cmd.Wait()
+            close(node.done)
+        }(node)
+        nodes = append(nodes, node)
+    }
+    // one of them has already gone
+    nodes[1].cmd.Process.Kill()
+    <-nodes[1].done
+
+    err := stopCluster(nodes)
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-nodes[0].done:
+    default:
+        t.Errorf("node0 is still running")
+    }
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+    "blockchain"
+    "config"
+    "datadir"
+    "errors"
+    "fmt"
+    "node"
+    "os"
+    "simnet"
+    "sort"
+    "strconv"
+    "time"
+    "wallet"
+)
+
+// define a subcommand of go_blockchain. args are whatever follows the command and its flags
+type command struct {
+    usage string
+    description string
+    run func(nodeConfig *configPackage.Config, args []string) error
+}
+
+// every command go_blockchain understands, by name
+var commands = map[string]command{
+    "node": {
+        usage: "node",
+        description: "run a node that syncs and serves blocks, mining only if Mine is set",
+        run: func(nodeConfig *configPackage.Config, args []string) error {
+            return runNode(nodeConfig)
+        },
+    },
+    "mine": {
+        usage: "mine",
+        description: "run a node and start mining right away (the default)",
+        run: func(nodeConfig *configPackage.Config, args []string) error {
+            if nodeConfig.DisableMining {
+                return errors.New("mining is disabled in the configuration, run \"go_blockchain node\" instead")
+            }
+            nodeConfig.Mine = true
+            return runNode(nodeConfig)
+        },
+    },
+    "wallet": {
+        usage: "wallet [list | new]",
+        description: "list the wallet's addresses or add a new one",
+        run: walletCommand,
+    },
+    "inspect-block": {
+        usage: "inspect-block <height or hash>",
+        description: "print a stored block",
+        run: inspectBlock,
+    },
+    "validate-chain": {
+        usage: "validate-chain [chain file]",
+        description: "check every block from genesis, report chain work, supply and the first bad block",
+        run: validateChain,
+    },
+    "export": {
+        usage: "export <file> [first] [last]",
+        description: "write blocks first to last (all by default) to a bootstrap file",
+        run: exportChain,
+    },
+    "import": {
+        usage: "import <file>",
+        description: "check and add the blocks from a bootstrap file that we don't have yet",
+        run: importChain,
+    },
+    "reindex": {
+        usage: "reindex",
+        description: "rebuild the block indexes from the stored chain",
+        run: reindex,
+    },
+    "migrate": {
+        usage: "migrate",
+        description: "upgrade stored files to the current format, keeping backups",
+        run: func(nodeConfig *configPackage.Config, args []string) error {
+            dataDir, err := openDataDir(nodeConfig)
+            if err != nil {
+                return err
+            }
+            defer dataDir.Close()
+            migrate(&blockchainPackage.Blockchain{DataDir: dataDir.Path, Params: nodeConfig.Params()},
+                    &nodePackage.Node{DataDir: dataDir.Path, Params: nodeConfig.Params()})
+            return nil
+        },
+    },
+    "cluster": {
+        usage: "cluster [nodes] [miners]",
+        description: "run nodes as separate processes on this machine, seeding each other, the first miners mining",
+        run: runCluster,
+    },
+    "simulate-faults": {
+        usage: "simulate-faults [nodes] [blocks] [seed]",
+        description: "mine on in-process nodes through lost, late and repeated messages and a partition, then check they agree",
+        run: simulateFaults,
+    },
+    "simulate": {
+        usage: "simulate [nodes] [blocks]",
+        description: "run two groups of in-process nodes that mine apart, join them and check they agree",
+        run: simulate,
+    },
+    "genesis": {
+        usage: "genesis [unix timestamp]",
+        description: "mine a genesis block for a new network",
+        run: func(nodeConfig *configPackage.Config, args []string) error {
+            generateGenesis(&blockchainPackage.Blockchain{Params: nodeConfig.Params(), MiningThreads: nodeConfig.MiningThreads}, args)
+            return nil
+        },
+    },
+}
+
+// list the commands, "help" can't live in the table since it reads the table
+func printUsage() {
+    fmt.Println("usage: go_blockchain [flags] <command> [arguments]")
+    fmt.Println("")
+    fmt.Println("commands:")
+    names := []string{}
+    for name := range commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Printf("    %-32s %s\n", commands[name].usage, commands[name].description)
+    }
+    fmt.Printf("    %-32s %s\n", "help", "show this message")
+    fmt.Println("")
+    fmt.Println("run \"go_blockchain -h\" for the flags every command accepts")
+}
+
+// Open the data directory and read the stored chain without starting the node.
+// The caller must close the data directory
+func openChain(nodeConfig *configPackage.Config) (*datadirPackage.DataDir, *blockchainPackage.Blockchain, error) {
+    dataDir, err := openDataDir(nodeConfig)
+    if err != nil {
+        return nil, nil, err
+    }
+    blockchainInstance := &blockchainPackage.Blockchain{
+        Chain: make([]blockchainPackage.Block, 0),
+        DataDir: dataDir.Path,
+        Params: nodeConfig.Params(),
+        MiningThreads: nodeConfig.MiningThreads,
+    }
+    err = readChain(blockchainInstance)
+    if err != nil {
+        dataDir.Close()
+        return nil, nil, err
+    }
+    return dataDir, blockchainInstance, nil
+}
+
+func walletCommand(nodeConfig *configPackage.Config, args []string) error {
+    action := "list"
+    if len(args) > 0 {
+        action = args[0]
+    }
+
+    dataDir, err := openDataDir(nodeConfig)
+    if err != nil {
+        return err
+    }
+    defer dataDir.Close()
+    wallet, err := walletPackage.Load(dataDir.File(datadirPackage.WALLET_FILENAME))
+    if err != nil {
+        return err
+    }
+
+    switch action {
+    case "list":
+        for _, address := range wallet.Addresses() {
+            fmt.Println(address)
+        }
+    case "new":
+        address, err := wallet.NewAddress()
+        if err != nil {
+            return err
+        }
+        fmt.Println(address)
+    default:
+        return errors.New("unknown wallet action \"" + action + "\", expected list or new")
+    }
+    return nil
+}
+
+func inspectBlock(nodeConfig *configPackage.Config, args []string) error {
+    if len(args) != 1 {
+        return errors.New("usage: go_blockchain inspect-block <height or hash>")
+    }
+    dataDir, blockchainInstance, err := openChain(nodeConfig)
+    if err != nil {
+        return err
+    }
+    defer dataDir.Close()
+
+    // anything that isn't a number is taken to be a block hash
+    query := blockchainPackage.IndexQuery{Hash: args[0]}
+    height, err := strconv.Atoi(args[0])
+    if err == nil {
+        query = blockchainPackage.IndexQuery{Height: height}
+    }
+    entry := blockchainInstance.Lookup(query)
+    if !entry.Found {
+        return errors.New("no block " + args[0] + " in the stored chain of " + strconv.Itoa(len(blockchainInstance.Chain)) + " blocks")
+    }
+    blockchainInstance.PrintBlockInfo(entry.Height)
+    return nil
+}
+
+// Run every consensus check from genesis and print a report. With a file argument
+// that chain file is checked instead, without locking or changing the data directory
+func validateChain(nodeConfig *configPackage.Config, args []string) error {
+    var blockchainInstance *blockchainPackage.Blockchain
+    source := ""
+    if len(args) > 0 {
+        blocks, err := blockchainPackage.ReadChainFile(args[0])
+        if err != nil {
+            return err
+        }
+        blockchainInstance = &blockchainPackage.Blockchain{Chain: blocks, Params: nodeConfig.Params()}
+        source = args[0]
+    } else {
+        dataDir, err := openDataDir(nodeConfig)
+        if err != nil {
+            return err
+        }
+        defer dataDir.Close()
+        blockchainInstance = &blockchainPackage.Blockchain{
+            Chain: make([]blockchainPackage.Block, 0),
+            DataDir: dataDir.Path,
+            Params: nodeConfig.Params(),
+        }
+        // read the chain as it is, a wrong genesis block is reported like any other bad block
+        err = blockchainInstance.ReadChain()
+        if err == blockchainPackage.ErrNoChain {
+            blockchainInstance.Chain = append(blockchainInstance.Chain, nodeConfig.Params().GenesisBlock)
+        } else if err != nil {
+            return err
+        }
+        source = dataDir.Path
+    }
+
+    report := blockchainInstance.Verify()
+    fmt.Println("Checked the " + nodeConfig.Params().Name + " chain in " + source)
+    fmt.Println("Blocks: " + strconv.Itoa(report.Blocks))
+    fmt.Println("Valid blocks: " + strconv.Itoa(report.ValidBlocks))
+    fmt.Println("Chain work: " + report.ChainWork.String())
+    fmt.Println("Supply: " + strconv.FormatInt(report.Supply, 10))
+    if report.FirstInvalid < 0 {
+        fmt.Println("All blocks are valid")
+        return nil
+    }
+
+    fmt.Println("First invalid block: " + strconv.Itoa(report.FirstInvalid) + ", " + report.Reason)
+    blockchainInstance.PrintBlockInfo(report.FirstInvalid)
+    return errors.New("the chain is invalid from block " + strconv.Itoa(report.FirstInvalid))
+}
+
+func exportChain(nodeConfig *configPackage.Config, args []string) error {
+    if len(args) < 1 || len(args) > 3 {
+        return errors.New("usage: go_blockchain export <file> [first] [last]")
+    }
+    dataDir, blockchainInstance, err := openChain(nodeConfig)
+    if err != nil {
+        return err
+    }
+    defer dataDir.Close()
+
+    // the range is inclusive and defaults to the whole chain
+    heights := []int{0, len(blockchainInstance.Chain) - 1}
+    for i, arg := range args[1:] {
+        heights[i], err = strconv.Atoi(arg)
+        if err != nil {
+            return errors.New("block heights must be numbers, not \"" + arg + "\"")
+        }
+    }
+
+    exported, err := blockchainInstance.ExportBootstrap(args[0], heights[0], heights[1])
+    if err != nil {
+        return err
+    }
+    fmt.Println("Exported " + strconv.Itoa(exported) + " blocks to " + args[0])
+    return nil
+}
+
+func importChain(nodeConfig *configPackage.Config, args []string) error {
+    if len(args) != 1 {
+        return errors.New("usage: go_blockchain import <file>")
+    }
+    // make sure the file is there before we touch the data directory
+    _, err := os.Stat(args[0])
+    if err != nil {
+        return err
+    }
+    dataDir, blockchainInstance, err := openChain(nodeConfig)
+    if err != nil {
+        return err
+    }
+    defer dataDir.Close()
+
+    added, err := blockchainInstance.ImportBootstrap(args[0])
+    fmt.Println("Imported " + strconv.Itoa(added) + " blocks, the chain now has " + strconv.Itoa(len(blockchainInstance.Chain)))
+    return err
+}
+
+func reindex(nodeConfig *configPackage.Config, args []string) error {
+    dataDir, blockchainInstance, err := openChain(nodeConfig)
+    if err != nil {
+        return err
+    }
+    defer dataDir.Close()
+
+    blockchainInstance.Reindex()
+    fmt.Println("Reindexed " + strconv.Itoa(len(blockchainInstance.Chain)) + " blocks")
+    return nil
+}
+
+// Split a simulated network in two, let each half mine its own branch, then join
+// them and check every node ends up on the branch with more work
+func simulate(nodeConfig *configPackage.Config, args []string) error {
+    counts, err := positiveArgs(args, []int{4, 10})
+    if err != nil {
+        return err
+    }
+    if counts[0] < 2 {
+        return errors.New("a simulation needs at least 2 nodes")
+    }
+
+    network, err := simnetPackage.New(counts[0])
+    if err != nil {
+        return err
+    }
+    defer network.Close()
+
+    half := len(network.Nodes) / 2
+    groups := [][]*simnetPackage.SimNode{network.Nodes[:half], network.Nodes[half:]}
+    for _, group := range groups {
+        for i, a := range group {
+            for _, b := range group[i + 1:] {
+                network.Connect(a, b)
+            }
+        }
+    }
+    first := network.Nodes[0]
+    last := network.Nodes[len(network.Nodes) - 1]
+
+    // the second group mines more, so its branch should win
+    err = network.RunScript([]simnetPackage.MiningStep{
+        {Node: 0, Blocks: counts[1]},
+        {Node: len(network.Nodes) - 1, Blocks: counts[1] + counts[1] / 2 + 1},
+    })
+    if err != nil {
+        return err
+    }
+    for _, group := range groups {
+        err = network.WaitForAgreement(group, 30 * time.Second)
+        if err != nil {
+            return err
+        }
+    }
+    fmt.Println("Before joining the groups:")
+    printTips(network.Tips())
+
+    network.Connect(first, last)
+    network.Sync()
+    _, err = network.Mine(first, 1)
+    if err != nil {
+        return err
+    }
+    err = network.WaitForConvergence(30 * time.Second)
+    if err != nil {
+        return err
+    }
+    fmt.Println("After joining the groups:")
+    printTips(network.Tips())
+    return nil
+}
+
+// Mine on a simulated network while messages are lost, delayed, duplicated and
+// reordered, and the two halves are cut off from each other for a while. Once
+// the faults stop every node should resync onto the same valid chain. The same
+// seed gives the same faults
+func simulateFaults(nodeConfig *configPackage.Config, args []string) error {
+    counts, err := positiveArgs(args, []int{6, 20, 1})
+    if err != nil {
+        return err
+    }
+    if counts[0] < 2 {
+        return errors.New("a simulation needs at least 2 nodes")
+    }
+
+    network, err := simnetPackage.New(counts[0])
+    if err != nil {
+        return err
+    }
+    defer network.Close()
+    network.ConnectAll()
+    network.Faults.Seed(int64(counts[2]))
+    network.Faults.AddRule(simnetPackage.FaultRule{
+        Drop: 0.1,
+        Duplicate: 0.05,
+        Reorder: 0.1,
+        Delay: time.Millisecond,
+        Jitter: 5 * time.Millisecond,
+    })
+
+    // cut the network in half for the middle half of the run
+    half := len(network.Nodes) / 2
+    first := network.Nodes[0]
+    last := network.Nodes[len(network.Nodes) - 1]
+    blockTime := time.Duration(network.Params.BlockTime) * time.Second
+    start := network.Clock.Now().Add(time.Duration(counts[1] / 4) * blockTime)
+    end := start.Add(time.Duration(counts[1] / 2) * blockTime)
+    network.PartitionBetween(start, end, network.Nodes[:half], network.Nodes[half:])
+    partitioned := false
+
+    // a miner on each side, the second one a little faster. Messages get a moment
+    // to arrive after each round, though lost ones may leave nodes behind
+    for i := 0; i < counts[1]; i++ {
+        steps := []simnetPackage.MiningStep{{Node: 0, Blocks: 1}}
+        if i % 3 != 2 {
+            steps = append(steps, simnetPackage.MiningStep{Node: len(network.Nodes) - 1, Blocks: 1})
+        }
+        err = network.RunScript(steps)
+        if err != nil {
+            return err
+        }
+        network.Settle(time.Second)
+
+        now := network.Clock.Now()
+        if !partitioned && !now.Before(start) && now.Before(end) {
+            fmt.Println("The halves were cut off from each other in round " + strconv.Itoa(i + 1))
+            partitioned = true
+        } else if partitioned && !now.Before(end) {
+            fmt.Println("The partition healed in round " + strconv.Itoa(i + 1))
+            partitioned = false
+        }
+    }
+    fmt.Println("While the faults were on:")
+    printTips(network.Tips())
+
+    // stop the faults, let everyone catch up and break any tie with one more block
+    network.Faults.ClearRules()
+    network.Heal()
+    network.Sync()
+    _, err = network.Mine(last, 1)
+    if err != nil {
+        return err
+    }
+    err = network.WaitForConvergence(30 * time.Second)
+    if err != nil {
+        return err
+    }
+    fmt.Println("After the faults stopped:")
+    printTips(network.Tips())
+
+    for _, simNode := range network.Nodes {
+        report := simNode.Blockchain.Verify()
+        if report.FirstInvalid != -1 {
+            return errors.New(simNode.Name + "'s block " + strconv.Itoa(report.FirstInvalid) + " is invalid: " + report.Reason)
+        }
+    }
+    stats := network.Faults.Stats()
+    fmt.Println(strconv.Itoa(stats.Sent) + " messages: " + strconv.Itoa(stats.Dropped) + " lost, " +
+                strconv.Itoa(stats.Delayed) + " delayed, " + strconv.Itoa(stats.Duplicated) + " duplicated, " +
+                strconv.Itoa(stats.Reordered) + " reordered, " + strconv.Itoa(stats.Partitioned) + " cut off by the partition")
+    fmt.Println(first.Name + " and the rest agree on a valid chain")
+    return nil
+}
+
+// parse positional numbers, keeping defaults for the ones not given
+func positiveArgs(args []string, defaults []int) ([]int, error) {
+    values := append([]int{}, defaults...)
+    for i := 0; i < len(args) && i < len(values); i++ {
+        value, err := strconv.Atoi(args[i])
+        if err != nil || value < 1 {
+            return nil, errors.New("\"" + args[i] + "\" is not a positive number")
+        }
+        values[i] = value
+    }
+    return values, nil
+}
+
+func printTips(tips []simnetPackage.Tip) {
+    for _, tip := range tips {
+        fmt.Println("    " + tip.Name + " block " + strconv.Itoa(tip.Height - 1) + " " + tip.Hash)
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "config"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// a regtest configuration keeping its files in a temporary directory
+func newTestConfig(t *testing.T) *configPackage.Config {
+    nodeConfig := configPackage.Default()
+    nodeConfig.Network = "regtest"
+    nodeConfig.DataDir = t.TempDir()
+    return &nodeConfig
+}
+
+func TestCommandTable(t *testing.T) {
+    for name, cmd := range commands {
+        if !strings.HasPrefix(cmd.usage, name) || cmd.description == "" || cmd.run == nil {
+            t.Errorf("command %q is missing its usage, description or function", name)
+        }
+    }
+}
+
+func TestCommandArguments(t *testing.T) {
+    tests := []struct {
+        name string
+        command string
+        // the file argument is put in the test's directory
+        args []string
+        wantErr bool
+    }{
+        {"inspect without a block", "inspect-block", nil, true},
+        {"inspect the genesis block", "inspect-block", []string{"0"}, false},
+        {"inspect a missing block", "inspect-block", []string{"1"}, true},
+        {"validate a fresh chain", "validate-chain", nil, false},
+        {"export without a file", "export", nil, true},
+        {"export everything", "export", []string{"blocks.json"}, false},
+        {"export from a bad height", "export", []string{"blocks.json", "first"}, true},
+        {"import a missing file", "import", []string{"blocks.json"}, true},
+        {"reindex", "reindex", nil, false},
+        {"new address", "wallet", []string{"new"}, false},
+        {"list addresses", "wallet", nil, false},
+        {"unknown wallet action", "wallet", []string{"spend"}, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeConfig := newTestConfig(t)
+            args := append([]string(nil), test.args...)
+            if len(args) > 0 && strings.HasSuffix(args[0], ".json") {
+                args[0] = filepath.Join(nodeConfig.DataDir, args[0])
+            }
+            err := commands[test.command].run(nodeConfig, args)
+            if (err != nil) != test.wantErr {
+                t.Errorf("got %v, want an error: %v", err, test.wantErr)
+            }
+        })
+    }
+}
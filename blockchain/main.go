@@ -2,46 +2,74 @@ package main
 
 import (
     "blockchain"
+    "config"
+    "datadir"
+    "miner"
     "node"
     "time"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
     "fmt"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
     "strconv"
-    "sync"
+    "syscall"
+    "wallet"
 )
 
-var STARTING_DIFFICULTY string = "0000007fffffffff"
-var NUM_BLOCKS int = 300
-var PORT int = 8080
-var KNOWN_NODES = []nodePackage.NodeAddress{{"192.168.0.251", 8080, time.Now().Unix()},
-                                            {"192.168.0.129", 8080, time.Now().Unix()}}
-
-func mineBlocks(blockchainInstance *blockchainPackage.Blockchain, nodeInstance *nodePackage.Node) {
-    for len(blockchainInstance.Chain) < NUM_BLOCKS {
-        // add the new block to the blockchain
-        blockchainInstance.AddBlock()
-	if !blockchainInstance.ValidateChain() {
-            // remove the most recent block
-            blockchainInstance.Chain = blockchainInstance.Chain[:len(blockchainInstance.Chain) - 1]
+// how long to wait for in-flight requests when shutting down
+var SHUTDOWN_TIMEOUT time.Duration = 10 * time.Second
+
+// The addresses mined blocks pay out to. With payout rotation these are every
+// address in the wallet, and the wallet gets its first address if it has none
+func payoutAddresses(nodeConfig *configPackage.Config, dataDir *datadirPackage.DataDir) ([]string, error) {
+    if !nodeConfig.RotatePayout {
+        if nodeConfig.PayoutAddress == "" {
+            fmt.Println("No payout address set, mined blocks will pay nobody")
+            return []string{}, nil
         }
-	fmt.Println("Found block number " + strconv.Itoa(len(blockchainInstance.Chain)))
-        if !nodeInstance.AddBlock(blockchainInstance.Chain[len(blockchainInstance.Chain) - 1]) {
-            // Our block was rejected by some of the nodes. We may be out of sync
-            blockchainInstance.Chain = blockchainInstance.Chain[:len(blockchainInstance.Chain) - 1]
-            syncChain(blockchainInstance, nodeInstance)
+        return []string{nodeConfig.PayoutAddress}, nil
+    }
+
+    wallet, err := walletPackage.Load(dataDir.File(datadirPackage.WALLET_FILENAME))
+    if err != nil {
+        return nil, err
+    }
+    if len(wallet.Keys) == 0 {
+        address, err := wallet.NewAddress()
+        if err != nil {
+            return nil, err
         }
+        fmt.Println("The wallet was empty, created payout address " + address)
     }
-    blockchainInstance.WriteChain()
-    for _, block := range blockchainInstance.Chain {
-        fmt.Println(block)
+    addresses := wallet.Addresses()
+    // the wallet file can be edited by hand, so check it like any other setting
+    for _, address := range addresses {
+        err = walletPackage.ValidateAddress(address)
+        if err != nil {
+            return nil, errors.New("wallet: " + err.Error())
+        }
     }
+    fmt.Println("Rotating payouts between " + strconv.Itoa(len(addresses)) + " wallet addresses")
+    return addresses, nil
 }
 
-func nodeSetup(nodeInstance *nodePackage.Node) {
-    // get the public IP of this node
-    nodeInstance.GetPublicIP()
+func nodeSetup(nodeInstance *nodePackage.Node, nodeConfig *configPackage.Config) {
+    if nodeConfig.AdvertisedAddress != "" {
+        // the operator told us how other nodes can reach us
+        nodeInstance.MyAddress, _ = nodePackage.ParseNodeAddress(nodeConfig.AdvertisedAddress)
+    } else {
+        // get the public IP of this node
+        nodeInstance.GetPublicIP()
 
-    // set port in node address
-    nodeInstance.MyAddress.Port = PORT
+        // set port in node address to the one we listen on
+        _, port, _ := net.SplitHostPort(nodeInstance.ListenAddresses[0])
+        nodeInstance.MyAddress.Port, _ = strconv.Atoi(port)
+    }
 
     // get a list of clients from well known locations
     nodeInstance.GetNodeList()
@@ -50,92 +78,312 @@ func nodeSetup(nodeInstance *nodePackage.Node) {
     nodeInstance.SyncNodes()
 }
 
-func syncChain(blockchainInstance *blockchainPackage.Blockchain, nodeInstance *nodePackage.Node) {
+func syncChain(ctx context.Context, blockchainInstance *blockchainPackage.Blockchain, nodeInstance *nodePackage.Node) {
     // get the height of the blockchain
     height := nodeInstance.GetHeight()
 
     // sync the blockchain from the other node
     synced := len(blockchainInstance.Chain)
-    for synced < height {
+    for synced < height && ctx.Err() == nil {
         fmt.Println("Syncing block number " + strconv.Itoa(synced + 1))
         newBlock := nodeInstance.GetBlock(synced)
-        blockchainInstance.Chain = append(blockchainInstance.Chain, newBlock)
+        if blockchainInstance.AcceptBlock(newBlock) != nil {
+            // the other nodes sent us a block we can't use, try again on the next sync
+            fmt.Println("Could not sync block number " + strconv.Itoa(synced + 1))
+            return
+        }
         synced++
     }
 }
 
-func main() {
+func migrate(blockchainInstance *blockchainPackage.Blockchain, nodeInstance *nodePackage.Node) {
+    migrated, err := blockchainInstance.MigrateChain()
+    if err != nil {
+        fmt.Println(err.Error())
+    } else if migrated {
+        fmt.Println("Upgraded the stored chain to format version " + strconv.Itoa(blockchainPackage.CHAIN_FORMAT_VERSION))
+    } else {
+        fmt.Println("The stored chain is already up to date")
+    }
+
+    migrated, err = nodeInstance.MigrateNodeList()
+    if err != nil {
+        fmt.Println(err.Error())
+    } else if migrated {
+        fmt.Println("Upgraded the stored node list to format version " + strconv.Itoa(nodePackage.NODELIST_FORMAT_VERSION))
+    } else {
+        fmt.Println("The stored node list is already up to date")
+    }
+}
+
+// mine a new genesis block and print it so it can be pasted into the network parameters
+func generateGenesis(blockchainInstance *blockchainPackage.Blockchain, args []string) {
+    genesisBlock := blockchainInstance.GetParams().GenesisBlock
+    genesisBlock.Timestamp = time.Now().Unix()
+    if len(args) > 0 {
+        timestamp, err := strconv.ParseInt(args[0], 10, 64)
+        if err != nil {
+            fmt.Println("the genesis timestamp must be a unix time in seconds")
+            return
+        }
+        genesisBlock.Timestamp = timestamp
+    }
+
+    fmt.Println("Mining genesis block with difficulty " + genesisBlock.Difficulty)
+    genesisBlock = blockchainInstance.MineGenesis(genesisBlock)
+    jsonBlock, err := json.MarshalIndent(genesisBlock, "", "    ")
+    if err != nil {
+        fmt.Println(err.Error())
+        return
+    }
+    fmt.Println(string(jsonBlock))
+    fmt.Println("GenesisHash: " + blockchainInstance.HashBlock(genesisBlock))
+}
+
+// Lock the data directory for the configured network. Networks other than
+// mainnet get their own subdirectory so their files never mix
+func openDataDir(nodeConfig *configPackage.Config) (*datadirPackage.DataDir, error) {
+    dataDirPath := nodeConfig.DataDir
+    if nodeConfig.Params() != &blockchainPackage.MainNetParams {
+        dataDirPath = filepath.Join(dataDirPath, nodeConfig.Params().Name)
+    }
+    return datadirPackage.Open(dataDirPath)
+}
 
-    // start by initializing a single block to avoid range errors in other functions
-    genesisBlock := blockchainPackage.Block {
-        Index: 0,
-        Timestamp: time.Now().Unix(),
-        Proof: 69, //nice
-        PreviousHash: "this is just a test",
-	Difficulty: STARTING_DIFFICULTY,
+// Read the stored chain, starting from the network's genesis block if nothing is stored yet
+func readChain(blockchainInstance *blockchainPackage.Blockchain) error {
+    err := blockchainInstance.ReadChain()
+    if err == blockchainPackage.ErrNoChain {
+	    blockchainInstance.Chain = append(blockchainInstance.Chain, blockchainInstance.GetParams().GenesisBlock)
+    } else if err != nil {
+        // don't start from a fresh genesis, that would overwrite the stored chain
+        return err
+    }
+    return blockchainInstance.CheckGenesis()
+}
+
+// run a networked node, mining if the config asks for it
+func runNode(nodeConfig *configPackage.Config) error {
+    params := nodeConfig.Params()
+
+    // lock the data directory before touching anything in it
+    dataDir, err := openDataDir(nodeConfig)
+    if err != nil {
+        return err
+    }
+    defer dataDir.Close()
+    err = dataDir.StartLog()
+    if err != nil {
+        fmt.Println(err.Error())
     }
 
     // create channels so the blockchain and node packages can communicate
+    sharedHeightRequestChannel := make(chan bool)
     sharedHeightChannel := make(chan int)
     sharedBlockIndexChannel := make(chan int)
     sharedGetBlockChannel := make(chan blockchainPackage.Block)
     sharedAddBlockChannel := make(chan blockchainPackage.Block)
-    sharedBlockValidateChannel := make(chan bool)
-
-    // create mutexes (mutices?) for safety
-    var nodeListMutex sync.Mutex
-    var blockMutex sync.Mutex
+    sharedBlockValidateChannel := make(chan error)
+    sharedIndexQueryChannel := make(chan blockchainPackage.IndexQuery)
+    sharedIndexEntryChannel := make(chan blockchainPackage.IndexEntry)
+    sharedGenerateChannel := make(chan blockchainPackage.GenerateRequest)
+    sharedGeneratedChannel := make(chan []blockchainPackage.Block)
+    sharedReorgChannel := make(chan blockchainPackage.Branch)
+    sharedReorgResultChannel := make(chan bool)
+    sharedBranchCheckChannel := make(chan blockchainPackage.Branch)
+    sharedBranchCheckResultChannel := make(chan error)
 
     // create the blockchain instance
     blockchainInstance := blockchainPackage.Blockchain {
         Chain: make([]blockchainPackage.Block, 0),
+        DataDir: dataDir.Path,
+        Params: params,
+        MiningThreads: nodeConfig.MiningThreads,
+        HeightRequestChannel: sharedHeightRequestChannel,
         HeightChannel: sharedHeightChannel,
         GetBlockChannel: sharedGetBlockChannel,
         AddBlockChannel: sharedAddBlockChannel,
         BlockIndexChannel: sharedBlockIndexChannel,
         BlockValidateChannel: sharedBlockValidateChannel,
-        BlockMutex: blockMutex,
+        IndexQueryChannel: sharedIndexQueryChannel,
+        IndexEntryChannel: sharedIndexEntryChannel,
+        GenerateChannel: sharedGenerateChannel,
+        GeneratedChannel: sharedGeneratedChannel,
+        ReorgChannel: sharedReorgChannel,
+        ReorgResultChannel: sharedReorgResultChannel,
+        BranchCheckChannel: sharedBranchCheckChannel,
+        BranchCheckResultChannel: sharedBranchCheckResultChannel,
     }
 
     // create the node instance
     nodeInstance := nodePackage.Node {
         // initialize the node list with well known nodes
+        DataDir: dataDir.Path,
+        Params: params,
+        ListenAddresses: nodeConfig.ListenAddresses,
+        AdminListenAddresses: nodeConfig.AdminListenAddresses,
+        SeedPeers: nodeConfig.SeedPeers,
+        BanThreshold: nodeConfig.BanThreshold,
+        BanDuration: nodeConfig.BanDuration,
+        TargetOutbound: nodeConfig.TargetOutbound,
+        MaxInbound: nodeConfig.MaxInbound,
+        HeightRequestChannel: sharedHeightRequestChannel,
         HeightChannel: sharedHeightChannel,
         GetBlockChannel: sharedGetBlockChannel,
         AddBlockChannel: sharedAddBlockChannel,
-        NodeListMutex: nodeListMutex,
         BlockValidateChannel: sharedBlockValidateChannel,
         BlockIndexChannel: sharedBlockIndexChannel,
+        IndexQueryChannel: sharedIndexQueryChannel,
+        IndexEntryChannel: sharedIndexEntryChannel,
+        GenerateChannel: sharedGenerateChannel,
+        GeneratedChannel: sharedGeneratedChannel,
+        ReorgChannel: sharedReorgChannel,
+        ReorgResultChannel: sharedReorgResultChannel,
+        BranchCheckChannel: sharedBranchCheckChannel,
+        BranchCheckResultChannel: sharedBranchCheckResultChannel,
     }
 
-    // this is just a test, improve later to make genesis block mined rather than manually created
-    if blockchainInstance.ReadChain() == false {
-	    blockchainInstance.Chain = append(blockchainInstance.Chain, genesisBlock)
+    err = readChain(&blockchainInstance)
+    if err != nil {
+        return err
     }
 
-    // try to read a list of known nodes from disk. If that fails, use the KNOWN_NODES variable
-    if !nodeInstance.ReadFromDisk() {
-        nodeInstance.NodeList = KNOWN_NODES
+    // seed the chain from a local bootstrap file before asking peers for anything
+    if nodeConfig.BootstrapFile != "" {
+        added, err := blockchainInstance.ImportBootstrap(nodeConfig.BootstrapFile)
+        if err != nil {
+            return err
+        }
+        fmt.Println("Imported " + strconv.Itoa(added) + " blocks from " + nodeConfig.BootstrapFile)
+    }
+
+    // try to read a list of known nodes from disk. If that fails, use the network's seed nodes
+    err = nodeInstance.ReadFromDisk()
+    if formatErr, ok := err.(*datadirPackage.FormatError); ok {
+        return formatErr
+    } else if err != nil {
+        nodeInstance.NodeList = nodeInstance.SeedNodes()
+    }
+    // bans outlive restarts, there's just nothing to read before the first one
+    err = nodeInstance.ReadBanList()
+    if formatErr, ok := err.(*datadirPackage.FormatError); ok {
+        return formatErr
+    } else if err != nil && !os.IsNotExist(err) {
+        fmt.Println("Could not read the ban list: " + err.Error())
+    }
+
+    // work out who mined blocks pay before going any further, a bad payout setting shouldn't waste any work
+    var payouts []string
+    if !nodeConfig.DisableMining {
+        payouts, err = payoutAddresses(nodeConfig, dataDir)
+        if err != nil {
+            return err
+        }
     }
 
+    // everything below stops when we get SIGINT or SIGTERM
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
     // Start the blockchain threads that listen on channels
     go blockchainInstance.SendHeight()
     go blockchainInstance.SendBlocks()
     go blockchainInstance.AddRemoteBlocks()
+    go blockchainInstance.SendIndexEntries()
+    go blockchainInstance.GenerateBlocks(ctx)
+    go blockchainInstance.ReorganizeBlocks()
+    go blockchainInstance.CheckBranches()
 
-    nodeSetup(&nodeInstance)
+    nodeSetup(&nodeInstance, nodeConfig)
 
-    syncChain(&blockchainInstance, &nodeInstance)
+    syncChain(ctx, &blockchainInstance, &nodeInstance)
 
     // start the server now that everything has synced
-    go nodeInstance.Server()
+    err = nodeInstance.Server()
+    if err != nil {
+        return err
+    }
+    // keep a session open with every node we know about
+    go nodeInstance.MaintainSessions(ctx)
 
-    // do the mining in a goroutine
-    go mineBlocks(&blockchainInstance, &nodeInstance)
+    // set up the miner unless this node never mines, and start it if asked to
+    var miner *minerPackage.Miner
+    if !nodeConfig.DisableMining {
+        miner = &minerPackage.Miner{
+            Blockchain: &blockchainInstance,
+            Node: &nodeInstance,
+            NumBlocks: nodeConfig.NumBlocks,
+            PayoutAddresses: payouts,
+            Context: ctx,
+        }
+        nodeInstance.Miner = miner
+        if nodeConfig.Mine {
+            miner.Start()
+        }
+    }
 
     // every 5 seconds, sync the nodes
-    for {
+    ticker := time.NewTicker(5000 * time.Millisecond)
+    for ctx.Err() == nil {
         go nodeInstance.SyncNodes()
-        time.Sleep(5000 * time.Millisecond)
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+        }
+    }
+    ticker.Stop()
+    stop()
+
+    // a second signal while we're shutting down kills the process as usual
+    fmt.Println("Shutting down")
+    if miner != nil {
+        miner.Stop()
+    }
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+    defer cancel()
+    nodeInstance.Shutdown(shutdownCtx)
+    blockchainInstance.WriteChain()
+    newCount, triedCount := nodeInstance.Addresses().Count()
+    fmt.Println("Saved " + strconv.Itoa(len(blockchainInstance.Chain)) + " blocks and " +
+                strconv.Itoa(newCount + triedCount) + " known nodes")
+    return nil
+}
+
+func main() {
+    // settings come from the config file, GOBLOCKCHAIN_* environment variables and flags,
+    // and every command reads the same config
+    nodeConfig, args, err := configPackage.Load(os.Args[1:])
+    if err == flag.ErrHelp {
+        printUsage()
+        return
+    } else if err != nil {
+        fmt.Println(err.Error())
+        os.Exit(2)
+    }
+    command := ""
+    if len(args) > 0 {
+        command = args[0]
+        args = args[1:]
+    }
+
+    // with no command we mine, like we always have
+    if command == "" {
+        command = "mine"
+    }
+    if command == "help" {
+        printUsage()
+        return
+    }
+    cmd, ok := commands[command]
+    if !ok {
+        fmt.Println("unknown command \"" + command + "\"")
+        printUsage()
+        os.Exit(2)
+    }
+
+    err = cmd.run(nodeConfig, args)
+    if err != nil {
+        fmt.Println(err.Error())
+        os.Exit(1)
     }
 }
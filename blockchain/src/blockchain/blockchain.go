@@ -1,32 +1,57 @@
 package blockchainPackage
 
 import (
+    "context"
     "crypto/sha256"
     "time"
     "strconv"
     "encoding/hex"
+    "errors"
     "fmt"
     "strings"
     "math/rand"
     "sync"
-    "encoding/json"
-    "io/ioutil"
+    "sync/atomic"
+    "wallet"
 )
 
-var BLOCK_TIME int64 = 120
-var BLOCK_ADJUSTMENT int = 720
-var NUM_OUTLIERS int = 60
-var JSONCHAIN string = "chain_storage.json"
-
 // define the blockchain structure. In go we add the functions for this structure later
 type Blockchain struct {
     Chain []Block
+    DataDir string
+    Params *NetworkParams
+    // how many goroutines ProofOfWork searches with. Once mining has started
+    // use GetMiningThreads and SetMiningThreads, they take BlockMutex
+    MiningThreads int
+    // the node asks for our height on HeightRequestChannel and we answer on HeightChannel
+    HeightRequestChannel chan bool
     HeightChannel chan int
     BlockIndexChannel chan int
     GetBlockChannel chan Block
     AddBlockChannel chan Block
-    BlockValidateChannel chan bool
+    // nil when a block from the node is accepted, otherwise why it wasn't
+    BlockValidateChannel chan error
+    IndexQueryChannel chan IndexQuery
+    IndexEntryChannel chan IndexEntry
+    GenerateChannel chan GenerateRequest
+    GeneratedChannel chan []Block
+    ReorgChannel chan Branch
+    ReorgResultChannel chan bool
+    // nil when every block of a branch is valid, otherwise why the first bad one isn't
+    BranchCheckChannel chan Branch
+    BranchCheckResultChannel chan error
     BlockMutex sync.Mutex
+    // where block timestamps come from. When nil it's time.Now, or a clock that
+    // moves one block time per block on networks with deterministic mining
+    Clock func() time.Time
+    loggedBlocks int
+    index *BlockIndex
+}
+
+// a request from the node package to mine blocks right away
+type GenerateRequest struct {
+    Blocks int
+    Address string
 }
 
 // define the block structure
@@ -36,6 +61,8 @@ type Block struct {
     Proof int
     PreviousHash string
     Difficulty string
+    // the address the block's reward is paid to, empty if the miner didn't set one
+    Coinbase string `json:",omitempty"`
 }
 
 // add a function to the blockchain struct to get the previous block
@@ -52,7 +79,8 @@ func (bc *Blockchain) PrintBlockInfo(index int) {
     fmt.Println("Hash of the previous block is " + block.PreviousHash)
     fmt.Println("Hash of the current block is " + bc.HashBlock(block))
     fmt.Println("Difficulty of the block is " + block.Difficulty)
-    fmt.Println("\n\n")
+    fmt.Println("Coinbase of the block is " + block.Coinbase)
+    fmt.Print("\n\n\n")
 }
 
 // Increment hex value by one lexicographically. Used to adjust difficulty 
@@ -133,19 +161,26 @@ func hexDec(hash []byte) []byte {
 // A function to adjust the difficulty based on the average time between
 // the last 720 blocks with 120 outliers removed
 func (bc *Blockchain) AdjustDifficulty() string {
+    return bc.adjustDifficulty(bc.Chain)
+}
+
+// the difficulty the block after chain has to be mined with
+func (bc *Blockchain) adjustDifficulty(chain []Block) string {
+    params := bc.GetParams()
+
     // check average time between last 10 blocks
-    if (len(bc.Chain) <= BLOCK_ADJUSTMENT) {
-        return bc.Chain[0].Difficulty
+    if (len(chain) <= params.BlockAdjustment) {
+        return chain[0].Difficulty
     } else {
         var timestamps []int64
-        for i := len(bc.Chain) - 1; i > len(bc.Chain) - BLOCK_ADJUSTMENT; i-- {
+        for i := len(chain) - 1; i > len(chain) - params.BlockAdjustment; i-- {
             if (i > 0) {
-                timestamps = append(timestamps, bc.Chain[i].Timestamp - bc.Chain[i-1].Timestamp)
+                timestamps = append(timestamps, chain[i].Timestamp - chain[i-1].Timestamp)
             }
         }
 
         // Take out the highest and lowest OUTLIER_NUM timestamps
-        for i := 0; i < NUM_OUTLIERS; i++ {
+        for i := 0; i < params.NumOutliers; i++ {
             // identify the highest and lowest
             var min int64 = 99999999
             var max int64 = -1
@@ -173,10 +208,10 @@ func (bc *Blockchain) AdjustDifficulty() string {
             running_total = running_total + timestamps[j]
         }
         average := running_total / int64(len(timestamps))
-        b := []byte(bc.Chain[len(bc.Chain) - 1].Difficulty)
+        b := []byte(chain[len(chain) - 1].Difficulty)
 
         // either increase or decrease the difficulty based on the average
-        if (average > BLOCK_TIME) {
+        if (average > params.BlockTime) {
             return string(hexInc(b))
         } else {
             return string(hexDec(b))
@@ -184,28 +219,139 @@ func (bc *Blockchain) AdjustDifficulty() string {
     }
 }
 
-// add a function to the blockchain struct to add a new block
-func (bc *Blockchain) AddBlock() {
-    newBlock := new(Block)
-    newBlock.Proof, newBlock.Timestamp = bc.ProofOfWork()
-    //newBlock.Timestamp = time.Now().Unix()
-    newBlock.Index = len(bc.Chain)
-    newBlock.PreviousHash = bc.HashBlock(bc.Chain[len(bc.Chain) - 1])
-    newBlock.Difficulty = bc.AdjustDifficulty()
+// the current time by the blockchain's clock, for mining block height. Without
+// one, networks with deterministic mining count one block time per block from
+// the genesis block, so the same run always makes the same blocks
+func (bc *Blockchain) now(height int) time.Time {
+    if bc.Clock != nil {
+        return bc.Clock()
+    }
+    params := bc.GetParams()
+    if params.DeterministicMining {
+        return time.Unix(params.GenesisBlock.Timestamp + int64(height) * params.BlockTime, 0)
+    }
+    return time.Now()
+}
+
+// the height of the chain and its newest block, read together
+func (bc *Blockchain) Tip() (int, Block) {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+    return len(bc.Chain), bc.Chain[len(bc.Chain) - 1]
+}
+
+// how many goroutines ProofOfWork searches with
+func (bc *Blockchain) GetMiningThreads() int {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+    return bc.MiningThreads
+}
 
+func (bc *Blockchain) SetMiningThreads(threads int) {
     bc.BlockMutex.Lock()
-    bc.Chain = append(bc.Chain, *newBlock)
+    bc.MiningThreads = threads
     bc.BlockMutex.Unlock()
 }
 
+// Mine a block paying out to address on top of our tip and add it to the chain.
+// Returns false without a block if ctx is cancelled while mining, or if the
+// block is turned down because another one got there first
+func (bc *Blockchain) MineBlock(ctx context.Context, address string) (Block, bool) {
+    // everything the new block builds on is read at once, if the tip moves while
+    // we mine the block just doesn't connect any more
+    bc.BlockMutex.Lock()
+    tip := bc.Chain[len(bc.Chain) - 1]
+    newBlock := Block{
+        Index: len(bc.Chain),
+        PreviousHash: bc.HashBlock(tip),
+        Difficulty: bc.AdjustDifficulty(),
+        Coinbase: address,
+    }
+    bc.BlockMutex.Unlock()
+
+    var found bool
+    newBlock.Proof, newBlock.Timestamp, found = bc.ProofOfWork(ctx, tip)
+    if !found {
+        return Block{}, false
+    }
+    if bc.AcceptBlock(newBlock) != nil {
+        return Block{}, false
+    }
+    return newBlock, true
+}
+
+// add a function to the blockchain struct to add a new block paying out to address.
+// Returns false without a block if ctx is cancelled while mining
+func (bc *Blockchain) AddBlock(ctx context.Context, address string) bool {
+    _, ok := bc.MineBlock(ctx, address)
+    return ok
+}
+
+// returned by AcceptBlock for a block that doesn't go on top of our chain. That
+// says nothing about whoever sent it, they may be ahead of us or on another branch
+var ErrBlockDoesNotConnect = errors.New("the block does not go on top of our chain")
+
+// returned by AcceptBlock for a block that goes on top of our chain but breaks the consensus rules
+type InvalidBlockError struct {
+    Reason string
+}
+
+func (invalidBlockError *InvalidBlockError) Error() string {
+    return "invalid block: " + invalidBlockError.Reason
+}
+
+// Append a block to the chain if it is valid. The block is on disk before this
+// returns nil. Otherwise the error is ErrBlockDoesNotConnect, an *InvalidBlockError,
+// or some other error if the block couldn't be saved
+func (bc *Blockchain) AcceptBlock(newBlock Block) error {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    // whether the block goes on our tip is decided here, under the lock, so a
+    // reorg can't make a block that was just late look like a broken one
+    if len(bc.Chain) == 0 || newBlock.Index != len(bc.Chain) ||
+       newBlock.PreviousHash != bc.HashBlock(bc.Chain[len(bc.Chain) - 1]) {
+        return ErrBlockDoesNotConnect
+    }
+
+    bc.Chain = append(bc.Chain, newBlock)
+    err := bc.checkBlockAt(bc.Chain, len(bc.Chain) - 1)
+    if err != nil {
+        // the new block is invalid, delete it
+        bc.Chain = bc.Chain[:len(bc.Chain) - 1]
+        fmt.Println(err.Error())
+        return &InvalidBlockError{Reason: err.Error()}
+    }
+    if !bc.persistBlock(newBlock) {
+        // we couldn't save the block, so don't claim to have it
+        bc.Chain = bc.Chain[:len(bc.Chain) - 1]
+        return errors.New("block " + strconv.Itoa(newBlock.Index) + " could not be saved")
+    }
+    bc.catchUpIndex()
+    return nil
+}
+
+// Remove the most recent block from the chain and from disk
+func (bc *Blockchain) RemoveLastBlock() {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    bc.Chain = bc.Chain[:len(bc.Chain) - 1]
+    if bc.index != nil {
+        bc.index.removeLast()
+    }
+    bc.writeChain()
+}
+
 // add a function to the blockchain struct to create a hash
 func (bc *Blockchain) HashBlock(block Block) string {
     var hash = sha256.New()
     hash.Write([]byte(strconv.Itoa(block.Index) +
-               time.Unix(block.Timestamp, 0).Format(time.UnixDate) +
+               time.Unix(block.Timestamp, 0).UTC().Format(time.UnixDate) +
                strconv.Itoa(block.Proof) +
                block.PreviousHash +
-               block.Difficulty))
+               block.Difficulty +
+               block.Coinbase))
     hashed := hash.Sum(nil)
     return hex.EncodeToString(hashed)
 }
@@ -222,31 +368,62 @@ func (bc *Blockchain) ProofOfWorkCalc(proof int, previous_proof int, Timestamp i
 }
 
 // The core mining function, tries random numbers until finding a golden hash
-func (bc *Blockchain) ProofOfWork() (int, int64) {
-    rand.Seed(time.Now().UnixNano())
+// for the block after tip. The search is split across MiningThreads goroutines,
+// each trying every n-th number. Returns false if ctx is cancelled first
+func (bc *Blockchain) ProofOfWork(ctx context.Context, tip Block) (int, int64, bool) {
     var r int
-    var Timestamp int64
-    r = rand.Intn(2147483647)
-    for true {
-	Timestamp = time.Now().Unix()
-        previous_proof := bc.Chain[len(bc.Chain) - 1].Proof
-	result_hash := bc.ProofOfWorkCalc(r, previous_proof, Timestamp)
+    threads := bc.GetMiningThreads()
+    if bc.GetParams().DeterministicMining {
+        // always search from zero on one thread so runs can be repeated exactly
+        r = 0
+        threads = 1
+    } else {
+        rand.Seed(time.Now().UnixNano())
+        r = rand.Intn(2147483647)
+    }
+    if threads < 1 {
+        threads = 1
+    }
 
-        if strings.Compare(result_hash, bc.Chain[len(bc.Chain) - 1].Difficulty) < 1 {
-            break
-        }
-        r++
+    type result struct {
+        proof int
+        timestamp int64
+    }
+    found := make(chan result, threads)
+    var done int32
+    for i := 0; i < threads; i++ {
+        go func(r int) {
+            for atomic.LoadInt32(&done) == 0 {
+	        Timestamp := bc.now(tip.Index + 1).Unix()
+	        result_hash := bc.ProofOfWorkCalc(r, tip.Proof, Timestamp)
+
+                if strings.Compare(result_hash, tip.Difficulty) < 1 {
+                    found <- result{r, Timestamp}
+                    return
+                }
+                r += threads
+            }
+        }(r + i)
+    }
+
+    // take the first answer and tell the other threads to stop
+    defer atomic.StoreInt32(&done, 1)
+    select {
+    case winner := <-found:
+        return winner.proof, winner.timestamp, true
+    case <-ctx.Done():
+        return 0, 0, false
     }
-    return r, Timestamp
 }
 
 // A function to use channels to send the blockchain height to the node package
 func (bc *Blockchain) SendHeight() {
     for true {
-        i := <-bc.HeightChannel
-        if i == 0 {
-            bc.HeightChannel <-len(bc.Chain)
-        }
+        <-bc.HeightRequestChannel
+        bc.BlockMutex.Lock()
+        height := len(bc.Chain)
+        bc.BlockMutex.Unlock()
+        bc.HeightChannel <- height
     }
 }
 
@@ -254,103 +431,113 @@ func (bc *Blockchain) SendHeight() {
 func (bc *Blockchain) SendBlocks() {
     for true {
         i := <-bc.BlockIndexChannel
+        // make an "error" block unless we have block i
+        respBlock := Block {
+            Index: -1,
+        }
+        bc.BlockMutex.Lock()
         if i < len(bc.Chain) && i >= 0 {
-            bc.GetBlockChannel <-bc.Chain[i]
-        } else {
-            // make an "error" block
-            respBlock := Block {
-                Index: -1,
-            }
-            bc.GetBlockChannel <-respBlock
+            respBlock = bc.Chain[i]
         }
+        bc.BlockMutex.Unlock()
+        bc.GetBlockChannel <-respBlock
     }
 }
 
+// A function to answer hash and height lookups from the node package
+func (bc *Blockchain) SendIndexEntries() {
+    for true {
+        query := <-bc.IndexQueryChannel
+        bc.IndexEntryChannel <- bc.Lookup(query)
+    }
+}
+
+// A function to mine blocks on request from the node package, used by regtest
+func (bc *Blockchain) GenerateBlocks(ctx context.Context) {
+    for true {
+        request := <-bc.GenerateChannel
+        bc.GeneratedChannel <- bc.Generate(ctx, request.Blocks, request.Address)
+    }
+}
+
+// Mine count blocks paying out to address and return them. Only useful when the
+// difficulty is trivial, otherwise this takes as long as normal mining
+func (bc *Blockchain) Generate(ctx context.Context, count int, address string) []Block {
+    blocks := []Block{}
+    for attempts := 0; len(blocks) < count && attempts < count * 10 && ctx.Err() == nil; attempts++ {
+        // another miner may beat us to a height, in which case we just try again
+        if block, ok := bc.MineBlock(ctx, address); ok {
+            blocks = append(blocks, block)
+        }
+    }
+    return blocks
+}
+
 // A function to receive a new block from the node package
 func (bc *Blockchain) AddRemoteBlocks() {
     for true {
         // listen for a block from the node goroutine
         newBlock := <-bc.AddBlockChannel
-        bc.BlockMutex.Lock()
-        bc.Chain = append(bc.Chain, newBlock)
-        bc.BlockMutex.Unlock()
-        fmt.Println("Another miner found block " + strconv.Itoa(len(bc.Chain)))
-        if !bc.ValidateChain() {
-            // the new block is invalid, delete it
-            bc.BlockMutex.Lock()
-            bc.Chain = bc.Chain[:len(bc.Chain) - 1]
-            bc.BlockMutex.Unlock()
-            // let the node package know that the block was rejected
-            bc.BlockValidateChannel <- false
-        } else {
-            bc.BlockValidateChannel <- true
-        }
+        fmt.Println("Another miner found block " + strconv.Itoa(newBlock.Index + 1))
+        // let the node package know whether the block was accepted, and why not
+        bc.BlockValidateChannel <- bc.AcceptBlock(newBlock)
     }
 }
 
 //add function to validate blockchain
 func (bc *Blockchain) ValidateChain() bool {
-    for i := 1; i <= len(bc.Chain); i++ {
-		//current block
-        block := bc.Chain[len(bc.Chain) - 1]
-		//previous block
-	prev_block :=  bc.Chain[len(bc.Chain) - 2]
+    // a chain that doesn't start from our network's genesis block is never valid
+    if len(bc.Chain) == 0 || bc.HashBlock(bc.Chain[0]) != bc.GetParams().GenesisHash {
+        fmt.Println("the chain does not start with the genesis block")
+        return false
+    }
+    if len(bc.Chain) == 1 {
+        return true
+    }
+    block := bc.Chain[len(bc.Chain) - 1]
+    err := bc.checkBlockAt(bc.Chain, len(bc.Chain) - 1)
+    if err != nil {
+        fmt.Println(err.Error())
+        fmt.Println(block)
+        return false
+    }
+    return true
+}
+
+// Check the block at height against the chain before it, including the
+// difficulty it had to be mined with. Returns why the block is invalid
+func (bc *Blockchain) checkBlockAt(chain []Block, height int) error {
+    err := bc.checkBlock(chain[height], chain[height - 1])
+    if err != nil {
+        return err
+    }
+    if chain[height].Difficulty != bc.adjustDifficulty(chain[:height]) {
+        return errors.New("the new block had the wrong difficulty")
+    }
+    return nil
+}
+
+// check a single block against the block before it
+func (bc *Blockchain) checkBlock(block Block, prev_block Block) error {
 	proof_hash := bc.ProofOfWorkCalc(block.Proof, prev_block.Proof, block.Timestamp)
 	//verify index
         if block.Index != prev_block.Index + 1 {
-            fmt.Println("the new block had the wrong index")
-            fmt.Println(block)
-	    return false
+            return errors.New("the new block had the wrong index")
 	}
 	//verify time stamp
         if block.Timestamp < prev_block.Timestamp {
-            fmt.Println("the new block had a bad timestamp")
-            fmt.Println(block)
-	    return false
+            return errors.New("the new block had a bad timestamp")
 	}
 	//verify proof
 	if strings.Compare(proof_hash, prev_block.Difficulty) != -1 {
-            fmt.Println("the new block did not reach the difficulty target")
-            fmt.Println(block)
-	    return false
+            return errors.New("the new block did not reach the difficulty target")
         }
 	if bc.HashBlock(prev_block) != block.PreviousHash {
-            fmt.Println("the new block had a bad previous hash field")
-            fmt.Println(block)
-	    return false
+            return errors.New("the new block had a bad previous hash field")
 	}
-    }
-    return true
-}
-
-//Write json to drive
-func (bc *Blockchain) WriteChain() {
-	jsonChain, err := json.Marshal(bc.Chain)
-	if err != nil{
-		fmt.Println(err.Error())
-		return
-	}
-	err = ioutil.WriteFile(JSONCHAIN, jsonChain, 0644)
-	if err != nil{
-		fmt.Println(err.Error())
-		return
-	}
-}
-
-
-//Read json from drive
-func (bc *Blockchain) ReadChain() bool {
-	diskChainList := []Block{}
-
-	chainData, err := ioutil.ReadFile(JSONCHAIN)
-	if err != nil {
-		return false
-	}
-	err = json.Unmarshal(chainData, &diskChainList)
-	if err != nil{
-		return false
+	//verify payout address, blocks without one pay nobody
+	if block.Coinbase != "" && walletPackage.ValidateAddress(block.Coinbase) != nil {
+            return errors.New("the new block had a bad coinbase address")
 	}
-
-	bc.Chain = diskChainList
-	return true
+    return nil
 }
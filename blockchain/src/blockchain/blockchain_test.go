@@ -0,0 +1,33 @@
+package blockchainPackage
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestMiningStopsWhenCancelled(t *testing.T) {
+    // mainnet's difficulty takes long enough that the cancel always comes first
+    bc := &Blockchain{
+        Chain: []Block{MainNetParams.GenesisBlock},
+        DataDir: t.TempDir(),
+        Params: &MainNetParams,
+        MiningThreads: 2,
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+
+    started := time.Now()
+    if bc.AddBlock(ctx, "") {
+        t.Fatal("a block was mined after mining was cancelled")
+    }
+    if elapsed := time.Since(started); elapsed > 5 * time.Second {
+        t.Errorf("mining took %v to stop", elapsed)
+    }
+    if len(bc.Chain) != 1 {
+        t.Errorf("the chain has %d blocks, want just the genesis block", len(bc.Chain))
+    }
+    if blocks := bc.Generate(ctx, 3, ""); len(blocks) != 0 {
+        t.Errorf("generated %d blocks after mining was cancelled", len(blocks))
+    }
+}
@@ -0,0 +1,146 @@
+package blockchainPackage
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "datadir"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+)
+
+// every bootstrap file starts with a header holding this
+var BOOTSTRAP_MAGIC string = "go_blockchain-bootstrap"
+
+// bump this whenever the layout of bootstrap files changes
+var BOOTSTRAP_FORMAT_VERSION int = 1
+
+// A bootstrap file is gzipped JSON lines: this header, then Count blocks in
+// height order starting at StartHeight
+type bootstrapHeader struct {
+    Magic string
+    Version int
+    ChainID string
+    GenesisHash string
+    StartHeight int
+    Count int
+}
+
+// Write blocks first to last (inclusive) to a bootstrap file another node can import
+func (bc *Blockchain) ExportBootstrap(path string, first int, last int) (int, error) {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    if first < 0 || last >= len(bc.Chain) || first > last {
+        return 0, errors.New("can't export blocks " + strconv.Itoa(first) + " to " + strconv.Itoa(last) +
+                             " from a chain of " + strconv.Itoa(len(bc.Chain)) + " blocks")
+    }
+
+    buffer := new(bytes.Buffer)
+    compressed := gzip.NewWriter(buffer)
+    encoder := json.NewEncoder(compressed)
+    err := encoder.Encode(bootstrapHeader{
+        Magic: BOOTSTRAP_MAGIC,
+        Version: BOOTSTRAP_FORMAT_VERSION,
+        ChainID: bc.GetParams().ChainID,
+        GenesisHash: bc.GetParams().GenesisHash,
+        StartHeight: first,
+        Count: last - first + 1,
+    })
+    if err != nil {
+        return 0, err
+    }
+    for height := first; height <= last; height++ {
+        err = encoder.Encode(bc.Chain[height])
+        if err != nil {
+            return 0, err
+        }
+    }
+    err = compressed.Close()
+    if err != nil {
+        return 0, err
+    }
+    return last - first + 1, datadirPackage.WriteFileAtomic(path, buffer.Bytes(), 0644)
+}
+
+// Add the blocks from a bootstrap file that we don't have yet. Blocks we already
+// have must match, and each new block is checked against the consensus rules.
+// The chain is saved once at the end, keeping every valid block before any
+// problem. Returns how many blocks were added
+func (bc *Blockchain) ImportBootstrap(path string) (int, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer file.Close()
+    compressed, err := gzip.NewReader(file)
+    if err != nil {
+        return 0, errors.New(path + " is not a bootstrap file: " + err.Error())
+    }
+    decoder := json.NewDecoder(bufio.NewReader(compressed))
+
+    var header bootstrapHeader
+    err = decoder.Decode(&header)
+    if err != nil || header.Magic != BOOTSTRAP_MAGIC {
+        return 0, errors.New(path + " is not a bootstrap file")
+    }
+    if header.Version != BOOTSTRAP_FORMAT_VERSION {
+        return 0, &datadirPackage.FormatError{Path: path, Version: header.Version, Want: BOOTSTRAP_FORMAT_VERSION}
+    }
+    if header.ChainID != bc.GetParams().ChainID || header.GenesisHash != bc.GetParams().GenesisHash {
+        return 0, errors.New(path + " holds blocks for " + header.ChainID + ", not " + bc.GetParams().ChainID)
+    }
+
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    if header.StartHeight > len(bc.Chain) {
+        return 0, errors.New(path + " starts at block " + strconv.Itoa(header.StartHeight) +
+                             " but we only have " + strconv.Itoa(len(bc.Chain)) + " blocks, import the earlier blocks first")
+    }
+
+    added := 0
+    for i := 0; i < header.Count; i++ {
+        height := header.StartHeight + i
+        var block Block
+        err = decoder.Decode(&block)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            err = errors.New(path + " ends after " + strconv.Itoa(i) + " of its " + strconv.Itoa(header.Count) + " blocks")
+            break
+        } else if err != nil {
+            err = errors.New("block " + strconv.Itoa(height) + " in " + path + " is not readable: " + err.Error())
+            break
+        }
+
+        if height < len(bc.Chain) {
+            // a different block at a height we have means the file is from another fork
+            if bc.HashBlock(block) != bc.HashBlock(bc.Chain[height]) {
+                err = errors.New("block " + strconv.Itoa(height) + " in " + path + " does not match the stored chain")
+                break
+            }
+            continue
+        }
+        bc.Chain = append(bc.Chain, block)
+        err = bc.checkBlockAt(bc.Chain, height)
+        if err != nil {
+            bc.Chain = bc.Chain[:height]
+            err = errors.New("block " + strconv.Itoa(height) + " in " + path + " is invalid: " + err.Error())
+            break
+        }
+        added++
+        if added % 10000 == 0 {
+            fmt.Println("Imported " + strconv.Itoa(added) + " blocks")
+        }
+    }
+
+    if added > 0 {
+        if !bc.writeChain() {
+            return 0, errors.New("could not save the imported blocks")
+        }
+    }
+    return added, err
+}
@@ -0,0 +1,107 @@
+package blockchainPackage
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+func TestExportRanges(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 3, "")
+
+    tests := []struct {
+        name string
+        first int
+        last int
+        want int
+        wantErr bool
+    }{
+        {"whole chain", 0, 3, 4, false},
+        {"the tip", 2, 3, 2, false},
+        {"before genesis", -1, 3, 0, true},
+        {"past the tip", 0, 4, 0, true},
+        {"backwards", 3, 2, 0, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            exported, err := bc.ExportBootstrap(filepath.Join(t.TempDir(), "bootstrap"), test.first, test.last)
+            if exported != test.want || (err != nil) != test.wantErr {
+                t.Errorf("got %d, %v, want %d and an error: %v", exported, err, test.want, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestImportBootstrap(t *testing.T) {
+    source := newTestChain(t)
+    mineBlocks(t, source, 5, "")
+    // export blocks first to last of a chain to a file in the test's directory
+    export := func(t *testing.T, bc *Blockchain, first int, last int) string {
+        path := filepath.Join(t.TempDir(), "bootstrap")
+        _, err := bc.ExportBootstrap(path, first, last)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return path
+    }
+
+    tests := []struct {
+        name string
+        // the file to import into bc, which starts with just the genesis block
+        file func(t *testing.T, bc *Blockchain) string
+        wantAdded int
+        wantErr bool
+        wantBlocks int
+    }{
+        {"whole chain", func(t *testing.T, bc *Blockchain) string {
+            return export(t, source, 0, 5)
+        }, 5, false, 6},
+        {"overlapping what we have", func(t *testing.T, bc *Blockchain) string {
+            _, err := bc.ImportBootstrap(export(t, source, 0, 2))
+            if err != nil {
+                t.Fatal(err)
+            }
+            return export(t, source, 1, 5)
+        }, 3, false, 6},
+        {"starts past our tip", func(t *testing.T, bc *Blockchain) string {
+            return export(t, source, 3, 5)
+        }, 0, true, 1},
+        {"another fork", func(t *testing.T, bc *Blockchain) string {
+            mineBlocks(t, bc, 1, newTestAddress(t))
+            return export(t, source, 0, 5)
+        }, 0, true, 2},
+        {"invalid block", func(t *testing.T, bc *Blockchain) string {
+            broken := &Blockchain{Chain: append([]Block(nil), source.Chain...), Params: source.Params}
+            broken.Chain[3].Coinbase = "gb1234"
+            return export(t, broken, 0, 5)
+        }, 2, true, 3},
+        {"another network", func(t *testing.T, bc *Blockchain) string {
+            return export(t, &Blockchain{Chain: []Block{MainNetParams.GenesisBlock}, Params: &MainNetParams}, 0, 0)
+        }, 0, true, 1},
+        {"not a bootstrap file", func(t *testing.T, bc *Blockchain) string {
+            path := filepath.Join(t.TempDir(), "bootstrap")
+            err := ioutil.WriteFile(path, []byte("blocks"), 0644)
+            if err != nil {
+                t.Fatal(err)
+            }
+            return path
+        }, 0, true, 1},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := newTestChain(t)
+            path := test.file(t, bc)
+            added, err := bc.ImportBootstrap(path)
+            if added != test.wantAdded || (err != nil) != test.wantErr {
+                t.Errorf("got %d, %v, want %d and an error: %v", added, err, test.wantAdded, test.wantErr)
+            }
+            if len(bc.Chain) != test.wantBlocks {
+                t.Errorf("the chain has %d blocks, want %d", len(bc.Chain), test.wantBlocks)
+            }
+            if reopened := reopen(t, bc); len(reopened.Chain) != test.wantBlocks {
+                t.Errorf("read back %d blocks, want %d", len(reopened.Chain), test.wantBlocks)
+            }
+        })
+    }
+}
@@ -0,0 +1,177 @@
+package blockchainPackage
+
+import (
+    "datadir"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+)
+
+var JSONINDEX string = "block_index.json"
+
+// where a transaction can be found in the chain
+type TxLocation struct {
+    BlockHash string
+    Height int
+    Position int
+}
+
+// define the lookup tables that make blocks and transactions addressable by hash
+type BlockIndex struct {
+    HashToHeight map[string]int
+    HeightToHash []string
+    // blocks don't carry transactions yet, so this stays empty until they do
+    TxToLocation map[string]TxLocation
+}
+
+// a query from the node package, only one of the fields should be set
+type IndexQuery struct {
+    Hash string
+    Height int
+    TxID string
+}
+
+// the answer to an IndexQuery
+type IndexEntry struct {
+    Found bool
+    Height int
+    Hash string
+    Block Block
+    Tx TxLocation
+}
+
+func newBlockIndex() *BlockIndex {
+    return &BlockIndex{
+        HashToHeight: make(map[string]int),
+        HeightToHash: make([]string, 0),
+        TxToLocation: make(map[string]TxLocation),
+    }
+}
+
+// add the next block in the chain to the index
+func (index *BlockIndex) add(hash string) {
+    index.HashToHeight[hash] = len(index.HeightToHash)
+    index.HeightToHash = append(index.HeightToHash, hash)
+}
+
+// remove the most recent block from the index
+func (index *BlockIndex) removeLast() {
+    if len(index.HeightToHash) == 0 {
+        return
+    }
+    height := len(index.HeightToHash) - 1
+    hash := index.HeightToHash[height]
+    delete(index.HashToHeight, hash)
+    for txID, location := range index.TxToLocation {
+        if location.Height == height {
+            delete(index.TxToLocation, txID)
+        }
+    }
+    index.HeightToHash = index.HeightToHash[:height]
+}
+
+// Rebuild the indexes from scratch by hashing every block in the chain
+func (bc *Blockchain) Reindex() {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    bc.index = newBlockIndex()
+    bc.catchUpIndex()
+    bc.writeIndex()
+}
+
+// add any blocks the index is missing. The caller must hold BlockMutex
+func (bc *Blockchain) catchUpIndex() {
+    if bc.index == nil {
+        bc.index = newBlockIndex()
+    }
+    for i := len(bc.index.HeightToHash); i < len(bc.Chain); i++ {
+        bc.index.add(bc.HashBlock(bc.Chain[i]))
+    }
+}
+
+// write the indexes to disk. The caller must hold BlockMutex
+func (bc *Blockchain) writeIndex() bool {
+    if bc.index == nil {
+        return false
+    }
+    jsonIndex, err := json.Marshal(bc.index)
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+    err = datadirPackage.WriteFileAtomic(bc.dataFile(JSONINDEX), jsonIndex, 0644)
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+    return true
+}
+
+// Read the indexes from disk and check them against the chain. Anything that
+// doesn't line up is thrown away and rebuilt
+func (bc *Blockchain) readIndex() {
+    diskIndex := newBlockIndex()
+
+    indexData, err := ioutil.ReadFile(bc.dataFile(JSONINDEX))
+    if err == nil {
+        err = json.Unmarshal(indexData, diskIndex)
+    }
+    if err != nil || diskIndex.HashToHeight == nil || diskIndex.TxToLocation == nil {
+        diskIndex = newBlockIndex()
+    }
+
+    // the index may be ahead of the chain if blocks were removed, cut it back
+    for len(diskIndex.HeightToHash) > len(bc.Chain) {
+        diskIndex.removeLast()
+    }
+
+    // make sure the index describes this chain and not some other one
+    tip := len(diskIndex.HeightToHash) - 1
+    if tip >= 0 && diskIndex.HeightToHash[tip] != bc.HashBlock(bc.Chain[tip]) {
+        fmt.Println("Block index does not match the chain, rebuilding it")
+        diskIndex = newBlockIndex()
+    }
+
+    bc.index = diskIndex
+    bc.catchUpIndex()
+}
+
+// Look up a block by its hash or height, or a transaction by its ID
+func (bc *Blockchain) Lookup(query IndexQuery) IndexEntry {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    entry := IndexEntry{Height: -1}
+    bc.catchUpIndex()
+
+    if query.TxID != "" {
+        location, ok := bc.index.TxToLocation[query.TxID]
+        if !ok {
+            return entry
+        }
+        entry.Found = true
+        entry.Tx = location
+        entry.Height = location.Height
+        entry.Hash = location.BlockHash
+        entry.Block = bc.Chain[location.Height]
+        return entry
+    }
+
+    height := query.Height
+    if query.Hash != "" {
+        var ok bool
+        height, ok = bc.index.HashToHeight[query.Hash]
+        if !ok {
+            return entry
+        }
+    }
+    if height < 0 || height >= len(bc.Chain) {
+        return entry
+    }
+    entry.Found = true
+    entry.Height = height
+    entry.Hash = bc.index.HeightToHash[height]
+    entry.Block = bc.Chain[height]
+    return entry
+}
@@ -0,0 +1,106 @@
+package blockchainPackage
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "testing"
+)
+
+func TestLookup(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 3, "")
+    tipHash := bc.HashBlock(bc.Chain[3])
+
+    tests := []struct {
+        name string
+        query IndexQuery
+        wantFound bool
+        wantHeight int
+    }{
+        {"genesis by height", IndexQuery{Height: 0}, true, 0},
+        {"tip by height", IndexQuery{Height: 3}, true, 3},
+        {"tip by hash", IndexQuery{Hash: tipHash}, true, 3},
+        {"genesis by hash", IndexQuery{Hash: bc.HashBlock(RegTestParams.GenesisBlock)}, true, 0},
+        {"height past the tip", IndexQuery{Height: 4}, false, -1},
+        {"negative height", IndexQuery{Height: -1}, false, -1},
+        {"unknown hash", IndexQuery{Hash: "00ff"}, false, -1},
+        {"unknown transaction", IndexQuery{TxID: "00ff"}, false, -1},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            entry := bc.Lookup(test.query)
+            if entry.Found != test.wantFound || entry.Height != test.wantHeight {
+                t.Fatalf("got found %v at %d, want found %v at %d", entry.Found, entry.Height, test.wantFound, test.wantHeight)
+            }
+            if entry.Found && entry.Hash != bc.HashBlock(entry.Block) {
+                t.Errorf("the entry's hash doesn't match its block")
+            }
+        })
+    }
+}
+
+func TestIndexIsCheckedAgainstTheChain(t *testing.T) {
+    tests := []struct {
+        name string
+        // change the saved index before it is read back
+        damage func(index *BlockIndex)
+    }{
+        {"index ahead of the chain", func(index *BlockIndex) { index.add("00aa") }},
+        {"index from another chain", func(index *BlockIndex) {
+            last := len(index.HeightToHash) - 1
+            delete(index.HashToHeight, index.HeightToHash[last])
+            index.HeightToHash[last] = "00bb"
+            index.HashToHeight["00bb"] = last
+        }},
+        {"index behind the chain", func(index *BlockIndex) { index.removeLast() }},
+        {"unreadable index", nil},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := newTestChain(t)
+            mineBlocks(t, bc, 3, "")
+            if !bc.WriteChain() {
+                t.Fatal("could not write the chain")
+            }
+
+            indexData := []byte("not json")
+            if test.damage != nil {
+                test.damage(bc.index)
+                var err error
+                indexData, err = json.Marshal(bc.index)
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            err := ioutil.WriteFile(bc.dataFile(JSONINDEX), indexData, 0644)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            reopened := reopen(t, bc)
+            if len(reopened.index.HeightToHash) != len(bc.Chain) {
+                t.Fatalf("index has %d blocks, want %d", len(reopened.index.HeightToHash), len(bc.Chain))
+            }
+            for height, block := range bc.Chain {
+                hash := bc.HashBlock(block)
+                if reopened.index.HeightToHash[height] != hash || reopened.index.HashToHeight[hash] != height {
+                    t.Errorf("block %d is indexed wrong", height)
+                }
+            }
+        })
+    }
+}
+
+func TestRemovedBlocksLeaveTheIndex(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 2, "")
+    removed := bc.HashBlock(bc.Chain[2])
+
+    bc.RemoveLastBlock()
+    if bc.Lookup(IndexQuery{Hash: removed}).Found {
+        t.Errorf("the removed block can still be looked up")
+    }
+    if reopen(t, bc).Lookup(IndexQuery{Hash: removed}).Found {
+        t.Errorf("the removed block is back after a restart")
+    }
+}
@@ -0,0 +1,143 @@
+package blockchainPackage
+
+import (
+    "bufio"
+    "bytes"
+    "datadir"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strconv"
+)
+
+// Each step upgrades the stored blocks from version i to version i+1. Blocks are
+// handled as generic JSON so a step can rename, add or drop fields
+var chainMigrations = []func(blocks []map[string]interface{}) error{
+    // Version 0 was a bare list of blocks. Its nodes each made their own genesis
+    // block at startup and hashed blocks in local time, so these chains don't
+    // start with the network's genesis block and MigrateChain refuses them below
+    func(blocks []map[string]interface{}) error {
+        return nil
+    },
+    // version 2 added the optional Coinbase field, older blocks simply don't have one
+    func(blocks []map[string]interface{}) error {
+        return nil
+    },
+}
+
+// the layout of a chain file of any version, before its blocks are upgraded
+type rawChainFile struct {
+    Version int
+    Blocks []map[string]interface{}
+}
+
+// Upgrade the stored chain in place to CHAIN_FORMAT_VERSION, keeping a backup of
+// the old file. Returns false if there was nothing to do
+func (bc *Blockchain) MigrateChain() (bool, error) {
+    path := bc.dataFile(JSONCHAIN)
+    chainData, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+
+    version, err := datadirPackage.FormatVersion(chainData)
+    if err != nil {
+        return false, errors.New(path + " is not a readable chain file: " + err.Error())
+    }
+    if version == CHAIN_FORMAT_VERSION {
+        return false, nil
+    }
+    if version > CHAIN_FORMAT_VERSION {
+        return false, &datadirPackage.FormatError{Path: path, Version: version, Want: CHAIN_FORMAT_VERSION}
+    }
+
+    diskChain := rawChainFile{Version: version}
+    if version == 0 {
+        err = json.Unmarshal(chainData, &diskChain.Blocks)
+    } else {
+        err = json.Unmarshal(chainData, &diskChain)
+    }
+    if err != nil {
+        return false, errors.New(path + " is not a readable chain file: " + err.Error())
+    }
+
+    // blocks in the log were written in the same format as the chain file, fold them in first
+    diskChain.Blocks, err = bc.readRawLog(diskChain.Blocks)
+    if err != nil {
+        return false, err
+    }
+
+    for diskChain.Version < CHAIN_FORMAT_VERSION {
+        err = chainMigrations[diskChain.Version](diskChain.Blocks)
+        if err != nil {
+            return false, errors.New("upgrading " + path + " from version " + strconv.Itoa(diskChain.Version) + ": " + err.Error())
+        }
+        diskChain.Version++
+    }
+
+    // make sure the upgraded blocks actually read back as blocks before replacing anything
+    jsonBlocks, err := json.Marshal(diskChain.Blocks)
+    if err != nil {
+        return false, err
+    }
+    blocks := []Block{}
+    err = json.Unmarshal(jsonBlocks, &blocks)
+    if err != nil {
+        return false, errors.New("upgraded chain is not readable: " + err.Error())
+    }
+    // upgrading can't fix a chain from before nodes shared a genesis block, every
+    // block after it would have to be mined again
+    if len(blocks) == 0 || bc.HashBlock(blocks[0]) != bc.GetParams().GenesisHash {
+        return false, errors.New(path + " does not start with the " + bc.GetParams().Name + " genesis block, so it can't be upgraded. " +
+                                 "Move it out of the way and the chain will be fetched from peers again")
+    }
+
+    backupPath, err := datadirPackage.BackupFile(path, version)
+    if err != nil {
+        return false, err
+    }
+    fmt.Println("Backed up " + path + " to " + backupPath)
+
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+    bc.Chain = blocks
+    bc.index = nil
+    if !bc.writeChain() {
+        return false, errors.New("could not write the upgraded chain to " + path)
+    }
+    return true, nil
+}
+
+// read the block log without decoding the blocks, dropping anything after a torn write
+func (bc *Blockchain) readRawLog(blocks []map[string]interface{}) ([]map[string]interface{}, error) {
+    logData, err := ioutil.ReadFile(bc.dataFile(JSONLOG))
+    if os.IsNotExist(err) {
+        return blocks, nil
+    } else if err != nil {
+        return blocks, err
+    }
+
+    reader := bufio.NewReader(bytes.NewReader(logData))
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            break
+        }
+        var block map[string]interface{}
+        if json.Unmarshal(line, &block) != nil {
+            break
+        }
+        index, ok := block["Index"].(float64)
+        if !ok || int(index) > len(blocks) {
+            break
+        }
+        if int(index) == len(blocks) {
+            blocks = append(blocks, block)
+        }
+    }
+    return blocks, nil
+}
@@ -0,0 +1,107 @@
+package blockchainPackage
+
+import (
+    "datadir"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "testing"
+)
+
+func TestMigrateChain(t *testing.T) {
+    mined := newTestChain(t)
+    mineBlocks(t, mined, 3, "")
+    blocks := mined.Chain
+    mainnetGenesis, err := json.Marshal([]Block{MainNetParams.GenesisBlock})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // the chain file as an older version wrote it, with the first n blocks in it
+    jsonBlocks := func(n int) string {
+        data, err := json.Marshal(blocks[:n])
+        if err != nil {
+            t.Fatal(err)
+        }
+        return string(data)
+    }
+
+    // the chain file as the first version of the program wrote it, starting from a
+    // genesis block it made at startup, with a block mined on top
+    baselineChain := `[{"Index":0,"Timestamp":1600000000,"Proof":69,"PreviousHash":"this is just a test","Difficulty":"0000007fffffffff"},` +
+                     `{"Index":1,"Timestamp":1600000120,"Proof":123456,"PreviousHash":"3f1c9b0e5d7a2468ace0fdb97531eca86420bdf13579ace02468bdf13579ace0","Difficulty":"0000007fffffffff"}]`
+
+    tests := []struct {
+        name string
+        chainFile string
+        log string
+        wantMigrated bool
+        wantErr bool
+        wantBlocks int
+    }{
+        {"version 0 bare list", jsonBlocks(4), "", true, false, 4},
+        {"version 0 with a block log", jsonBlocks(2), logLine(t, blocks[2]) + logLine(t, blocks[3]), true, false, 4},
+        {"version 0 from its own genesis block", baselineChain, "", false, true, 0},
+        {"version 0 from another network", string(mainnetGenesis), "", false, true, 0},
+        {"version 1", `{"Version": 1, "Blocks": ` + jsonBlocks(3) + `}`, "", true, false, 3},
+        {"version 1 from another network", `{"Version": 1, "Blocks": ` + string(mainnetGenesis) + `}`, "", false, true, 0},
+        {"current version", `{"Version": ` + strconv.Itoa(CHAIN_FORMAT_VERSION) + `, "Blocks": ` + jsonBlocks(2) + `}`, "", false, false, 2},
+        {"newer version", `{"Version": 99, "Blocks": []}`, "", false, true, 0},
+        {"not a chain file", `"hello"`, "", false, true, 0},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := &Blockchain{DataDir: t.TempDir(), Params: &RegTestParams}
+            err := ioutil.WriteFile(bc.dataFile(JSONCHAIN), []byte(test.chainFile), 0644)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if test.log != "" {
+                err = ioutil.WriteFile(bc.dataFile(JSONLOG), []byte(test.log), 0644)
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            migrated, err := bc.MigrateChain()
+            if (err != nil) != test.wantErr {
+                t.Fatalf("got error %v, want an error: %v", err, test.wantErr)
+            }
+            if migrated != test.wantMigrated {
+                t.Fatalf("migrated is %v, want %v", migrated, test.wantMigrated)
+            }
+            if test.wantErr {
+                // a file we don't understand is left alone
+                data, _ := ioutil.ReadFile(bc.dataFile(JSONCHAIN))
+                if string(data) != test.chainFile {
+                    t.Errorf("the chain file was changed")
+                }
+                return
+            }
+
+            if len(reopen(t, bc).Chain) != test.wantBlocks {
+                t.Errorf("read back %d blocks, want %d", len(reopen(t, bc).Chain), test.wantBlocks)
+            }
+            if !test.wantMigrated {
+                return
+            }
+            version, _ := datadirPackage.FormatVersion([]byte(test.chainFile))
+            backup, err := ioutil.ReadFile(bc.dataFile(JSONCHAIN) + ".v" + strconv.Itoa(version) + ".bak")
+            if err != nil || string(backup) != test.chainFile {
+                t.Errorf("the old chain file wasn't backed up: %v", err)
+            }
+        })
+    }
+}
+
+func TestMigrateChainWithoutAFile(t *testing.T) {
+    bc := &Blockchain{DataDir: t.TempDir(), Params: &RegTestParams}
+    migrated, err := bc.MigrateChain()
+    if migrated || err != nil {
+        t.Errorf("got %v, %v with nothing stored, want false, nil", migrated, err)
+    }
+    if _, err := os.Stat(bc.dataFile(JSONCHAIN)); !os.IsNotExist(err) {
+        t.Errorf("migrating created a chain file")
+    }
+}
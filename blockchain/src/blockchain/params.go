@@ -0,0 +1,142 @@
+package blockchainPackage
+
+import (
+    "errors"
+    "strings"
+)
+
+// define the settings every node on a network has to agree on
+type NetworkParams struct {
+    Name string
+    // sent with every message so nodes can tell when a peer is on another network
+    ChainID string
+    GenesisBlock Block
+    GenesisHash string
+    // difficulty rules: target seconds per block, how many blocks to average over
+    // and how many of the fastest and slowest blocks to ignore
+    BlockTime int64
+    BlockAdjustment int
+    NumOutliers int
+    // coins each block pays to its coinbase address
+    BlockReward int64
+    DefaultPort int
+    // "ip:port" of nodes to ask for peers when we don't know any yet
+    SeedNodes []string
+    // search for proofs from zero instead of a random start so mining is repeatable,
+    // and allow blocks to be generated on demand
+    DeterministicMining bool
+}
+
+// The main network. The genesis blocks were made with "go_blockchain genesis" and
+// must never change, every stored chain and every peer depends on them
+var MainNetParams = NetworkParams{
+    Name: "mainnet",
+    ChainID: "go_blockchain-main",
+    GenesisBlock: Block{
+        Index: 0,
+        Timestamp: 1577836800,
+        Proof: 1946000,
+        PreviousHash: "0000000000000000000000000000000000000000000000000000000000000000",
+        Difficulty: "0000007fffffffff",
+    },
+    GenesisHash: "0053eb5c42c3d2c26d3c9bdaad5374f7276d1179808efd5469c563a9fc091ccf",
+    BlockTime: 120,
+    BlockAdjustment: 720,
+    NumOutliers: 60,
+    BlockReward: 50,
+    DefaultPort: 8080,
+    SeedNodes: []string{"192.168.0.251:8080", "192.168.0.129:8080"},
+}
+
+// A public test network with an easier starting difficulty
+var TestNetParams = NetworkParams{
+    Name: "testnet",
+    ChainID: "go_blockchain-test",
+    GenesisBlock: Block{
+        Index: 0,
+        Timestamp: 1577836800,
+        Proof: 183217,
+        PreviousHash: "0000000000000000000000000000000000000000000000000000000000000000",
+        Difficulty: "00000fffffffffff",
+    },
+    GenesisHash: "50065e81a187c6b55bb91f8d0389b1692d6ada2a1462e264da213e43439b729d",
+    BlockTime: 120,
+    BlockAdjustment: 720,
+    NumOutliers: 60,
+    BlockReward: 50,
+    DefaultPort: 18080,
+    SeedNodes: []string{"192.168.0.251:18080", "192.168.0.129:18080"},
+}
+
+// A private network for local testing. Nearly every proof meets the target and
+// the difficulty never adjusts, so blocks can be made as fast as we like
+var RegTestParams = NetworkParams{
+    Name: "regtest",
+    ChainID: "go_blockchain-regtest",
+    GenesisBlock: Block{
+        Index: 0,
+        Timestamp: 1577836800,
+        Proof: 3,
+        PreviousHash: "0000000000000000000000000000000000000000000000000000000000000000",
+        Difficulty: "7fffffffffffffff",
+    },
+    GenesisHash: "a6bd038cfd1a087f2c95b62f841eeb28215ac5633ca82ecb35c6334a1359451d",
+    BlockTime: 120,
+    BlockAdjustment: 1 << 30,
+    NumOutliers: 0,
+    BlockReward: 50,
+    DefaultPort: 28080,
+    SeedNodes: []string{},
+    DeterministicMining: true,
+}
+
+// every network a node can be started on, by name
+var Networks = map[string]*NetworkParams{
+    MainNetParams.Name: &MainNetParams,
+    TestNetParams.Name: &TestNetParams,
+    RegTestParams.Name: &RegTestParams,
+}
+
+// Look up a network's parameters by name
+func GetNetworkParams(name string) (*NetworkParams, error) {
+    params, ok := Networks[name]
+    if !ok {
+        return nil, errors.New("unknown network \"" + name + "\", expected mainnet, testnet or regtest")
+    }
+    return params, nil
+}
+
+// the parameters this blockchain runs with, mainnet unless told otherwise
+func (bc *Blockchain) GetParams() *NetworkParams {
+    if bc.Params == nil {
+        return &MainNetParams
+    }
+    return bc.Params
+}
+
+// Make sure a stored chain was built on this network's genesis block
+func (bc *Blockchain) CheckGenesis() error {
+    if len(bc.Chain) == 0 {
+        return errors.New("the chain is empty")
+    }
+    hash := bc.HashBlock(bc.Chain[0])
+    if hash != bc.GetParams().GenesisHash {
+        return errors.New("the stored chain starts with genesis block " + hash + " but " +
+                          bc.GetParams().Name + " starts with " + bc.GetParams().GenesisHash +
+                          ", it belongs to a different network")
+    }
+    return nil
+}
+
+// Search for a genesis block proof that meets the block's own difficulty. The
+// search always starts from zero so the same inputs give the same block
+func (bc *Blockchain) MineGenesis(genesis Block) Block {
+    genesis.Index = 0
+    for genesis.Proof = 0; ; genesis.Proof++ {
+        result_hash := bc.ProofOfWorkCalc(genesis.Proof, 0, genesis.Timestamp)
+        if strings.Compare(result_hash, genesis.Difficulty) == -1 {
+            break
+        }
+    }
+    return genesis
+}
@@ -0,0 +1,102 @@
+package blockchainPackage
+
+import (
+    "context"
+    "testing"
+)
+
+func TestGetNetworkParams(t *testing.T) {
+    tests := []struct {
+        name string
+        want *NetworkParams
+    }{
+        {"mainnet", &MainNetParams},
+        {"testnet", &TestNetParams},
+        {"regtest", &RegTestParams},
+        {"moonnet", nil},
+        {"", nil},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            params, err := GetNetworkParams(test.name)
+            if params != test.want || (err != nil) != (test.want == nil) {
+                t.Errorf("got %v, %v", params, err)
+            }
+        })
+    }
+}
+
+func TestNetworksDontOverlap(t *testing.T) {
+    chainIDs := map[string]bool{}
+    ports := map[int]bool{}
+    for _, params := range Networks {
+        if chainIDs[params.ChainID] || ports[params.DefaultPort] {
+            t.Errorf("%s shares its chain ID or port with another network", params.Name)
+        }
+        chainIDs[params.ChainID] = true
+        ports[params.DefaultPort] = true
+    }
+}
+
+func TestDeterministicMiningIsRepeatable(t *testing.T) {
+    mine := func() []Block {
+        bc := newTestChain(t)
+        blocks := bc.Generate(context.Background(), 3, "")
+        if len(blocks) != 3 {
+            t.Fatalf("generated %d blocks, want 3", len(blocks))
+        }
+        return blocks
+    }
+    first, second := mine(), mine()
+    for i := range first {
+        if first[i] != second[i] {
+            t.Errorf("block %d came out as %+v then %+v", i + 1, first[i], second[i])
+        }
+        if want := RegTestParams.GenesisBlock.Timestamp + int64(i + 1) * RegTestParams.BlockTime; first[i].Timestamp != want {
+            t.Errorf("block %d has timestamp %d, want %d", i + 1, first[i].Timestamp, want)
+        }
+    }
+}
+
+func TestGenesisBlocks(t *testing.T) {
+    for _, params := range []*NetworkParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+        t.Run(params.Name, func(t *testing.T) {
+            bc := &Blockchain{Params: params}
+            if hash := bc.HashBlock(params.GenesisBlock); hash != params.GenesisHash {
+                t.Errorf("the genesis block hashes to %s, want %s", hash, params.GenesisHash)
+            }
+            // mining it again from its fields gives the same block
+            mined := bc.MineGenesis(Block{Timestamp: params.GenesisBlock.Timestamp,
+                                          PreviousHash: params.GenesisBlock.PreviousHash,
+                                          Difficulty: params.GenesisBlock.Difficulty})
+            if mined != params.GenesisBlock {
+                t.Errorf("mined %+v, want %+v", mined, params.GenesisBlock)
+            }
+        })
+    }
+}
+
+func TestCheckGenesis(t *testing.T) {
+    tests := []struct {
+        name string
+        chain []Block
+        params *NetworkParams
+        wantErr bool
+    }{
+        {"this network's genesis", []Block{MainNetParams.GenesisBlock}, &MainNetParams, false},
+        {"no parameters means mainnet", []Block{MainNetParams.GenesisBlock}, nil, false},
+        {"another network's genesis", []Block{TestNetParams.GenesisBlock}, &MainNetParams, true},
+        {"a genesis made at startup", []Block{{Index: 0, Timestamp: 1600000000, Proof: 69, PreviousHash: "this is just a test",
+                                                Difficulty: "0000007fffffffff"}}, &MainNetParams, true},
+        {"empty chain", []Block{}, &MainNetParams, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := &Blockchain{Chain: test.chain, Params: test.params}
+            err := bc.CheckGenesis()
+            if (err != nil) != test.wantErr {
+                t.Errorf("got %v, want an error: %v", err, test.wantErr)
+            }
+        })
+    }
+}
@@ -0,0 +1,134 @@
+package blockchainPackage
+
+import (
+    "fmt"
+    "math/big"
+    "strconv"
+)
+
+// a run of blocks from a peer that follows the first ForkHeight blocks of our chain
+type Branch struct {
+    ForkHeight int
+    Blocks []Block
+}
+
+// the work it took to mine chain[from:], each block is mined against its parent's difficulty
+func chainWork(chain []Block, from int) *big.Int {
+    work := new(big.Int)
+    for height := from; height < len(chain); height++ {
+        if height == 0 {
+            work.Add(work, BlockWork(chain[0].Difficulty))
+        } else {
+            work.Add(work, BlockWork(chain[height - 1].Difficulty))
+        }
+    }
+    return work
+}
+
+// Switch to a branch that shares our first ForkHeight blocks, if every block on it
+// is valid and it has more work than the blocks it replaces. A branch that
+// simply extends our chain always has more work. Ties keep the chain we have
+func (bc *Blockchain) Reorganize(branch Branch) bool {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    // the genesis block is never replaced
+    if branch.ForkHeight < 1 || branch.ForkHeight > len(bc.Chain) || len(branch.Blocks) == 0 {
+        return false
+    }
+
+    // blocks at the start of the branch that we already have aren't replaced
+    for len(branch.Blocks) > 0 && branch.ForkHeight < len(bc.Chain) &&
+        bc.HashBlock(branch.Blocks[0]) == bc.HashBlock(bc.Chain[branch.ForkHeight]) {
+        branch.ForkHeight++
+        branch.Blocks = branch.Blocks[1:]
+    }
+    if len(branch.Blocks) == 0 {
+        return false
+    }
+
+    candidate := make([]Block, branch.ForkHeight, branch.ForkHeight + len(branch.Blocks))
+    copy(candidate, bc.Chain[:branch.ForkHeight])
+    candidate = append(candidate, branch.Blocks...)
+    for height := branch.ForkHeight; height < len(candidate); height++ {
+        err := bc.checkBlockAt(candidate, height)
+        if err != nil {
+            fmt.Println("block " + strconv.Itoa(height) + " of the branch is invalid: " + err.Error())
+            return false
+        }
+    }
+
+    if chainWork(candidate, branch.ForkHeight).Cmp(chainWork(bc.Chain, branch.ForkHeight)) <= 0 {
+        return false
+    }
+
+    replaced := len(bc.Chain) - branch.ForkHeight
+    if replaced > 0 {
+        fmt.Println("Switching to a branch with more work, replacing " + strconv.Itoa(replaced) +
+                    " blocks after block " + strconv.Itoa(branch.ForkHeight - 1))
+    }
+    // the log only ever appends, so the whole chain is written out again. If that
+    // fails we keep the chain we had, it's still the one on disk
+    previous := bc.Chain
+    bc.Chain = candidate
+    bc.trimIndex(branch.ForkHeight)
+    if !bc.writeChain() {
+        bc.Chain = previous
+        bc.trimIndex(branch.ForkHeight)
+        bc.catchUpIndex()
+        return false
+    }
+    return true
+}
+
+// Check every block of a branch that shares our first ForkHeight blocks, without
+// switching to it. Returns ErrBlockDoesNotConnect for a block that doesn't follow
+// the one before it, which may just mean the peer switched branches while we
+// were fetching, or an *InvalidBlockError for one that breaks the consensus rules
+func (bc *Blockchain) CheckBranch(branch Branch) error {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    if branch.ForkHeight < 1 || branch.ForkHeight > len(bc.Chain) {
+        return ErrBlockDoesNotConnect
+    }
+    candidate := make([]Block, branch.ForkHeight, branch.ForkHeight + len(branch.Blocks))
+    copy(candidate, bc.Chain[:branch.ForkHeight])
+    candidate = append(candidate, branch.Blocks...)
+    for height := branch.ForkHeight; height < len(candidate); height++ {
+        if candidate[height].Index != height || candidate[height].PreviousHash != bc.HashBlock(candidate[height - 1]) {
+            return ErrBlockDoesNotConnect
+        }
+        err := bc.checkBlockAt(candidate, height)
+        if err != nil {
+            return &InvalidBlockError{Reason: "block " + strconv.Itoa(height) + ": " + err.Error()}
+        }
+    }
+    return nil
+}
+
+// drop index entries above the first height blocks. The caller must hold BlockMutex
+func (bc *Blockchain) trimIndex(height int) {
+    if bc.index == nil {
+        return
+    }
+    for len(bc.index.HeightToHash) > height {
+        bc.index.removeLast()
+    }
+}
+
+// A function to switch branches on request from the node package
+func (bc *Blockchain) ReorganizeBlocks() {
+    for true {
+        branch := <-bc.ReorgChannel
+        bc.ReorgResultChannel <- bc.Reorganize(branch)
+    }
+}
+
+// A function to check branches on request from the node package
+func (bc *Blockchain) CheckBranches() {
+    for true {
+        branch := <-bc.BranchCheckChannel
+        bc.BranchCheckResultChannel <- bc.CheckBranch(branch)
+    }
+}
@@ -0,0 +1,200 @@
+package blockchainPackage
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+// count blocks mined on top of the first height blocks of bc, paying out to
+// address so they differ from bc's own blocks at the same heights
+func mineBranch(t *testing.T, bc *Blockchain, height int, count int, address string) []Block {
+    fork := &Blockchain{
+        Chain: append([]Block(nil), bc.Chain[:height]...),
+        DataDir: t.TempDir(),
+        Params: bc.Params,
+        MiningThreads: 1,
+    }
+    if !fork.WriteChain() {
+        t.Fatal("could not write the fork")
+    }
+    mineBlocks(t, fork, count, address)
+    return fork.Chain[height:]
+}
+
+func TestReorganize(t *testing.T) {
+    address := newTestAddress(t)
+
+    tests := []struct {
+        name string
+        // the branch to offer a chain of genesis and three blocks
+        branch func(bc *Blockchain) Branch
+        want bool
+        wantBlocks int
+    }{
+        {"more work", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 2, Blocks: mineBranch(t, bc, 2, 3, address)}
+        }, true, 5},
+        {"same work", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 2, Blocks: mineBranch(t, bc, 2, 2, address)}
+        }, false, 4},
+        {"less work", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 2, Blocks: mineBranch(t, bc, 2, 1, address)}
+        }, false, 4},
+        {"extends our tip", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 4, Blocks: mineBranch(t, bc, 4, 1, address)}
+        }, true, 5},
+        {"starts with blocks we have", func(bc *Blockchain) Branch {
+            blocks := append([]Block(nil), bc.Chain[1:3]...)
+            return Branch{ForkHeight: 1, Blocks: append(blocks, mineBranch(t, bc, 3, 2, address)...)}
+        }, true, 5},
+        {"only blocks we have", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 1, Blocks: append([]Block(nil), bc.Chain[1:]...)}
+        }, false, 4},
+        {"invalid block", func(bc *Blockchain) Branch {
+            blocks := mineBranch(t, bc, 2, 3, address)
+            blocks[1].Coinbase = "gb1234"
+            return Branch{ForkHeight: 2, Blocks: blocks}
+        }, false, 4},
+        {"replaces genesis", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 0, Blocks: append([]Block{bc.Chain[0]}, mineBranch(t, bc, 1, 4, address)...)}
+        }, false, 4},
+        {"forks past our tip", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 5, Blocks: mineBranch(t, bc, 4, 1, address)}
+        }, false, 4},
+        {"empty", func(bc *Blockchain) Branch { return Branch{ForkHeight: 2} }, false, 4},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := newTestChain(t)
+            mineBlocks(t, bc, 3, "")
+            before := append([]Block(nil), bc.Chain...)
+            branch := test.branch(bc)
+
+            if got := bc.Reorganize(branch); got != test.want {
+                t.Fatalf("Reorganize returned %v, want %v", got, test.want)
+            }
+            if len(bc.Chain) != test.wantBlocks {
+                t.Fatalf("chain has %d blocks, want %d", len(bc.Chain), test.wantBlocks)
+            }
+            if !test.want {
+                for height := range before {
+                    if bc.HashBlock(bc.Chain[height]) != bc.HashBlock(before[height]) {
+                        t.Errorf("block %d changed though the branch was refused", height)
+                    }
+                }
+                return
+            }
+
+            tip := bc.Chain[len(bc.Chain) - 1]
+            if bc.HashBlock(tip) != bc.HashBlock(branch.Blocks[len(branch.Blocks) - 1]) {
+                t.Errorf("the tip isn't the branch's last block")
+            }
+            for height, block := range bc.Chain {
+                entry := bc.Lookup(IndexQuery{Hash: bc.HashBlock(block)})
+                if !entry.Found || entry.Height != height {
+                    t.Errorf("block %d is missing from the index", height)
+                }
+            }
+            for height := 2; height < len(before); height++ {
+                if hash := bc.HashBlock(before[height]); hash != bc.HashBlock(bc.Chain[height]) &&
+                    bc.Lookup(IndexQuery{Hash: hash}).Found {
+                    t.Errorf("replaced block %d can still be looked up", height)
+                }
+            }
+            reopened := reopen(t, bc)
+            if bc.HashBlock(reopened.Chain[len(reopened.Chain) - 1]) != bc.HashBlock(tip) {
+                t.Errorf("the branch wasn't saved")
+            }
+        })
+    }
+}
+
+func TestCheckingABranch(t *testing.T) {
+    address := newTestAddress(t)
+
+    tests := []struct {
+        name string
+        branch func(bc *Blockchain) Branch
+        // "", "invalid" or "does not connect"
+        want string
+    }{
+        {"less work", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 2, Blocks: mineBranch(t, bc, 2, 1, address)}
+        }, ""},
+        {"more work", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 2, Blocks: mineBranch(t, bc, 2, 3, address)}
+        }, ""},
+        {"only blocks we have", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 1, Blocks: append([]Block(nil), bc.Chain[1:]...)}
+        }, ""},
+        {"invalid block", func(bc *Blockchain) Branch {
+            blocks := mineBranch(t, bc, 2, 3, address)
+            blocks[2].Coinbase = "gb1234"
+            return Branch{ForkHeight: 2, Blocks: blocks}
+        }, "invalid"},
+        {"blocks from two branches", func(bc *Blockchain) Branch {
+            blocks := mineBranch(t, bc, 2, 1, address)
+            return Branch{ForkHeight: 2, Blocks: append(blocks, mineBranch(t, bc, 3, 1, address)...)}
+        }, "does not connect"},
+        {"forks past our tip", func(bc *Blockchain) Branch {
+            return Branch{ForkHeight: 5, Blocks: mineBranch(t, bc, 4, 1, address)}
+        }, "does not connect"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := newTestChain(t)
+            mineBlocks(t, bc, 3, "")
+            before := append([]Block(nil), bc.Chain...)
+            err := bc.CheckBranch(test.branch(bc))
+            got := ""
+            if _, ok := err.(*InvalidBlockError); ok {
+                got = "invalid"
+            } else if err == ErrBlockDoesNotConnect {
+                got = "does not connect"
+            } else if err != nil {
+                t.Fatal(err)
+            }
+            if got != test.want {
+                t.Errorf("got %q, want %q", got, test.want)
+            }
+            if len(bc.Chain) != len(before) || bc.HashBlock(bc.Chain[len(bc.Chain) - 1]) != bc.HashBlock(before[len(before) - 1]) {
+                t.Errorf("checking the branch changed the chain")
+            }
+        })
+    }
+}
+
+func TestReorganizeKeepsTheChainWhenWritingFails(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 3, "")
+    before := append([]Block(nil), bc.Chain...)
+    branch := Branch{ForkHeight: 2, Blocks: mineBranch(t, bc, 2, 3, newTestAddress(t))}
+
+    // a data directory under a plain file can't be written to
+    file := filepath.Join(t.TempDir(), "file")
+    err := ioutil.WriteFile(file, nil, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bc.DataDir = filepath.Join(file, "data")
+
+    if bc.Reorganize(branch) {
+        t.Fatal("switched to a branch that couldn't be saved")
+    }
+    if len(bc.Chain) != len(before) {
+        t.Fatalf("chain has %d blocks, want %d", len(bc.Chain), len(before))
+    }
+    for height, block := range before {
+        hash := bc.HashBlock(block)
+        if bc.HashBlock(bc.Chain[height]) != hash {
+            t.Errorf("block %d changed", height)
+        }
+        if entry := bc.Lookup(IndexQuery{Hash: hash}); !entry.Found || entry.Height != height {
+            t.Errorf("block %d is missing from the index", height)
+        }
+    }
+    if bc.Lookup(IndexQuery{Hash: bc.HashBlock(branch.Blocks[0])}).Found {
+        t.Errorf("the unsaved branch is in the index")
+    }
+}
@@ -0,0 +1,220 @@
+package blockchainPackage
+
+import (
+    "bufio"
+    "bytes"
+    "datadir"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+)
+
+var JSONCHAIN string = "chain_storage.json"
+var JSONLOG string = "chain_log.json"
+
+// bump this whenever the way blocks are stored changes, and add a step to chainMigrations
+var CHAIN_FORMAT_VERSION int = 2
+
+// returned by ReadChain when there is nothing stored yet
+var ErrNoChain = errors.New("no stored chain")
+
+// define the layout of the chain file
+type chainFile struct {
+    Version int
+    Blocks []Block
+}
+
+// rewrite the full chain file after this many blocks have been appended to the log
+var LOG_COMPACT_INTERVAL int = 100
+
+// the path of one of the blockchain's files inside its data directory
+func (bc *Blockchain) dataFile(name string) string {
+    return filepath.Join(bc.DataDir, name)
+}
+
+//Write json to drive
+func (bc *Blockchain) WriteChain() bool {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+    return bc.writeChain()
+}
+
+// write the chain file and empty the block log. The caller must hold BlockMutex
+func (bc *Blockchain) writeChain() bool {
+    jsonChain, err := json.Marshal(chainFile{Version: CHAIN_FORMAT_VERSION, Blocks: bc.Chain})
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+    err = datadirPackage.WriteFileAtomic(bc.dataFile(JSONCHAIN), jsonChain, 0644)
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+
+    // every logged block is now in the chain file, so the log can start over
+    err = os.Truncate(bc.dataFile(JSONLOG), 0)
+    if err != nil && !os.IsNotExist(err) {
+        fmt.Println(err.Error())
+    }
+    bc.loggedBlocks = 0
+
+    // the indexes are rebuilt from the chain on startup, so they only need saving alongside it
+    bc.catchUpIndex()
+    bc.writeIndex()
+    return true
+}
+
+// Append a single block to the block log and flush it to disk
+func (bc *Blockchain) logBlock(block Block) bool {
+    jsonBlock, err := json.Marshal(block)
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+    file, err := os.OpenFile(bc.dataFile(JSONLOG), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+    defer file.Close()
+
+    _, err = file.Write(append(jsonBlock, '\n'))
+    if err == nil {
+        err = file.Sync()
+    }
+    if err != nil {
+        fmt.Println(err.Error())
+        return false
+    }
+    bc.loggedBlocks++
+    return true
+}
+
+// Persist a block that was just appended to the chain. The caller must hold BlockMutex
+func (bc *Blockchain) persistBlock(block Block) bool {
+    if bc.loggedBlocks >= LOG_COMPACT_INTERVAL {
+        return bc.writeChain()
+    }
+    return bc.logBlock(block)
+}
+
+// Check a block from the log against the chain read so far. Blocks the chain
+// already has are fine, they were logged before the chain file was last written
+func (bc *Blockchain) checkLogged(chain []Block, block Block) error {
+    if block.Index < 0 || block.Index > len(chain) {
+        return errors.New("there is a gap before it")
+    }
+    if block.Index < len(chain) {
+        if bc.HashBlock(block) != bc.HashBlock(chain[block.Index]) {
+            return errors.New("it's from another branch")
+        }
+        return nil
+    }
+    if block.Index == 0 {
+        if bc.HashBlock(block) != bc.GetParams().GenesisHash {
+            return errors.New("it isn't the genesis block")
+        }
+        return nil
+    }
+    return bc.checkBlockAt(append(chain[:len(chain):len(chain)], block), block.Index)
+}
+
+// Read a chain file without touching anything else in its directory
+func ReadChainFile(path string) ([]Block, error) {
+    diskChain := chainFile{Version: CHAIN_FORMAT_VERSION, Blocks: []Block{}}
+    chainData, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    // refuse to guess at a format we don't know, the caller might overwrite it
+    version, err := datadirPackage.FormatVersion(chainData)
+    if err != nil {
+        return nil, errors.New(path + " is not a readable chain file: " + err.Error())
+    }
+    if version != CHAIN_FORMAT_VERSION {
+        return nil, &datadirPackage.FormatError{Path: path, Version: version, Want: CHAIN_FORMAT_VERSION}
+    }
+    err = json.Unmarshal(chainData, &diskChain)
+    if err != nil {
+        return nil, errors.New(path + " is not a readable chain file: " + err.Error())
+    }
+    return diskChain.Blocks, nil
+}
+
+//Read json from drive. Returns ErrNoChain if nothing has been stored yet
+func (bc *Blockchain) ReadChain() error {
+    diskChain := chainFile{Version: CHAIN_FORMAT_VERSION, Blocks: []Block{}}
+
+    // a leftover temp file means we crashed mid-write, the real chain file is still intact
+    os.Remove(bc.dataFile(JSONCHAIN) + ".tmp")
+
+    blocks, err := ReadChainFile(bc.dataFile(JSONCHAIN))
+    if err == nil {
+        diskChain.Blocks = blocks
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+
+    diskChain.Blocks, bc.loggedBlocks = bc.replayLog(diskChain.Blocks)
+    if len(diskChain.Blocks) == 0 {
+        return ErrNoChain
+    }
+
+    bc.Chain = diskChain.Blocks
+    bc.readIndex()
+    return nil
+}
+
+// Apply the blocks in the block log on top of the chain read from the chain file,
+// checking each one the way AcceptBlock does. The log is cut back to the last
+// good entry if a write was torn by a crash, or if it still holds blocks from a
+// branch we left because emptying it failed. Also returns how many entries the
+// log holds afterwards, so it gets compacted on schedule
+func (bc *Blockchain) replayLog(chain []Block) ([]Block, int) {
+    logData, err := ioutil.ReadFile(bc.dataFile(JSONLOG))
+    if err != nil {
+        return chain, 0
+    }
+
+    offset := 0
+    entries := 0
+    reason := "an incomplete write"
+    reader := bufio.NewReader(bytes.NewReader(logData))
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            // a partial line at the end of the file is a torn write
+            break
+        }
+        var block Block
+        if json.Unmarshal(line, &block) != nil {
+            break
+        }
+        err = bc.checkLogged(chain, block)
+        if err != nil {
+            // nothing after a block that doesn't fit can be trusted
+            reason = "block " + strconv.Itoa(block.Index) + ": " + err.Error()
+            break
+        }
+        if block.Index == len(chain) {
+            chain = append(chain, block)
+        }
+        offset += len(line)
+        entries++
+    }
+
+    if offset < len(logData) {
+        fmt.Println("Truncating block log at byte " + strconv.Itoa(offset) + " after " + reason)
+        err = os.Truncate(bc.dataFile(JSONLOG), int64(offset))
+        if err != nil {
+            fmt.Println(err.Error())
+        }
+    }
+    return chain, entries
+}
@@ -0,0 +1,252 @@
+package blockchainPackage
+
+import (
+    "context"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+)
+
+// a blockchain with just the genesis block, keeping its files in a temporary directory
+func newTestChain(t *testing.T) *Blockchain {
+    bc := &Blockchain{Chain: []Block{RegTestParams.GenesisBlock}, DataDir: t.TempDir(), Params: &RegTestParams}
+    if !bc.WriteChain() {
+        t.Fatal("could not write the genesis block")
+    }
+    return bc
+}
+
+// mine count blocks on top of bc paying out to address
+func mineBlocks(t *testing.T, bc *Blockchain, count int, address string) {
+    for i := 0; i < count; i++ {
+        if !bc.AddBlock(context.Background(), address) {
+            t.Fatalf("could not mine block %d", len(bc.Chain))
+        }
+    }
+}
+
+// mine count blocks on top of chain with params without storing them anywhere
+func branchBlocks(params *NetworkParams, chain []Block, count int) []Block {
+    bc := &Blockchain{Chain: append([]Block{}, chain...), Params: params}
+    for i := 0; i < count; i++ {
+        newBlock := Block{Index: len(bc.Chain), PreviousHash: bc.HashBlock(bc.GetPreviousBlock()), Difficulty: bc.AdjustDifficulty()}
+        newBlock.Proof, newBlock.Timestamp, _ = bc.ProofOfWork(context.Background(), bc.GetPreviousBlock())
+        bc.Chain = append(bc.Chain, newBlock)
+    }
+    return bc.Chain[len(chain):]
+}
+
+// read bc's data directory into a fresh blockchain, like a restart would
+func reopen(t *testing.T, bc *Blockchain) *Blockchain {
+    reopened := &Blockchain{DataDir: bc.DataDir, Params: bc.Params}
+    err := reopened.ReadChain()
+    if err != nil {
+        t.Fatalf("reading the chain back: %v", err)
+    }
+    return reopened
+}
+
+// one line of the block log
+func logLine(t *testing.T, block Block) string {
+    jsonBlock, err := json.Marshal(block)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(jsonBlock) + "\n"
+}
+
+func TestAcceptedBlocksSurviveRestart(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 3, "")
+
+    reopened := reopen(t, bc)
+    if len(reopened.Chain) != 4 {
+        t.Fatalf("read back %d blocks, want 4", len(reopened.Chain))
+    }
+    for height := range bc.Chain {
+        if bc.HashBlock(reopened.Chain[height]) != bc.HashBlock(bc.Chain[height]) {
+            t.Errorf("block %d changed across the restart", height)
+        }
+    }
+    if reopened.loggedBlocks != 3 {
+        t.Errorf("loggedBlocks is %d after reading a log of 3 blocks, want 3", reopened.loggedBlocks)
+    }
+}
+
+func TestReplayLogAfterCrash(t *testing.T) {
+    genesis := []Block{RegTestParams.GenesisBlock}
+    blocks := append(genesis, branchBlocks(&RegTestParams, genesis, 3)...)
+    // a branch off the genesis block, as if the log wasn't emptied after a reorg.
+    // It's stamped with the wall clock so it doesn't come out the same as blocks
+    wallClock := RegTestParams
+    wallClock.DeterministicMining = false
+    other := branchBlocks(&wallClock, genesis, 2)
+    badTimestamp := blocks[1]
+    badTimestamp.Timestamp = RegTestParams.GenesisBlock.Timestamp - 1
+
+    tests := []struct {
+        name string
+        log func() string
+        wantBlocks int
+        wantEntries int
+        // whether the log should be cut back to its good entries
+        wantTruncated bool
+    }{
+        {
+            name: "clean log",
+            log: func() string { return logLine(t, blocks[1]) + logLine(t, blocks[2]) + logLine(t, blocks[3]) },
+            wantBlocks: 4,
+            wantEntries: 3,
+        },
+        {
+            name: "torn last write",
+            log: func() string {
+                last := logLine(t, blocks[3])
+                return logLine(t, blocks[1]) + logLine(t, blocks[2]) + last[:len(last) / 2]
+            },
+            wantBlocks: 3,
+            wantEntries: 2,
+            wantTruncated: true,
+        },
+        {
+            name: "garbage after the good entries",
+            log: func() string { return logLine(t, blocks[1]) + "{not json\n" + logLine(t, blocks[2]) },
+            wantBlocks: 2,
+            wantEntries: 1,
+            wantTruncated: true,
+        },
+        {
+            name: "gap in the log",
+            log: func() string { return logLine(t, blocks[1]) + logLine(t, blocks[3]) },
+            wantBlocks: 2,
+            wantEntries: 1,
+            wantTruncated: true,
+        },
+        {
+            name: "block from a branch we left",
+            log: func() string { return logLine(t, blocks[1]) + logLine(t, other[1]) + logLine(t, blocks[2]) },
+            wantBlocks: 2,
+            wantEntries: 1,
+            wantTruncated: true,
+        },
+        {
+            name: "block breaking the rules",
+            log: func() string { return logLine(t, badTimestamp) + logLine(t, blocks[2]) },
+            wantBlocks: 1,
+            wantEntries: 0,
+            wantTruncated: true,
+        },
+        {
+            name: "block the chain file has from another branch",
+            log: func() string { return logLine(t, blocks[0]) + logLine(t, blocks[1]) + logLine(t, other[0]) },
+            wantBlocks: 2,
+            wantEntries: 2,
+            wantTruncated: true,
+        },
+        {
+            name: "blocks the chain file already has",
+            log: func() string { return logLine(t, blocks[0]) + logLine(t, blocks[1]) },
+            wantBlocks: 2,
+            wantEntries: 2,
+        },
+        {
+            name: "empty log",
+            log: func() string { return "" },
+            wantBlocks: 1,
+            wantEntries: 0,
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := newTestChain(t)
+            logData := test.log()
+            err := ioutil.WriteFile(bc.dataFile(JSONLOG), []byte(logData), 0644)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            reopened := reopen(t, bc)
+            if len(reopened.Chain) != test.wantBlocks {
+                t.Errorf("recovered %d blocks, want %d", len(reopened.Chain), test.wantBlocks)
+            }
+            if reopened.loggedBlocks != test.wantEntries {
+                t.Errorf("loggedBlocks is %d, want %d", reopened.loggedBlocks, test.wantEntries)
+            }
+            info, err := os.Stat(bc.dataFile(JSONLOG))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if truncated := info.Size() < int64(len(logData)); truncated != test.wantTruncated {
+                t.Errorf("log truncated is %v, want %v", truncated, test.wantTruncated)
+            }
+        })
+    }
+}
+
+func TestLogIsCompactedOnSchedule(t *testing.T) {
+    interval := LOG_COMPACT_INTERVAL
+    LOG_COMPACT_INTERVAL = 3
+    defer func() { LOG_COMPACT_INTERVAL = interval }()
+
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 2, "")
+
+    // a restart in the middle of an interval picks up the count where it was
+    bc = reopen(t, bc)
+    if bc.loggedBlocks != 2 {
+        t.Fatalf("loggedBlocks is %d after a restart, want 2", bc.loggedBlocks)
+    }
+    mineBlocks(t, bc, 2, "")
+
+    // the third logged block fills the interval, so the fourth rewrites the chain file
+    chainData, err := ioutil.ReadFile(bc.dataFile(JSONCHAIN))
+    if err != nil {
+        t.Fatal(err)
+    }
+    diskChain := chainFile{}
+    err = json.Unmarshal(chainData, &diskChain)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(diskChain.Blocks) != 5 {
+        t.Errorf("chain file has %d blocks, want all 5", len(diskChain.Blocks))
+    }
+    if bc.loggedBlocks != 0 {
+        t.Errorf("loggedBlocks is %d after compacting, want 0", bc.loggedBlocks)
+    }
+    if len(reopen(t, bc).Chain) != 5 {
+        t.Errorf("the compacted chain doesn't read back")
+    }
+}
+
+func TestLeftoverTempFileIsIgnored(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 1, "")
+    tmpPath := bc.dataFile(JSONCHAIN) + ".tmp"
+    err := ioutil.WriteFile(tmpPath, []byte(`{"Version": 1, "Blocks": [`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(reopen(t, bc).Chain) != 2 {
+        t.Errorf("a half written temp file changed the chain")
+    }
+    if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+        t.Errorf("the temp file is still there")
+    }
+}
+
+func TestReadChainRefusesOtherVersions(t *testing.T) {
+    bc := newTestChain(t)
+    err := ioutil.WriteFile(bc.dataFile(JSONCHAIN), []byte(`{"Version": 99, "Blocks": []}`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = (&Blockchain{DataDir: bc.DataDir, Params: bc.Params}).ReadChain()
+    if err == nil || !strings.Contains(err.Error(), "newer") {
+        t.Errorf("got %v, want a format error about a newer version", err)
+    }
+}
@@ -0,0 +1,71 @@
+package blockchainPackage
+
+import (
+    "errors"
+    "math/big"
+)
+
+// define what a full check of the chain found
+type VerifyReport struct {
+    Blocks int
+    ValidBlocks int
+    // the expected number of hashes it took to mine the valid blocks
+    ChainWork *big.Int
+    // coins paid out by the valid blocks
+    Supply int64
+    // the height of the first invalid block and what was wrong with it, -1 if every block is valid
+    FirstInvalid int
+    Reason string
+}
+
+// The expected number of proofs to try before one beats difficulty. A proof
+// hash beats it when it sorts below it, so the odds are difficulty / 16^digits
+func BlockWork(difficulty string) *big.Int {
+    work := new(big.Int).Lsh(big.NewInt(1), uint(4 * len(difficulty)))
+    target, ok := new(big.Int).SetString(difficulty, 16)
+    if !ok || target.Sign() <= 0 {
+        // nothing can beat it, count it as the hardest possible block
+        return work
+    }
+    return work.Div(work, target)
+}
+
+// the coins a block pays out, blocks without a coinbase address pay nobody
+func (bc *Blockchain) blockReward(block Block) int64 {
+    if block.Coinbase == "" {
+        return 0
+    }
+    return bc.GetParams().BlockReward
+}
+
+// Check every block from genesis against the consensus rules, adding up the
+// chain work and supply of the valid ones. Stops at the first invalid block
+func (bc *Blockchain) Verify() VerifyReport {
+    bc.BlockMutex.Lock()
+    defer bc.BlockMutex.Unlock()
+
+    report := VerifyReport{Blocks: len(bc.Chain), ChainWork: new(big.Int), FirstInvalid: -1}
+    for height, block := range bc.Chain {
+        var err error
+        // genesis is mined against its own difficulty, every other block against its parent's
+        difficulty := block.Difficulty
+        if height == 0 {
+            if bc.HashBlock(block) != bc.GetParams().GenesisHash {
+                err = errors.New("the chain does not start with the " + bc.GetParams().Name + " genesis block")
+            }
+        } else {
+            err = bc.checkBlockAt(bc.Chain, height)
+            difficulty = bc.Chain[height - 1].Difficulty
+        }
+        if err != nil {
+            report.FirstInvalid = height
+            report.Reason = err.Error()
+            break
+        }
+
+        report.ValidBlocks++
+        report.ChainWork.Add(report.ChainWork, BlockWork(difficulty))
+        report.Supply += bc.blockReward(block)
+    }
+    return report
+}
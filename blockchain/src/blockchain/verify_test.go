@@ -0,0 +1,160 @@
+package blockchainPackage
+
+import (
+    "math/big"
+    "path/filepath"
+    "strings"
+    "testing"
+    "wallet"
+)
+
+// a fresh address out of a wallet in a temporary directory
+func newTestAddress(t *testing.T) string {
+    wallet, err := walletPackage.Load(filepath.Join(t.TempDir(), "wallet.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    address, err := wallet.NewAddress()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return address
+}
+
+func TestBlockWork(t *testing.T) {
+    tests := []struct {
+        difficulty string
+        want int64
+    }{
+        {"8", 2},
+        {"1", 16},
+        {"00ff", 257},
+        {"7fffffffffffffff", 2},
+        // nothing beats these, so they count as the hardest block of their length
+        {"0", 16},
+        {"zz", 256},
+    }
+    for _, test := range tests {
+        t.Run(test.difficulty, func(t *testing.T) {
+            if work := BlockWork(test.difficulty); work.Cmp(big.NewInt(test.want)) != 0 {
+                t.Errorf("got %v, want %d", work, test.want)
+            }
+        })
+    }
+}
+
+func TestVerifyValidChain(t *testing.T) {
+    bc := newTestChain(t)
+    mineBlocks(t, bc, 2, newTestAddress(t))
+    mineBlocks(t, bc, 1, "")
+
+    report := bc.Verify()
+    if report.FirstInvalid != -1 {
+        t.Fatalf("block %d is invalid: %s", report.FirstInvalid, report.Reason)
+    }
+    if report.Blocks != 4 || report.ValidBlocks != 4 {
+        t.Errorf("got %d of %d blocks valid, want 4 of 4", report.ValidBlocks, report.Blocks)
+    }
+    // blocks without a coinbase address pay nobody
+    if report.Supply != 2 * RegTestParams.BlockReward {
+        t.Errorf("supply is %d, want %d", report.Supply, 2 * RegTestParams.BlockReward)
+    }
+    want := new(big.Int).Mul(big.NewInt(4), BlockWork(RegTestParams.GenesisBlock.Difficulty))
+    if report.ChainWork.Cmp(want) != 0 {
+        t.Errorf("chain work is %v, want %v", report.ChainWork, want)
+    }
+}
+
+func TestVerifyFindsTheFirstInvalidBlock(t *testing.T) {
+    mined := newTestChain(t)
+    mineBlocks(t, mined, 3, "")
+
+    tests := []struct {
+        name string
+        height int
+        tamper func(block *Block)
+        wantReason string
+    }{
+        {"wrong genesis block", 0, func(block *Block) { block.Proof++ }, "genesis"},
+        {"wrong index", 2, func(block *Block) { block.Index = 5 }, "index"},
+        {"timestamp before its parent", 2, func(block *Block) { block.Timestamp = mined.Chain[1].Timestamp - 1 }, "timestamp"},
+        {"proof that misses the target", 2, func(block *Block) {
+            for mined.ProofOfWorkCalc(block.Proof, mined.Chain[1].Proof, block.Timestamp) < mined.Chain[1].Difficulty {
+                block.Proof++
+            }
+        }, "difficulty target"},
+        {"bad previous hash", 2, func(block *Block) { block.PreviousHash = mined.HashBlock(mined.Chain[0]) }, "previous hash"},
+        {"bad coinbase address", 2, func(block *Block) { block.Coinbase = "gb1234" }, "coinbase"},
+        {"wrong difficulty", 2, func(block *Block) { block.Difficulty = "6fffffffffffffff" }, "wrong difficulty"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            bc := &Blockchain{Chain: append([]Block(nil), mined.Chain...), Params: &RegTestParams}
+            test.tamper(&bc.Chain[test.height])
+
+            report := bc.Verify()
+            if report.FirstInvalid != test.height || report.ValidBlocks != test.height {
+                t.Fatalf("got first invalid block %d with %d valid, want %d", report.FirstInvalid, report.ValidBlocks, test.height)
+            }
+            if !strings.Contains(report.Reason, test.wantReason) {
+                t.Errorf("reason %q doesn't mention %q", report.Reason, test.wantReason)
+            }
+        })
+    }
+}
+
+func TestHexIncDec(t *testing.T) {
+    tests := []struct {
+        hash string
+        wantInc string
+        wantDec string
+    }{
+        {"07ff", "08ff", "06ff"},
+        {"0fff", "1fff", "0eff"},
+        {"0a00", "0b00", "0900"},
+        {"1000", "2000", "0000"},
+    }
+    for _, test := range tests {
+        t.Run(test.hash, func(t *testing.T) {
+            if got := string(hexInc([]byte(test.hash))); got != test.wantInc {
+                t.Errorf("hexInc gave %s, want %s", got, test.wantInc)
+            }
+            if got := string(hexDec([]byte(test.hash))); got != test.wantDec {
+                t.Errorf("hexDec gave %s, want %s", got, test.wantDec)
+            }
+        })
+    }
+}
+
+func TestAdjustDifficulty(t *testing.T) {
+    params := RegTestParams
+    params.BlockAdjustment = 4
+    bc := &Blockchain{Params: &params}
+
+    // a chain of blocks spaced gap seconds apart, all at difficulty 0800
+    chainWithGap := func(length int, gap int64) []Block {
+        var chain []Block
+        for i := 0; i < length; i++ {
+            chain = append(chain, Block{Index: i, Timestamp: int64(i) * gap, Difficulty: "0800"})
+        }
+        return chain
+    }
+
+    tests := []struct {
+        name string
+        chain []Block
+        want string
+    }{
+        {"too short to adjust", chainWithGap(4, 1), "0800"},
+        {"slow blocks get easier", chainWithGap(5, params.BlockTime * 2), "0900"},
+        {"fast blocks get harder", chainWithGap(5, params.BlockTime / 2), "0700"},
+        {"on time blocks get harder", chainWithGap(5, params.BlockTime), "0700"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if got := bc.adjustDifficulty(test.chain); got != test.want {
+                t.Errorf("got %s, want %s", got, test.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,429 @@
+package configPackage
+
+import (
+    "blockchain"
+    "encoding/json"
+    "errors"
+    "flag"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "wallet"
+)
+
+var CONFIG_FILENAME string = "config.json"
+
+// every environment variable override starts with this
+var ENV_PREFIX string = "GOBLOCKCHAIN_"
+
+// define everything an operator can set. Anything left empty or zero falls back to the network's defaults
+type Config struct {
+    Network string
+    DataDir string
+    // host:port addresses to accept peer connections on, e.g. ":8080", "0.0.0.0:8080" or "[::]:8080"
+    ListenAddresses []string
+    // host:port addresses for the admin endpoints, keep these on localhost
+    AdminListenAddresses []string
+    // ip:port other nodes should use to reach us, found automatically when empty
+    AdvertisedAddress string
+    // ip:port of nodes to ask for peers, replaces the network's seed nodes when set
+    SeedPeers []string
+    // start mining as soon as "go_blockchain node" is up. Mining can still be started later through the admin endpoints
+    Mine bool
+    // never mine, the node only relays and serves blocks
+    DisableMining bool
+    MiningThreads int
+    // stop mining once the chain is this long, 0 to mine forever
+    NumBlocks int
+    // address mined blocks pay out to in their coinbase, blocks pay nobody when empty
+    PayoutAddress string
+    // pay each mined block to the next address in the wallet instead of PayoutAddress
+    RotatePayout bool
+    // bootstrap file to import blocks from when the node starts, before syncing from peers
+    BootstrapFile string
+    // the misbehavior score that gets a peer banned, and how many seconds the ban lasts
+    BanThreshold int
+    BanDuration int64
+    // how many nodes to talk to, picked from the known addresses, and how many peers that connect to us to keep
+    TargetOutbound int
+    MaxInbound int
+}
+
+// the settings used when nothing else is given
+func Default() Config {
+    return Config{
+        Network: "mainnet",
+        DataDir: ".",
+        Mine: false,
+        MiningThreads: 1,
+        NumBlocks: 0,
+        BanThreshold: 100,
+        BanDuration: 24 * 60 * 60,
+        TargetOutbound: 8,
+        MaxInbound: 32,
+    }
+}
+
+// Build the configuration from, in increasing priority, the defaults, a config
+// file, environment variables and command line flags. Returns the arguments that
+// aren't flags
+func Load(args []string) (*Config, []string, error) {
+    flags := flag.NewFlagSet("go_blockchain", flag.ContinueOnError)
+    configPath := flags.String("config", "", "config file to read, defaults to config.json in the data directory")
+    network := flags.String("network", "", "network to join: mainnet, testnet or regtest")
+    dataDir := flags.String("datadir", "", "directory that holds the chain, peers, wallet and logs")
+    listen := flags.String("listen", "", "comma separated host:port list to accept peer connections on")
+    adminListen := flags.String("adminlisten", "", "comma separated host:port list for the admin endpoints")
+    advertise := flags.String("advertise", "", "ip:port other nodes should use to reach this node")
+    seeds := flags.String("seeds", "", "comma separated ip:port list of nodes to ask for peers")
+    mine := flags.Bool("mine", false, "start mining as soon as the node is up, always on for the mine command")
+    disableMining := flags.Bool("nomining", false, "never mine, only relay and serve blocks")
+    threads := flags.Int("threads", 0, "number of mining threads")
+    numBlocks := flags.Int("numblocks", 0, "stop mining once the chain is this long, 0 to mine forever")
+    payout := flags.String("payout", "", "address mined blocks pay out to")
+    bootstrap := flags.String("bootstrap", "", "bootstrap file to import blocks from at startup")
+    rotatePayout := flags.Bool("rotatepayout", false, "pay each mined block to the next address in the wallet")
+    banThreshold := flags.Int("banscore", 0, "misbehavior score that gets a peer banned")
+    banDuration := flags.Int64("bantime", 0, "seconds a misbehaving peer stays banned")
+    targetOutbound := flags.Int("outbound", 0, "number of nodes to talk to")
+    maxInbound := flags.Int("maxinbound", 0, "most peers that connect to this node to keep")
+    // flags may come before, between or after the other arguments
+    positional := []string{}
+    for {
+        err := flags.Parse(args)
+        if err != nil {
+            return nil, nil, err
+        }
+        args = flags.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+
+    // remember which flags were actually given so they only override when set
+    given := map[string]bool{}
+    flags.Visit(func(f *flag.Flag) {
+        given[f.Name] = true
+    })
+
+    config := Default()
+
+    // the config file can live in the data directory, so work out where that is first
+    if *configPath == "" {
+        *configPath = os.Getenv(ENV_PREFIX + "CONFIG")
+    }
+    explicitPath := *configPath != ""
+    if !explicitPath {
+        dir := config.DataDir
+        if os.Getenv(ENV_PREFIX + "DATADIR") != "" {
+            dir = os.Getenv(ENV_PREFIX + "DATADIR")
+        }
+        if given["datadir"] {
+            dir = *dataDir
+        }
+        *configPath = filepath.Join(dir, CONFIG_FILENAME)
+    }
+    err := config.readFile(*configPath)
+    if err != nil && (explicitPath || !os.IsNotExist(err)) {
+        return nil, nil, err
+    }
+
+    err = config.readEnv()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if given["network"] {
+        config.Network = *network
+    }
+    if given["datadir"] {
+        config.DataDir = *dataDir
+    }
+    if given["listen"] {
+        config.ListenAddresses = splitList(*listen)
+    }
+    if given["adminlisten"] {
+        config.AdminListenAddresses = splitList(*adminListen)
+    }
+    if given["advertise"] {
+        config.AdvertisedAddress = *advertise
+    }
+    if given["seeds"] {
+        config.SeedPeers = splitList(*seeds)
+    }
+    if given["mine"] {
+        config.Mine = *mine
+    }
+    if given["nomining"] {
+        config.DisableMining = *disableMining
+    }
+    if given["threads"] {
+        config.MiningThreads = *threads
+    }
+    if given["numblocks"] {
+        config.NumBlocks = *numBlocks
+    }
+    if given["payout"] {
+        config.PayoutAddress = *payout
+    }
+    if given["rotatepayout"] {
+        config.RotatePayout = *rotatePayout
+    }
+    if given["bootstrap"] {
+        config.BootstrapFile = *bootstrap
+    }
+    if given["banscore"] {
+        config.BanThreshold = *banThreshold
+    }
+    if given["bantime"] {
+        config.BanDuration = *banDuration
+    }
+    if given["outbound"] {
+        config.TargetOutbound = *targetOutbound
+    }
+    if given["maxinbound"] {
+        config.MaxInbound = *maxInbound
+    }
+
+    err = config.Validate()
+    if err != nil {
+        return nil, nil, err
+    }
+    config.ApplyNetworkDefaults()
+    return &config, positional, nil
+}
+
+// read settings from a JSON config file on top of the current ones
+func (config *Config) readFile(path string) error {
+    fileData, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    err = json.Unmarshal(fileData, config)
+    if err != nil {
+        return errors.New(path + " is not a valid config file: " + err.Error())
+    }
+    return nil
+}
+
+// read settings from GOBLOCKCHAIN_* environment variables on top of the current ones
+func (config *Config) readEnv() error {
+    if value := os.Getenv(ENV_PREFIX + "NETWORK"); value != "" {
+        config.Network = value
+    }
+    if value := os.Getenv(ENV_PREFIX + "DATADIR"); value != "" {
+        config.DataDir = value
+    }
+    if value := os.Getenv(ENV_PREFIX + "LISTEN"); value != "" {
+        config.ListenAddresses = splitList(value)
+    }
+    if value := os.Getenv(ENV_PREFIX + "ADMINLISTEN"); value != "" {
+        config.AdminListenAddresses = splitList(value)
+    }
+    if value := os.Getenv(ENV_PREFIX + "ADVERTISE"); value != "" {
+        config.AdvertisedAddress = value
+    }
+    if value := os.Getenv(ENV_PREFIX + "SEEDS"); value != "" {
+        config.SeedPeers = splitList(value)
+    }
+    if value := os.Getenv(ENV_PREFIX + "MINE"); value != "" {
+        mine, err := strconv.ParseBool(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "MINE must be true or false")
+        }
+        config.Mine = mine
+    }
+    if value := os.Getenv(ENV_PREFIX + "NOMINING"); value != "" {
+        disableMining, err := strconv.ParseBool(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "NOMINING must be true or false")
+        }
+        config.DisableMining = disableMining
+    }
+    if value := os.Getenv(ENV_PREFIX + "THREADS"); value != "" {
+        threads, err := strconv.Atoi(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "THREADS must be a number")
+        }
+        config.MiningThreads = threads
+    }
+    if value := os.Getenv(ENV_PREFIX + "NUMBLOCKS"); value != "" {
+        numBlocks, err := strconv.Atoi(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "NUMBLOCKS must be a number")
+        }
+        config.NumBlocks = numBlocks
+    }
+    if value := os.Getenv(ENV_PREFIX + "PAYOUT"); value != "" {
+        config.PayoutAddress = value
+    }
+    if value := os.Getenv(ENV_PREFIX + "ROTATEPAYOUT"); value != "" {
+        rotatePayout, err := strconv.ParseBool(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "ROTATEPAYOUT must be true or false")
+        }
+        config.RotatePayout = rotatePayout
+    }
+    if value := os.Getenv(ENV_PREFIX + "BOOTSTRAP"); value != "" {
+        config.BootstrapFile = value
+    }
+    if value := os.Getenv(ENV_PREFIX + "BANSCORE"); value != "" {
+        banThreshold, err := strconv.Atoi(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "BANSCORE must be a number")
+        }
+        config.BanThreshold = banThreshold
+    }
+    if value := os.Getenv(ENV_PREFIX + "BANTIME"); value != "" {
+        banDuration, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "BANTIME must be a number")
+        }
+        config.BanDuration = banDuration
+    }
+    if value := os.Getenv(ENV_PREFIX + "OUTBOUND"); value != "" {
+        targetOutbound, err := strconv.Atoi(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "OUTBOUND must be a number")
+        }
+        config.TargetOutbound = targetOutbound
+    }
+    if value := os.Getenv(ENV_PREFIX + "MAXINBOUND"); value != "" {
+        maxInbound, err := strconv.Atoi(value)
+        if err != nil {
+            return errors.New(ENV_PREFIX + "MAXINBOUND must be a number")
+        }
+        config.MaxInbound = maxInbound
+    }
+    return nil
+}
+
+// Check every setting and report all of the problems at once
+func (config *Config) Validate() error {
+    problems := []string{}
+
+    _, err := blockchainPackage.GetNetworkParams(config.Network)
+    if err != nil {
+        problems = append(problems, err.Error())
+    }
+    if config.DataDir == "" {
+        problems = append(problems, "the data directory can't be empty")
+    }
+    for _, address := range config.ListenAddresses {
+        err = checkHostPort(address, true)
+        if err != nil {
+            problems = append(problems, "listen address: " + err.Error())
+        }
+    }
+    for _, address := range config.AdminListenAddresses {
+        err = checkHostPort(address, true)
+        if err != nil {
+            problems = append(problems, "admin listen address: " + err.Error())
+        }
+    }
+    if config.AdvertisedAddress != "" {
+        err = checkHostPort(config.AdvertisedAddress, false)
+        if err != nil {
+            problems = append(problems, "advertised address: " + err.Error())
+        }
+    }
+    for _, seed := range config.SeedPeers {
+        err = checkHostPort(seed, false)
+        if err != nil {
+            problems = append(problems, "seed peer: " + err.Error())
+        }
+    }
+    if config.MiningThreads < 1 {
+        problems = append(problems, "the number of mining threads must be at least 1")
+    }
+    if config.NumBlocks < 0 {
+        problems = append(problems, "the number of blocks to mine can't be negative")
+    }
+    if config.Mine && config.DisableMining {
+        problems = append(problems, "set either mining at startup or no mining, not both")
+    }
+    if config.BanThreshold < 1 {
+        problems = append(problems, "the ban score must be at least 1")
+    }
+    if config.BanDuration < 1 {
+        problems = append(problems, "bans must last at least a second")
+    }
+    if config.TargetOutbound < 1 {
+        problems = append(problems, "the number of nodes to talk to must be at least 1")
+    }
+    if config.MaxInbound < 1 {
+        problems = append(problems, "the number of inbound peers must be at least 1")
+    }
+    if config.PayoutAddress != "" {
+        err = walletPackage.ValidateAddress(config.PayoutAddress)
+        if err != nil {
+            problems = append(problems, "payout address: " + err.Error())
+        }
+        if config.RotatePayout {
+            problems = append(problems, "set either a payout address or payout rotation, not both")
+        }
+    }
+
+    if config.BootstrapFile != "" {
+        _, err = os.Stat(config.BootstrapFile)
+        if err != nil {
+            problems = append(problems, "bootstrap file: " + err.Error())
+        }
+    }
+
+    if len(problems) > 0 {
+        return errors.New("invalid configuration:\n    " + strings.Join(problems, "\n    "))
+    }
+    return nil
+}
+
+// the network parameters the config selects
+func (config *Config) Params() *blockchainPackage.NetworkParams {
+    params, _ := blockchainPackage.GetNetworkParams(config.Network)
+    return params
+}
+
+// Fill in the listen addresses from the network's port if none were given. Peers
+// are accepted on every interface, the admin endpoints only on localhost
+func (config *Config) ApplyNetworkDefaults() {
+    port := config.Params().DefaultPort
+    if len(config.ListenAddresses) == 0 {
+        config.ListenAddresses = []string{":" + strconv.Itoa(port)}
+    }
+    if len(config.AdminListenAddresses) == 0 {
+        config.AdminListenAddresses = []string{"127.0.0.1:" + strconv.Itoa(port + 1)}
+    }
+}
+
+// make sure an address is host:port with a usable port. A listen address may leave the host empty
+func checkHostPort(address string, hostOptional bool) error {
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    if host == "" && !hostOptional {
+        return errors.New(address + " is missing a host")
+    }
+    portNumber, err := strconv.Atoi(port)
+    if err != nil || portNumber <= 0 || portNumber > 65535 {
+        return errors.New(address + " does not have a port between 1 and 65535")
+    }
+    return nil
+}
+
+// split a comma separated list, ignoring blank entries
+func splitList(list string) []string {
+    items := []string{}
+    for _, item := range strings.Split(list, ",") {
+        item = strings.TrimSpace(item)
+        if item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
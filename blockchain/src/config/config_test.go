@@ -0,0 +1,110 @@
+package configPackage
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        name string
+        change func(config *Config)
+        wantErr bool
+    }{
+        {"defaults", func(config *Config) {}, false},
+        {"regtest", func(config *Config) { config.Network = "regtest" }, false},
+        {"unknown network", func(config *Config) { config.Network = "moonnet" }, true},
+        {"empty data directory", func(config *Config) { config.DataDir = "" }, true},
+        {"listen without a host", func(config *Config) { config.ListenAddresses = []string{":8080"} }, false},
+        {"listen without a port", func(config *Config) { config.ListenAddresses = []string{"0.0.0.0"} }, true},
+        {"admin listen without a port", func(config *Config) { config.AdminListenAddresses = []string{"127.0.0.1"} }, true},
+        {"seed without a host", func(config *Config) { config.SeedPeers = []string{":8080"} }, true},
+        {"no mining threads", func(config *Config) { config.MiningThreads = 0 }, true},
+        {"mine at startup", func(config *Config) { config.Mine = true }, false},
+        {"never mine", func(config *Config) { config.DisableMining = true }, false},
+        {"mine and never mine", func(config *Config) {
+            config.Mine = true
+            config.DisableMining = true
+        }, true},
+        {"zero ban score", func(config *Config) { config.BanThreshold = 0 }, true},
+        {"zero ban time", func(config *Config) { config.BanDuration = 0 }, true},
+        {"zero outbound peers", func(config *Config) { config.TargetOutbound = 0 }, true},
+        {"zero inbound peers", func(config *Config) { config.MaxInbound = 0 }, true},
+        {"bad payout address", func(config *Config) { config.PayoutAddress = "gb1234" }, true},
+        {"rotate payouts", func(config *Config) { config.RotatePayout = true }, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            config := Default()
+            test.change(&config)
+            err := config.Validate()
+            if (err != nil) != test.wantErr {
+                t.Errorf("got %v, want an error: %v", err, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestLoadPrecedence(t *testing.T) {
+    dir := t.TempDir()
+    err := ioutil.WriteFile(filepath.Join(dir, CONFIG_FILENAME), []byte(`{"MiningThreads": 2, "NumBlocks": 5, "AdvertisedAddress": "203.0.113.7:28080"}`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv(ENV_PREFIX + "THREADS", "3")
+    t.Setenv(ENV_PREFIX + "NUMBLOCKS", "6")
+
+    config, args, err := Load([]string{"-datadir", dir, "-network", "regtest", "node", "-numblocks", "7"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(args) != 1 || args[0] != "node" {
+        t.Errorf("got arguments %v, want [node]", args)
+    }
+    if config.AdvertisedAddress != "203.0.113.7:28080" {
+        t.Errorf("AdvertisedAddress is %q, want it from the file", config.AdvertisedAddress)
+    }
+    if config.MiningThreads != 3 {
+        t.Errorf("MiningThreads is %d, want 3 from the environment", config.MiningThreads)
+    }
+    if config.NumBlocks != 7 {
+        t.Errorf("NumBlocks is %d, want 7 from the flag", config.NumBlocks)
+    }
+    if len(config.ListenAddresses) != 1 || config.ListenAddresses[0] != ":28080" {
+        t.Errorf("listen addresses are %v, want regtest's port", config.ListenAddresses)
+    }
+    if len(config.AdminListenAddresses) != 1 || config.AdminListenAddresses[0] != "127.0.0.1:28081" {
+        t.Errorf("admin listen addresses are %v, want localhost on regtest's port + 1", config.AdminListenAddresses)
+    }
+}
+
+func TestLoadRefusesMiningAndNoMining(t *testing.T) {
+    _, _, err := Load([]string{"-datadir", t.TempDir(), "-mine", "-nomining"})
+    if err == nil {
+        t.Errorf("-mine and -nomining together were accepted")
+    }
+}
+
+func TestLoadRefusesBadSettings(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+        env string
+    }{
+        {"bad flag value", []string{"-threads", "many"}, ""},
+        {"bad environment value", nil, "lots"},
+        {"missing config file", []string{"-config", "missing.json"}, ""},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if test.env != "" {
+                t.Setenv(ENV_PREFIX + "THREADS", test.env)
+            }
+            _, _, err := Load(append([]string{"-datadir", t.TempDir()}, test.args...))
+            if err == nil {
+                t.Errorf("%v was accepted", test.args)
+            }
+        })
+    }
+}
@@ -0,0 +1,200 @@
+package datadirPackage
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "syscall"
+)
+
+var LOCK_FILENAME string = ".lock"
+var LOG_FILENAME string = "debug.log"
+var WALLET_FILENAME string = "wallet.json"
+
+// define the data directory structure. Everything a node saves lives under Path
+type DataDir struct {
+    Path string
+    lockFile *os.File
+    logFile *os.File
+    logPipe *os.File
+    terminal *os.File
+    logDone chan bool
+}
+
+// Create the data directory if needed and lock it so no other process can use it
+func Open(path string) (*DataDir, error) {
+    err := os.MkdirAll(path, 0755)
+    if err != nil {
+        return nil, err
+    }
+
+    lockFile, err := os.OpenFile(filepath.Join(path, LOCK_FILENAME), os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+
+    // the lock goes away with the process, so a crash never leaves the directory stuck
+    err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if err != nil {
+        lockFile.Close()
+        return nil, errors.New("data directory " + path + " is already in use by another process")
+    }
+
+    // record who holds the lock to make the error above easier to track down
+    lockFile.Truncate(0)
+    lockFile.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+
+    return &DataDir{Path: path, lockFile: lockFile}, nil
+}
+
+// Write a file with permissions perm so that a crash leaves either the old or
+// the new contents on disk, never a mix
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+    tmpPath := path + ".tmp"
+    file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+    if err != nil {
+        return err
+    }
+    // a temp file left over from a crash keeps its old permissions, so set them
+    // before anything is written
+    err = file.Chmod(perm)
+    if err == nil {
+        _, err = file.Write(data)
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+    err = os.Rename(tmpPath, path)
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+
+    // sync the directory so the rename itself survives a crash
+    dir, err := os.Open(filepath.Dir(path))
+    if err != nil {
+        return nil
+    }
+    dir.Sync()
+    dir.Close()
+    return nil
+}
+
+// returned when a file on disk was written by a different version of the program
+type FormatError struct {
+    Path string
+    Version int
+    Want int
+}
+
+func (formatError *FormatError) Error() string {
+    if formatError.Version > formatError.Want {
+        return formatError.Path + " is format version " + strconv.Itoa(formatError.Version) +
+               " which is newer than this program understands (version " + strconv.Itoa(formatError.Want) + ")"
+    }
+    return formatError.Path + " is format version " + strconv.Itoa(formatError.Version) +
+           " but this program needs version " + strconv.Itoa(formatError.Want) +
+           ", run \"go_blockchain migrate\" to upgrade it"
+}
+
+// Work out which format version a stored JSON file uses. Files from before
+// versioning are a bare list, which we call version 0
+func FormatVersion(data []byte) (int, error) {
+    trimmed := bytes.TrimSpace(data)
+    if len(trimmed) > 0 && trimmed[0] == '[' {
+        return 0, nil
+    }
+    var header struct {
+        Version int
+    }
+    err := json.Unmarshal(trimmed, &header)
+    if err != nil {
+        return -1, err
+    }
+    return header.Version, nil
+}
+
+// Copy a file next to itself before it gets rewritten, tagged with the version it held
+func BackupFile(path string, version int) (string, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return "", err
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    // the backup is as private as the file it copies
+    backupPath := path + ".v" + strconv.Itoa(version) + ".bak"
+    err = WriteFileAtomic(backupPath, data, info.Mode().Perm())
+    if err != nil {
+        return "", err
+    }
+    return backupPath, nil
+}
+
+// the path of a file inside the data directory
+func (dataDir *DataDir) File(name string) string {
+    return filepath.Join(dataDir.Path, name)
+}
+
+// Copy everything the process prints to the log file in the data directory as well as the terminal
+func (dataDir *DataDir) StartLog() error {
+    logFile, err := os.OpenFile(dataDir.File(LOG_FILENAME), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    reader, writer, err := os.Pipe()
+    if err != nil {
+        logFile.Close()
+        return err
+    }
+
+    dataDir.terminal = os.Stdout
+    dataDir.logFile = logFile
+    dataDir.logPipe = writer
+    dataDir.logDone = make(chan bool)
+    go func() {
+        io.Copy(io.MultiWriter(dataDir.terminal, logFile), reader)
+        reader.Close()
+        dataDir.logDone <- true
+    }()
+
+    // the packages print with fmt and log, point both at the pipe
+    os.Stdout = writer
+    os.Stderr = writer
+    log.SetOutput(writer)
+    return nil
+}
+
+// Release the lock so another process can open the directory
+func (dataDir *DataDir) Close() {
+    if dataDir.lockFile != nil {
+        syscall.Flock(int(dataDir.lockFile.Fd()), syscall.LOCK_UN)
+        dataDir.lockFile.Close()
+        dataDir.lockFile = nil
+    }
+    if dataDir.logPipe != nil {
+        // send output straight to the terminal again and wait for the log to catch up
+        os.Stdout = dataDir.terminal
+        os.Stderr = dataDir.terminal
+        log.SetOutput(dataDir.terminal)
+        dataDir.logPipe.Close()
+        <-dataDir.logDone
+        dataDir.logFile.Close()
+        dataDir.logPipe = nil
+    }
+}
@@ -0,0 +1,121 @@
+package datadirPackage
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestFormatVersion(t *testing.T) {
+    tests := []struct {
+        name string
+        data string
+        want int
+        wantErr bool
+    }{
+        {"bare list from before versioning", `[{"Index": 0}]`, 0, false},
+        {"bare list after whitespace", "\n  []", 0, false},
+        {"versioned file", `{"Version": 2, "Blocks": []}`, 2, false},
+        {"object without a version", `{"Blocks": []}`, 0, false},
+        {"not JSON", `version 2`, -1, true},
+        {"empty file", ``, -1, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            version, err := FormatVersion([]byte(test.data))
+            if version != test.want || (err != nil) != test.wantErr {
+                t.Errorf("got %d, %v, want %d and an error: %v", version, err, test.want, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestFormatErrorSaysWhatToDo(t *testing.T) {
+    older := (&FormatError{Path: "chain.json", Version: 1, Want: 2}).Error()
+    if !strings.Contains(older, "migrate") {
+        t.Errorf("%q doesn't point at the migrate command", older)
+    }
+    newer := (&FormatError{Path: "chain.json", Version: 3, Want: 2}).Error()
+    if !strings.Contains(newer, "newer") {
+        t.Errorf("%q doesn't say the file is newer", newer)
+    }
+}
+
+func TestBackupFile(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "known_nodes.json")
+    err := ioutil.WriteFile(path, []byte("[]"), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    backupPath, err := BackupFile(path, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if backupPath != path + ".v1.bak" {
+        t.Errorf("backed up to %s, want %s", backupPath, path + ".v1.bak")
+    }
+    data, err := ioutil.ReadFile(backupPath)
+    if err != nil || string(data) != "[]" {
+        t.Errorf("backup holds %q, %v", data, err)
+    }
+    info, err := os.Stat(backupPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("backup of a private file has permissions %v", info.Mode().Perm())
+    }
+}
+
+func TestOpenLocksTheDirectory(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "data")
+    dataDir, err := Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pid, err := ioutil.ReadFile(filepath.Join(path, LOCK_FILENAME))
+    if err != nil || strings.TrimSpace(string(pid)) != strconv.Itoa(os.Getpid()) {
+        t.Errorf("the lock file holds %q, %v, want our pid", pid, err)
+    }
+
+    _, err = Open(path)
+    if err == nil {
+        t.Fatal("a locked directory was opened again")
+    }
+    dataDir.Close()
+
+    dataDir, err = Open(path)
+    if err != nil {
+        t.Fatalf("the directory is still locked after Close: %v", err)
+    }
+    dataDir.Close()
+}
+
+func TestStartLog(t *testing.T) {
+    dataDir, err := Open(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    stdout := os.Stdout
+    err = dataDir.StartLog()
+    if err != nil {
+        dataDir.Close()
+        t.Fatal(err)
+    }
+    fmt.Println("written while logging")
+    dataDir.Close()
+
+    if os.Stdout != stdout {
+        t.Errorf("output wasn't sent back to the terminal")
+    }
+    data, err := ioutil.ReadFile(dataDir.File(LOG_FILENAME))
+    if err != nil || !strings.Contains(string(data), "written while logging") {
+        t.Errorf("the log holds %q, %v", data, err)
+    }
+}
@@ -0,0 +1,131 @@
+package minerPackage
+
+import (
+    "blockchain"
+    "context"
+    "errors"
+    "fmt"
+    "node"
+    "strconv"
+    "sync"
+    "sync/atomic"
+)
+
+// define the miner structure. It mines on Blockchain and announces what it finds through Node
+type Miner struct {
+    Blockchain *blockchainPackage.Blockchain
+    Node *nodePackage.Node
+    // stop once the chain is this long, 0 to mine forever
+    NumBlocks int
+    // addresses mined blocks pay out to, taking turns block by block. Blocks pay nobody when empty
+    PayoutAddresses []string
+    nextPayout int
+    // the miner stops for good when this is cancelled
+    Context context.Context
+    mutex sync.Mutex
+    running bool
+    cancel context.CancelFunc
+    done chan bool
+    // updated by the mining loop without the mutex, which Stop holds while waiting for the loop
+    blocksFound int64
+}
+
+// Start mining in the background. Returns false if the miner was already running
+func (miner *Miner) Start() bool {
+    miner.mutex.Lock()
+    defer miner.mutex.Unlock()
+
+    if miner.running || miner.Context.Err() != nil {
+        return false
+    }
+    ctx, cancel := context.WithCancel(miner.Context)
+    miner.cancel = cancel
+    miner.done = make(chan bool)
+    miner.running = true
+    go miner.mineBlocks(ctx, miner.done)
+    fmt.Println("Mining started with " + strconv.Itoa(miner.Blockchain.GetMiningThreads()) + " threads")
+    return true
+}
+
+// Stop mining and wait for the current search to give up. Returns false if the miner wasn't running
+func (miner *Miner) Stop() bool {
+    miner.mutex.Lock()
+    defer miner.mutex.Unlock()
+    return miner.stop()
+}
+
+// the caller must hold the mutex
+func (miner *Miner) stop() bool {
+    if !miner.running {
+        return false
+    }
+    miner.cancel()
+    <-miner.done
+    miner.running = false
+    fmt.Println("Mining stopped")
+    return true
+}
+
+// Change the number of mining threads, restarting the miner if it is running
+func (miner *Miner) SetThreads(threads int) error {
+    if threads < 1 {
+        return errors.New("the number of mining threads must be at least 1")
+    }
+
+    miner.mutex.Lock()
+    wasRunning := miner.stop()
+    miner.Blockchain.SetMiningThreads(threads)
+    miner.mutex.Unlock()
+
+    if wasRunning {
+        miner.Start()
+    }
+    return nil
+}
+
+// report what the miner is doing
+func (miner *Miner) Status() nodePackage.MinerStatus {
+    miner.mutex.Lock()
+    defer miner.mutex.Unlock()
+    return nodePackage.MinerStatus{
+        Running: miner.running,
+        Threads: miner.Blockchain.GetMiningThreads(),
+        BlocksFound: atomic.LoadInt64(&miner.blocksFound),
+    }
+}
+
+// the mining loop, runs until ctx is cancelled or NumBlocks is reached
+func (miner *Miner) mineBlocks(ctx context.Context, done chan bool) {
+    defer close(done)
+
+    blockchainInstance := miner.Blockchain
+    for ctx.Err() == nil {
+        height, _ := blockchainInstance.Tip()
+        if miner.NumBlocks > 0 && height >= miner.NumBlocks {
+            fmt.Println("Reached " + strconv.Itoa(miner.NumBlocks) + " blocks, mining finished")
+            blockchainInstance.WriteChain()
+            go miner.Stop()
+            return
+        }
+
+        // add the new block to the blockchain. It is validated and saved to disk before we hear back
+        block, ok := blockchainInstance.MineBlock(ctx, miner.payoutAddress())
+        if !ok {
+            continue
+        }
+        // only move on to the next address once a block actually paid this one
+        miner.nextPayout++
+        atomic.AddInt64(&miner.blocksFound, 1)
+	fmt.Println("Found block number " + strconv.Itoa(block.Index + 1))
+        // if another miner beat us to it, whichever branch ends up with more work wins
+        miner.Node.AnnounceBlock(block)
+    }
+}
+
+// the address the next block pays out to
+func (miner *Miner) payoutAddress() string {
+    if len(miner.PayoutAddresses) == 0 {
+        return ""
+    }
+    return miner.PayoutAddresses[miner.nextPayout % len(miner.PayoutAddresses)]
+}
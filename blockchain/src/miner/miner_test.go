@@ -0,0 +1,149 @@
+package minerPackage
+
+import (
+    "blockchain"
+    "context"
+    "node"
+    "path/filepath"
+    "testing"
+    "time"
+    "wallet"
+)
+
+// a miner on a fresh regtest chain, stopped when the test ends
+func newTestMiner(t *testing.T, numBlocks int, payouts []string) *Miner {
+    bc := &blockchainPackage.Blockchain{
+        Chain: []blockchainPackage.Block{blockchainPackage.RegTestParams.GenesisBlock},
+        DataDir: t.TempDir(),
+        Params: &blockchainPackage.RegTestParams,
+        MiningThreads: 1,
+        IndexQueryChannel: make(chan blockchainPackage.IndexQuery),
+        IndexEntryChannel: make(chan blockchainPackage.IndexEntry),
+    }
+    if !bc.WriteChain() {
+        t.Fatal("could not write the genesis block")
+    }
+    go bc.SendIndexEntries()
+    // announcing a block looks up its hash, there's nobody to announce it to
+    nodeInstance := &nodePackage.Node{
+        DataDir: bc.DataDir,
+        Params: bc.Params,
+        IndexQueryChannel: bc.IndexQueryChannel,
+        IndexEntryChannel: bc.IndexEntryChannel,
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    miner := &Miner{Blockchain: bc, Node: nodeInstance, NumBlocks: numBlocks, PayoutAddresses: payouts, Context: ctx}
+    t.Cleanup(func() {
+        cancel()
+        miner.Stop()
+    })
+    return miner
+}
+
+// wait for the miner to stop by itself
+func waitForStop(t *testing.T, miner *Miner) {
+    deadline := time.Now().Add(10 * time.Second)
+    for miner.Status().Running {
+        if time.Now().After(deadline) {
+            t.Fatal("the miner didn't stop")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestMinerStopsAtNumBlocks(t *testing.T) {
+    miner := newTestMiner(t, 4, nil)
+    if !miner.Start() {
+        t.Fatal("the miner didn't start")
+    }
+    waitForStop(t, miner)
+
+    if height, _ := miner.Blockchain.Tip(); height != 4 {
+        t.Errorf("the chain is %d blocks long, want 4", height)
+    }
+    if found := miner.Status().BlocksFound; found != 3 {
+        t.Errorf("the miner says it found %d blocks, want 3", found)
+    }
+}
+
+func TestStartAndStop(t *testing.T) {
+    miner := newTestMiner(t, 0, nil)
+    if !miner.Start() {
+        t.Fatal("the miner didn't start")
+    }
+    if miner.Start() {
+        t.Errorf("the miner started twice")
+    }
+    if !miner.Status().Running {
+        t.Errorf("the miner doesn't say it's running")
+    }
+    if !miner.Stop() {
+        t.Fatal("the miner didn't stop")
+    }
+    if miner.Stop() {
+        t.Errorf("the miner stopped twice")
+    }
+    if miner.Status().Running {
+        t.Errorf("the miner says it's still running")
+    }
+
+    // nothing is mined once the miner has stopped
+    height, _ := miner.Blockchain.Tip()
+    time.Sleep(50 * time.Millisecond)
+    if after, _ := miner.Blockchain.Tip(); after != height {
+        t.Errorf("the chain grew from %d to %d blocks after the miner stopped", height, after)
+    }
+}
+
+func TestStartAfterTheContextEnds(t *testing.T) {
+    miner := newTestMiner(t, 0, nil)
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    miner.Context = ctx
+    if miner.Start() {
+        t.Errorf("the miner started after it was shut down")
+    }
+}
+
+func TestSetThreads(t *testing.T) {
+    miner := newTestMiner(t, 0, nil)
+    if miner.SetThreads(0) == nil {
+        t.Errorf("0 threads was accepted")
+    }
+
+    miner.Start()
+    err := miner.SetThreads(3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    status := miner.Status()
+    if !status.Running || status.Threads != 3 {
+        t.Errorf("got %+v, want the miner running with 3 threads", status)
+    }
+}
+
+func TestPayoutsTakeTurns(t *testing.T) {
+    wallet, err := walletPackage.Load(filepath.Join(t.TempDir(), "wallet.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    payouts := []string{}
+    for i := 0; i < 2; i++ {
+        address, err := wallet.NewAddress()
+        if err != nil {
+            t.Fatal(err)
+        }
+        payouts = append(payouts, address)
+    }
+
+    miner := newTestMiner(t, 5, payouts)
+    miner.Start()
+    waitForStop(t, miner)
+
+    for height, block := range miner.Blockchain.Chain[1:] {
+        if want := payouts[height % 2]; block.Coinbase != want {
+            t.Errorf("block %d pays %s, want %s", height + 1, block.Coinbase, want)
+        }
+    }
+}
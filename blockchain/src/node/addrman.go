@@ -0,0 +1,452 @@
+package nodePackage
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "math"
+    "math/rand"
+    "net"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Addresses we've heard of but never reached go in the new table, ones we've
+// connected to go in the tried table. Each table is split into buckets of
+// ADDRESS_BUCKET_SIZE and a full bucket pushes an old address out
+var NEW_BUCKET_COUNT int = 256
+var TRIED_BUCKET_COUNT int = 64
+var ADDRESS_BUCKET_SIZE int = 64
+
+// the most buckets the addresses from one source group can land in, and the
+// most tried buckets one group of addresses can fill, so no single peer or
+// network can crowd everyone else out
+var NEW_BUCKETS_PER_SOURCE_GROUP int = 32
+var TRIED_BUCKETS_PER_GROUP int = 8
+
+// addresses that haven't been heard of for this many seconds are worth nothing
+var ADDRESS_HORIZON int64 = 30 * 24 * 60 * 60
+
+// an address that never answered is given up on after this many tries, one that
+// used to answer after MAX_ADDRESS_FAILURES tries with no success for a week
+var MAX_ADDRESS_RETRIES int = 3
+var MAX_ADDRESS_FAILURES int = 10
+
+// the most addresses we hand out for one /get-nodes, and the most we take from one answer
+var MAX_GET_NODES int = 1000
+
+// define what we know about an address
+type KnownAddress struct {
+    NodeAddress
+    // the ip of whoever told us about it, empty for ourselves and seed nodes
+    Source string
+    // whether we've ever connected to it
+    Tried bool
+    // failed attempts since it last answered, and when the last one was
+    Attempts int
+    LastAttempt int64
+    LastSuccess int64
+    // where it sits in its table
+    bucket int
+}
+
+// Define the table of every address we know, for picking peers from. Its key
+// is random for each data directory so other nodes can't work out which
+// addresses share a bucket
+type AddrManager struct {
+    mutex sync.Mutex
+    key string
+    clock func() time.Time
+    random *rand.Rand
+    addresses map[string]*KnownAddress
+    newBuckets [][]string
+    triedBuckets [][]string
+}
+
+// an empty address table with a new key, telling the time with clock
+func NewAddrManager(clock func() time.Time) *AddrManager {
+    key, _ := newSession()
+    return newAddrManager(key, clock)
+}
+
+func newAddrManager(key string, clock func() time.Time) *AddrManager {
+    return &AddrManager{
+        key: key,
+        clock: clock,
+        random: rand.New(rand.NewSource(time.Now().UnixNano())),
+        addresses: map[string]*KnownAddress{},
+        newBuckets: make([][]string, NEW_BUCKET_COUNT),
+        triedBuckets: make([][]string, TRIED_BUCKET_COUNT),
+    }
+}
+
+// The network group of an ip: its /16 for IPv4 and its /32 for IPv6. A
+// hostname is a group of its own
+func addressGroup(host string) string {
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return host
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return strconv.Itoa(int(ip4[0])) + "." + strconv.Itoa(int(ip4[1]))
+    }
+    return hex.EncodeToString(ip[:4])
+}
+
+// a number drawn from the key and parts, the same every time for the same parts
+func (manager *AddrManager) keyedHash(parts ...string) uint64 {
+    hash := sha256.New()
+    hash.Write([]byte(manager.key))
+    for _, part := range parts {
+        hash.Write([]byte{0})
+        hash.Write([]byte(part))
+    }
+    return binary.BigEndian.Uint64(hash.Sum(nil))
+}
+
+// The new bucket for an address we heard about from source. Everything one
+// source group tells us lands in at most NEW_BUCKETS_PER_SOURCE_GROUP buckets
+func (manager *AddrManager) newBucket(node NodeAddress, source string) int {
+    sourceGroup := addressGroup(source)
+    slot := manager.keyedHash(addressGroup(node.IpAddr), sourceGroup) % uint64(NEW_BUCKETS_PER_SOURCE_GROUP)
+    return int(manager.keyedHash(sourceGroup, strconv.FormatUint(slot, 10)) % uint64(NEW_BUCKET_COUNT))
+}
+
+// The tried bucket for an address. One group fills at most TRIED_BUCKETS_PER_GROUP buckets
+func (manager *AddrManager) triedBucket(node NodeAddress) int {
+    slot := manager.keyedHash(addressKey(node)) % uint64(TRIED_BUCKETS_PER_GROUP)
+    return int(manager.keyedHash(addressGroup(node.IpAddr), strconv.FormatUint(slot, 10)) % uint64(TRIED_BUCKET_COUNT))
+}
+
+// whether an address isn't worth keeping or trying any more
+func (manager *AddrManager) isTerrible(known *KnownAddress, now int64) bool {
+    // tried a minute ago, give it a chance to come back
+    if now - known.LastAttempt < 60 {
+        return false
+    }
+    if now - known.LastSeen > ADDRESS_HORIZON {
+        return true
+    }
+    if known.LastSuccess == 0 && known.Attempts >= MAX_ADDRESS_RETRIES {
+        return true
+    }
+    if now - known.LastSuccess > 7 * 24 * 60 * 60 && known.Attempts >= MAX_ADDRESS_FAILURES {
+        return true
+    }
+    return false
+}
+
+// How likely we are to pick an address, lower for ones that keep failing and
+// ones we tried moments ago
+func (manager *AddrManager) chance(known *KnownAddress, now int64) float64 {
+    chance := math.Pow(0.66, math.Min(float64(known.Attempts), 8))
+    if now - known.LastAttempt < 10 * 60 {
+        chance *= 0.01
+    }
+    return chance
+}
+
+// take a key out of a bucket
+func removeFromBucket(bucket []string, key string) []string {
+    for i, bucketKey := range bucket {
+        if bucketKey == key {
+            return append(bucket[:i], bucket[i + 1:]...)
+        }
+    }
+    return bucket
+}
+
+// Make room in a full new bucket by forgetting a terrible address, or the one
+// we heard from longest ago
+func (manager *AddrManager) evictNew(bucket int, now int64) {
+    oldest := ""
+    for _, key := range manager.newBuckets[bucket] {
+        known := manager.addresses[key]
+        if manager.isTerrible(known, now) {
+            oldest = key
+            break
+        }
+        if oldest == "" || known.LastSeen < manager.addresses[oldest].LastSeen {
+            oldest = key
+        }
+    }
+    manager.newBuckets[bucket] = removeFromBucket(manager.newBuckets[bucket], oldest)
+    delete(manager.addresses, oldest)
+}
+
+// put an address in its new bucket, pushing another one out if the bucket is full
+func (manager *AddrManager) placeNew(known *KnownAddress, now int64) {
+    known.Tried = false
+    known.bucket = manager.newBucket(known.NodeAddress, known.Source)
+    if len(manager.newBuckets[known.bucket]) >= ADDRESS_BUCKET_SIZE {
+        manager.evictNew(known.bucket, now)
+    }
+    manager.newBuckets[known.bucket] = append(manager.newBuckets[known.bucket], addressKey(known.NodeAddress))
+    manager.addresses[addressKey(known.NodeAddress)] = known
+}
+
+// Put an address in its tried bucket. If the bucket is full the address there
+// that answered longest ago goes back to the new table, it was good once
+func (manager *AddrManager) placeTried(known *KnownAddress, now int64) {
+    known.Tried = true
+    known.bucket = manager.triedBucket(known.NodeAddress)
+    if len(manager.triedBuckets[known.bucket]) >= ADDRESS_BUCKET_SIZE {
+        oldest := ""
+        for _, key := range manager.triedBuckets[known.bucket] {
+            if oldest == "" || manager.addresses[key].LastSuccess < manager.addresses[oldest].LastSuccess {
+                oldest = key
+            }
+        }
+        manager.triedBuckets[known.bucket] = removeFromBucket(manager.triedBuckets[known.bucket], oldest)
+        manager.placeNew(manager.addresses[oldest], now)
+    }
+    manager.triedBuckets[known.bucket] = append(manager.triedBuckets[known.bucket], addressKey(known.NodeAddress))
+    manager.addresses[addressKey(known.NodeAddress)] = known
+}
+
+// take an address out of whichever table it's in
+func (manager *AddrManager) unplace(known *KnownAddress) {
+    key := addressKey(known.NodeAddress)
+    if known.Tried {
+        manager.triedBuckets[known.bucket] = removeFromBucket(manager.triedBuckets[known.bucket], key)
+    } else {
+        manager.newBuckets[known.bucket] = removeFromBucket(manager.newBuckets[known.bucket], key)
+    }
+}
+
+// whether an address could be a node at all
+func usableAddress(node NodeAddress) bool {
+    return node.IpAddr != "" && node.Port > 0 && node.Port <= 65535
+}
+
+// Add addresses source told us about to the new table. Ones we already know
+// only have when they were last heard of brought forward
+func (manager *AddrManager) Add(nodes []NodeAddress, source string) {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    now := manager.clock().Unix()
+    for _, node := range nodes {
+        if !usableAddress(node) {
+            continue
+        }
+        // nobody gets to claim an address was around after now
+        if node.LastSeen > now || node.LastSeen <= 0 {
+            node.LastSeen = now
+        }
+        if known, ok := manager.addresses[addressKey(node)]; ok {
+            if node.LastSeen > known.LastSeen {
+                known.LastSeen = node.LastSeen
+            }
+            continue
+        }
+        manager.placeNew(&KnownAddress{NodeAddress: node, Source: source}, now)
+    }
+}
+
+// Record that we connected to node, moving it to the tried table
+func (manager *AddrManager) Good(node NodeAddress) {
+    if !usableAddress(node) {
+        return
+    }
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    now := manager.clock().Unix()
+    known, ok := manager.addresses[addressKey(node)]
+    if !ok {
+        known = &KnownAddress{NodeAddress: node}
+    }
+    known.LastSeen = now
+    known.LastSuccess = now
+    known.Attempts = 0
+    if ok && known.Tried {
+        return
+    }
+    if ok {
+        manager.unplace(known)
+    }
+    manager.placeTried(known, now)
+}
+
+// Record that we couldn't reach node
+func (manager *AddrManager) Attempt(node NodeAddress) {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    known, ok := manager.addresses[addressKey(node)]
+    if ok {
+        known.Attempts++
+        known.LastAttempt = manager.clock().Unix()
+    }
+}
+
+// how many times in a row we've failed to reach node
+func (manager *AddrManager) Failures(node NodeAddress) int {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    known, ok := manager.addresses[addressKey(node)]
+    if !ok {
+        return 0
+    }
+    return known.Attempts
+}
+
+// Forget node altogether
+func (manager *AddrManager) Remove(node NodeAddress) {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    known, ok := manager.addresses[addressKey(node)]
+    if ok {
+        manager.unplace(known)
+        delete(manager.addresses, addressKey(node))
+    }
+}
+
+// how many addresses are in the new and tried tables
+func (manager *AddrManager) Count() (int, int) {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    newCount, triedCount := 0, 0
+    for _, known := range manager.addresses {
+        if known.Tried {
+            triedCount++
+        } else {
+            newCount++
+        }
+    }
+    return newCount, triedCount
+}
+
+// Every address we know, tried ones first, most recently seen first
+func (manager *AddrManager) Addresses() []KnownAddress {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    addresses := []KnownAddress{}
+    for _, known := range manager.addresses {
+        addresses = append(addresses, *known)
+    }
+    sort.Slice(addresses, func(i, j int) bool {
+        if addresses[i].Tried != addresses[j].Tried {
+            return addresses[i].Tried
+        }
+        return addresses[i].LastSeen > addresses[j].LastSeen
+    })
+    return addresses
+}
+
+// Up to count random addresses that are still worth something, for passing on to other nodes
+func (manager *AddrManager) Sample(count int) []NodeAddress {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    now := manager.clock().Unix()
+    sample := []NodeAddress{}
+    for _, known := range manager.addresses {
+        if !manager.isTerrible(known, now) {
+            sample = append(sample, known.NodeAddress)
+        }
+    }
+    manager.random.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+    if len(sample) > count {
+        sample = sample[:count]
+    }
+    return sample
+}
+
+// Pick up to count addresses to connect to, leaving out the ones in exclude and
+// the ones usable turns down. Tried and new addresses are drawn about equally,
+// addresses that keep failing less often, and at first only one address per
+// network group (counting the groups in exclude) so an attacker holding many
+// addresses in one network can't take every slot. Groups are only repeated when
+// there aren't enough of them
+func (manager *AddrManager) Select(count int, exclude []NodeAddress, usable func(NodeAddress) bool) []NodeAddress {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    now := manager.clock().Unix()
+
+    skip := map[string]bool{}
+    groups := map[string]bool{}
+    for _, node := range exclude {
+        skip[addressKey(node)] = true
+        groups[addressGroup(node.IpAddr)] = true
+    }
+    tried := []*KnownAddress{}
+    untried := []*KnownAddress{}
+    for key, known := range manager.addresses {
+        if skip[key] || manager.isTerrible(known, now) || (usable != nil && !usable(known.NodeAddress)) {
+            continue
+        }
+        if known.Tried {
+            tried = append(tried, known)
+        } else {
+            untried = append(untried, known)
+        }
+    }
+    // map order isn't random enough to draw from
+    sort.Slice(tried, func(i, j int) bool { return addressKey(tried[i].NodeAddress) < addressKey(tried[j].NodeAddress) })
+    sort.Slice(untried, func(i, j int) bool { return addressKey(untried[i].NodeAddress) < addressKey(untried[j].NodeAddress) })
+
+    picked := []NodeAddress{}
+    for _, diverse := range []bool{true, false} {
+        candidates := map[bool][]*KnownAddress{true: append([]*KnownAddress{}, tried...), false: append([]*KnownAddress{}, untried...)}
+        for len(picked) < count && len(candidates[true]) + len(candidates[false]) > 0 {
+            table := manager.random.Intn(2) == 0
+            if len(candidates[table]) == 0 {
+                table = !table
+            }
+            i := manager.random.Intn(len(candidates[table]))
+            known := candidates[table][i]
+            // an unlikely address stays in the running for the next draw
+            if manager.random.Float64() >= manager.chance(known, now) && len(candidates[true]) + len(candidates[false]) > 1 &&
+               manager.random.Intn(4) != 0 {
+                continue
+            }
+            candidates[table] = append(candidates[table][:i], candidates[table][i + 1:]...)
+            key := addressKey(known.NodeAddress)
+            group := addressGroup(known.IpAddr)
+            if skip[key] || (diverse && groups[group]) {
+                continue
+            }
+            skip[key] = true
+            groups[group] = true
+            picked = append(picked, known.NodeAddress)
+        }
+    }
+    return picked
+}
+
+// the key and every address, for saving
+func (manager *AddrManager) snapshot() (string, []KnownAddress) {
+    manager.mutex.Lock()
+    defer manager.mutex.Unlock()
+    addresses := []KnownAddress{}
+    for _, known := range manager.addresses {
+        addresses = append(addresses, *known)
+    }
+    sort.Slice(addresses, func(i, j int) bool { return addressKey(addresses[i].NodeAddress) < addressKey(addresses[j].NodeAddress) })
+    return manager.key, addresses
+}
+
+// Build an address table from saved addresses. The buckets are worked out
+// again, so a table saved with different bucket counts still loads
+func loadAddrManager(key string, addresses []KnownAddress, clock func() time.Time) *AddrManager {
+    if key == "" {
+        key, _ = newSession()
+    }
+    manager := newAddrManager(key, clock)
+    now := clock().Unix()
+    for i := range addresses {
+        known := addresses[i]
+        if !usableAddress(known.NodeAddress) {
+            continue
+        }
+        if _, ok := manager.addresses[addressKey(known.NodeAddress)]; ok {
+            continue
+        }
+        if known.Tried {
+            manager.placeTried(&known, now)
+        } else {
+            manager.placeNew(&known, now)
+        }
+    }
+    return manager
+}
@@ -0,0 +1,224 @@
+package nodePackage
+
+import (
+    "strconv"
+    "testing"
+    "time"
+)
+
+// an address table with a fixed key on a clock the test moves
+func newTestAddrManager() (*AddrManager, *testClock) {
+    clock := &testClock{now: time.Unix(1600000000, 0)}
+    return newAddrManager("test key", clock.Now), clock
+}
+
+// count addresses in the /16 a.b, from a.b.0.1 on
+func addressesInGroup(a int, b int, count int) []NodeAddress {
+    nodes := []NodeAddress{}
+    for i := 0; i < count; i++ {
+        ip := strconv.Itoa(a) + "." + strconv.Itoa(b) + "." + strconv.Itoa(i / 250) + "." + strconv.Itoa(i % 250 + 1)
+        nodes = append(nodes, NodeAddress{IpAddr: ip, Port: 8080})
+    }
+    return nodes
+}
+
+func TestAddressGroup(t *testing.T) {
+    tests := []struct {
+        host string
+        want string
+    }{
+        {"10.1.2.3", "10.1"},
+        {"10.1.200.7", "10.1"},
+        {"10.2.2.3", "10.2"},
+        {"::ffff:10.1.2.3", "10.1"},
+        {"2001:db8:1:2::1", "20010db8"},
+        {"2001:db8:ffff::1", "20010db8"},
+        {"seed.example.com", "seed.example.com"},
+    }
+    for _, test := range tests {
+        t.Run(test.host, func(t *testing.T) {
+            if got := addressGroup(test.host); got != test.want {
+                t.Errorf("got %s, want %s", got, test.want)
+            }
+        })
+    }
+}
+
+func TestAddAndGood(t *testing.T) {
+    manager, clock := newTestAddrManager()
+    now := clock.Now().Unix()
+    manager.Add([]NodeAddress{
+        {IpAddr: "10.0.0.1", Port: 8080},
+        {IpAddr: "10.0.0.2", Port: 8080, LastSeen: now + 3600},
+        {IpAddr: "10.0.0.3", Port: 0},
+        {IpAddr: "", Port: 8080},
+    }, "10.9.9.9")
+    manager.Add([]NodeAddress{{IpAddr: "10.0.0.1", Port: 8080}}, "10.8.8.8")
+    if newCount, triedCount := manager.Count(); newCount != 2 || triedCount != 0 {
+        t.Fatalf("got %d new and %d tried, want 2 and 0", newCount, triedCount)
+    }
+    for _, known := range manager.Addresses() {
+        if known.LastSeen > now {
+            t.Errorf("%s claims to have been seen in the future", known.IpAddr)
+        }
+        if known.IpAddr == "10.0.0.1" && known.Source != "10.9.9.9" {
+            t.Errorf("hearing of an address again changed its source to %s", known.Source)
+        }
+    }
+
+    manager.Attempt(NodeAddress{IpAddr: "10.0.0.1", Port: 8080})
+    if manager.Failures(NodeAddress{IpAddr: "10.0.0.1", Port: 8080}) != 1 {
+        t.Errorf("the failed attempt wasn't counted")
+    }
+    manager.Good(NodeAddress{IpAddr: "10.0.0.1", Port: 8080})
+    if newCount, triedCount := manager.Count(); newCount != 1 || triedCount != 1 {
+        t.Errorf("got %d new and %d tried after connecting, want 1 and 1", newCount, triedCount)
+    }
+    if manager.Failures(NodeAddress{IpAddr: "10.0.0.1", Port: 8080}) != 0 {
+        t.Errorf("connecting didn't reset the failures")
+    }
+    if addresses := manager.Addresses(); !addresses[0].Tried || addresses[0].IpAddr != "10.0.0.1" {
+        t.Errorf("the tried address doesn't come first")
+    }
+
+    manager.Remove(NodeAddress{IpAddr: "10.0.0.1", Port: 8080})
+    if newCount, triedCount := manager.Count(); newCount != 1 || triedCount != 0 {
+        t.Errorf("got %d new and %d tried after removing, want 1 and 0", newCount, triedCount)
+    }
+}
+
+func TestOneSourceGroupFillsFewNewBuckets(t *testing.T) {
+    manager, _ := newTestAddrManager()
+    // addresses from lots of networks, all from sources in one /16
+    for group := 0; group < 200; group++ {
+        manager.Add(addressesInGroup(group + 1, 7, 5), "10.9.0." + strconv.Itoa(group % 250 + 1))
+    }
+    buckets := map[int]bool{}
+    for _, known := range manager.addresses {
+        buckets[known.bucket] = true
+    }
+    if len(buckets) > NEW_BUCKETS_PER_SOURCE_GROUP {
+        t.Errorf("one source group filled %d new buckets, want at most %d", len(buckets), NEW_BUCKETS_PER_SOURCE_GROUP)
+    }
+    for bucket := range manager.newBuckets {
+        if len(manager.newBuckets[bucket]) > ADDRESS_BUCKET_SIZE {
+            t.Errorf("new bucket %d holds %d addresses", bucket, len(manager.newBuckets[bucket]))
+        }
+    }
+}
+
+func TestOneGroupFillsFewTriedBuckets(t *testing.T) {
+    manager, _ := newTestAddrManager()
+    for _, node := range addressesInGroup(10, 3, 1000) {
+        manager.Good(node)
+    }
+    buckets := map[int]bool{}
+    for _, known := range manager.addresses {
+        if known.Tried {
+            buckets[known.bucket] = true
+        }
+    }
+    if len(buckets) > TRIED_BUCKETS_PER_GROUP {
+        t.Errorf("one group filled %d tried buckets, want at most %d", len(buckets), TRIED_BUCKETS_PER_GROUP)
+    }
+    for bucket := range manager.triedBuckets {
+        if len(manager.triedBuckets[bucket]) > ADDRESS_BUCKET_SIZE {
+            t.Errorf("tried bucket %d holds %d addresses", bucket, len(manager.triedBuckets[bucket]))
+        }
+    }
+    // addresses pushed out of a full tried bucket go back to the new table
+    if newCount, _ := manager.Count(); newCount == 0 {
+        t.Errorf("no address went back to the new table")
+    }
+}
+
+func TestIsTerrible(t *testing.T) {
+    manager, clock := newTestAddrManager()
+    now := clock.Now().Unix()
+    day := int64(24 * 60 * 60)
+
+    tests := []struct {
+        name string
+        known KnownAddress
+        want bool
+    }{
+        {"just heard of", KnownAddress{NodeAddress: NodeAddress{LastSeen: now}}, false},
+        {"not heard of for too long", KnownAddress{NodeAddress: NodeAddress{LastSeen: now - ADDRESS_HORIZON - 1}}, true},
+        {"never answered", KnownAddress{NodeAddress: NodeAddress{LastSeen: now}, Attempts: MAX_ADDRESS_RETRIES, LastAttempt: now - 120}, true},
+        {"never answered, tried a moment ago", KnownAddress{NodeAddress: NodeAddress{LastSeen: now}, Attempts: MAX_ADDRESS_RETRIES, LastAttempt: now - 10}, false},
+        {"used to answer", KnownAddress{NodeAddress: NodeAddress{LastSeen: now}, Attempts: MAX_ADDRESS_RETRIES, LastAttempt: now - 120, LastSuccess: now - day}, false},
+        {"stopped answering a week ago", KnownAddress{NodeAddress: NodeAddress{LastSeen: now}, Attempts: MAX_ADDRESS_FAILURES, LastAttempt: now - 120, LastSuccess: now - 8 * day}, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if got := manager.isTerrible(&test.known, now); got != test.want {
+                t.Errorf("got %v, want %v", got, test.want)
+            }
+        })
+    }
+}
+
+func TestSelectSpreadsAcrossGroups(t *testing.T) {
+    tests := []struct {
+        name string
+        // addresses in each group 10.<i>
+        groupSizes []int
+        exclude []NodeAddress
+        count int
+        wantPicked int
+        wantGroups int
+    }{
+        {"one address per group", []int{20, 1, 1, 1}, nil, 4, 4, 4},
+        {"more wanted than there are groups", []int{5, 5}, nil, 6, 6, 2},
+        {"excluded groups count", []int{20, 1, 1}, []NodeAddress{{IpAddr: "10.0.0.1", Port: 8080}}, 2, 2, 2},
+        {"fewer addresses than wanted", []int{1, 1}, nil, 5, 2, 2},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            manager, _ := newTestAddrManager()
+            for group, size := range test.groupSizes {
+                manager.Add(addressesInGroup(10, group, size), "10.99.0.1")
+            }
+
+            picked := manager.Select(test.count, test.exclude, nil)
+            if len(picked) != test.wantPicked {
+                t.Fatalf("picked %d addresses, want %d", len(picked), test.wantPicked)
+            }
+            groups := map[string]bool{}
+            for _, node := range picked {
+                for _, excluded := range test.exclude {
+                    if addressKey(node) == addressKey(excluded) {
+                        t.Errorf("picked excluded address %s", addressKey(node))
+                    }
+                }
+                groups[addressGroup(node.IpAddr)] = true
+            }
+            if len(groups) != test.wantGroups {
+                t.Errorf("picked from %d groups, want %d", len(groups), test.wantGroups)
+            }
+            if test.exclude != nil && groups[addressGroup(test.exclude[0].IpAddr)] {
+                t.Errorf("picked from the excluded address's group while others were left")
+            }
+        })
+    }
+}
+
+func TestAddressTableReloads(t *testing.T) {
+    manager, clock := newTestAddrManager()
+    manager.Add(addressesInGroup(10, 1, 30), "10.9.9.9")
+    for _, node := range addressesInGroup(10, 1, 5) {
+        manager.Good(node)
+    }
+
+    key, addresses := manager.snapshot()
+    reloaded := loadAddrManager(key, addresses, clock.Now)
+    newCount, triedCount := reloaded.Count()
+    if newCount != 25 || triedCount != 5 {
+        t.Errorf("got %d new and %d tried back, want 25 and 5", newCount, triedCount)
+    }
+    for _, known := range reloaded.addresses {
+        if known.bucket != manager.addresses[addressKey(known.NodeAddress)].bucket {
+            t.Errorf("%s moved bucket with the same key", addressKey(known.NodeAddress))
+        }
+    }
+}
@@ -0,0 +1,298 @@
+package nodePackage
+
+import (
+    "bytes"
+    "datadir"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "time"
+)
+
+var BANLIST_FILENAME string = "banned.json"
+
+// bump this whenever the way bans are stored changes
+var BANLIST_FORMAT_VERSION int = 1
+
+// a peer is banned once its misbehavior adds up to this, for this many seconds
+var DEFAULT_BAN_THRESHOLD int = 100
+var DEFAULT_BAN_DURATION int64 = 24 * 60 * 60
+
+// how much each kind of misbehavior counts towards a ban. Sending a block that
+// breaks the rules is never an accident, a request we can't read might be a bug
+var SCORE_INVALID_BLOCK int = 100
+var SCORE_MALFORMED_REQUEST int = 10
+var SCORE_OVERSIZED_INV int = 20
+
+// define a ban on every request from an ip address
+type Ban struct {
+    IpAddr string
+    // unix time the ban ends
+    Until int64
+    Reason string
+}
+
+// define the layout of the ban list file
+type banListFile struct {
+    Version int
+    Bans []Ban
+}
+
+// the score that gets a peer banned
+func (nodeInstance *Node) banThreshold() int {
+    if nodeInstance.BanThreshold <= 0 {
+        return DEFAULT_BAN_THRESHOLD
+    }
+    return nodeInstance.BanThreshold
+}
+
+// how many seconds a ban lasts
+func (nodeInstance *Node) banDuration() int64 {
+    if nodeInstance.BanDuration <= 0 {
+        return DEFAULT_BAN_DURATION
+    }
+    return nodeInstance.BanDuration
+}
+
+// the ban in force on ip, if there is one. Bans that have run out are dropped here
+func (nodeInstance *Node) banOn(ip string) (Ban, bool) {
+    nodeInstance.banMutex.Lock()
+    defer nodeInstance.banMutex.Unlock()
+    ban, ok := nodeInstance.bans[ip]
+    if !ok {
+        return Ban{}, false
+    }
+    if nodeInstance.now().Unix() >= ban.Until {
+        delete(nodeInstance.bans, ip)
+        return Ban{}, false
+    }
+    return ban, true
+}
+
+// Whether requests from ip are refused and we stay away from it
+func (nodeInstance *Node) IsBanned(ip string) bool {
+    _, banned := nodeInstance.banOn(ip)
+    return banned
+}
+
+// Add points to ip's misbehavior score, banning it once the score reaches the threshold
+func (nodeInstance *Node) misbehaving(ip string, points int, reason string) {
+    if ip == "" {
+        return
+    }
+    nodeInstance.banMutex.Lock()
+    if nodeInstance.misbehavior == nil {
+        nodeInstance.misbehavior = map[string]int{}
+    }
+    nodeInstance.misbehavior[ip] += points
+    score := nodeInstance.misbehavior[ip]
+    nodeInstance.banMutex.Unlock()
+
+    fmt.Println("Peer " + ip + " misbehaved (" + strconv.Itoa(score) + "/" + strconv.Itoa(nodeInstance.banThreshold()) + "): " + reason)
+    if score >= nodeInstance.banThreshold() {
+        nodeInstance.Ban(ip, nodeInstance.banDuration(), reason)
+    }
+}
+
+// misbehaving for the peer that sent req
+func (nodeInstance *Node) misbehavingRequest(req *http.Request, points int, reason string) {
+    remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+    nodeInstance.misbehaving(remoteIP, points, reason + " on " + req.URL.Path)
+}
+
+// Refuse everything from ip for the next duration seconds and hang up on it.
+// The ban list is saved right away so a restart doesn't lift it
+func (nodeInstance *Node) Ban(ip string, duration int64, reason string) {
+    nodeInstance.banMutex.Lock()
+    if nodeInstance.bans == nil {
+        nodeInstance.bans = map[string]Ban{}
+    }
+    nodeInstance.bans[ip] = Ban{IpAddr: ip, Until: nodeInstance.now().Unix() + duration, Reason: reason}
+    // a peer starts from nothing once its ban is over
+    delete(nodeInstance.misbehavior, ip)
+    nodeInstance.banMutex.Unlock()
+    fmt.Println("Banned " + ip + " for " + strconv.FormatInt(duration, 10) + " seconds: " + reason)
+
+    nodeInstance.disconnect(ip)
+    nodeInstance.writeBanList()
+}
+
+// Lift the ban on ip. Returns false if it wasn't banned
+func (nodeInstance *Node) Unban(ip string) bool {
+    nodeInstance.banMutex.Lock()
+    _, ok := nodeInstance.bans[ip]
+    delete(nodeInstance.bans, ip)
+    nodeInstance.banMutex.Unlock()
+    if ok {
+        nodeInstance.writeBanList()
+    }
+    return ok
+}
+
+// Every ban still in force, the ones ending first first
+func (nodeInstance *Node) Bans() []Ban {
+    nodeInstance.banMutex.Lock()
+    defer nodeInstance.banMutex.Unlock()
+    now := nodeInstance.now().Unix()
+    bans := []Ban{}
+    for ip, ban := range nodeInstance.bans {
+        if now >= ban.Until {
+            delete(nodeInstance.bans, ip)
+            continue
+        }
+        bans = append(bans, ban)
+    }
+    sort.Slice(bans, func(i, j int) bool { return bans[i].Until < bans[j].Until })
+    return bans
+}
+
+// forget every peer at ip and close its sessions, whichever side opened them
+func (nodeInstance *Node) disconnect(ip string) {
+    nodeInstance.PeerMutex.Lock()
+    streams := []*session{}
+    for key, peer := range nodeInstance.outboundPeers {
+        if peer.Address.IpAddr == ip {
+            if peer.stream != nil {
+                streams = append(streams, peer.stream)
+            }
+            delete(nodeInstance.outboundPeers, key)
+        }
+    }
+    for key, peer := range nodeInstance.inboundPeers {
+        if peer.remoteIP == ip {
+            if peer.stream != nil {
+                streams = append(streams, peer.stream)
+            }
+            delete(nodeInstance.inboundPeers, key)
+        }
+    }
+    nodeInstance.PeerMutex.Unlock()
+
+    for _, s := range streams {
+        s.close()
+    }
+}
+
+// wrap a server function so it refuses banned addresses
+func (nodeInstance *Node) notBanned(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+        if ban, banned := nodeInstance.banOn(remoteIP); banned {
+            http.Error(w, "This address is banned until " + banEnds(ban), http.StatusForbidden)
+            return
+        }
+        handler(w, req)
+    }
+}
+
+/******************************************** Disk I/O Functions *****************************************/
+
+// Read the saved ban list, dropping bans that ran out while we were stopped. A
+// *datadirPackage.FormatError means the file is from another version
+func (nodeInstance *Node) ReadBanList() error {
+    path := filepath.Join(nodeInstance.DataDir, BANLIST_FILENAME)
+    fileData, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    version, err := datadirPackage.FormatVersion(fileData)
+    if err != nil {
+        return err
+    }
+    if version != BANLIST_FORMAT_VERSION {
+        return &datadirPackage.FormatError{Path: path, Version: version, Want: BANLIST_FORMAT_VERSION}
+    }
+
+    diskBanList := banListFile{}
+    err = json.Unmarshal(fileData, &diskBanList)
+    if err != nil {
+        return err
+    }
+
+    now := nodeInstance.now().Unix()
+    nodeInstance.banMutex.Lock()
+    nodeInstance.bans = map[string]Ban{}
+    for _, ban := range diskBanList.Bans {
+        if now < ban.Until {
+            nodeInstance.bans[ban.IpAddr] = ban
+        }
+    }
+    nodeInstance.banMutex.Unlock()
+    return nil
+}
+
+func (nodeInstance *Node) writeBanList() {
+    // bans can come from several requests at once, and they all write the same file
+    nodeInstance.banFileMutex.Lock()
+    defer nodeInstance.banFileMutex.Unlock()
+    jsonBanList, err := json.Marshal(banListFile{Version: BANLIST_FORMAT_VERSION, Bans: nodeInstance.Bans()})
+    if err != nil {
+        fmt.Println(err.Error())
+        return
+    }
+    err = datadirPackage.WriteFileAtomic(filepath.Join(nodeInstance.DataDir, BANLIST_FILENAME), jsonBanList, 0644)
+    if err != nil {
+        fmt.Println(err.Error())
+        return
+    }
+}
+
+//************************ Server Functions ***********************************
+
+// what the admin endpoints take to ban or unban an address
+type BanRequest struct {
+    IpAddr string
+    // seconds, the node's ban duration when zero
+    Duration int64
+    Reason string
+}
+
+// an admin server function to list, add or lift bans. The action is the last part of the page
+func (nodeInstance *Node) controlBans(w http.ResponseWriter, req *http.Request) {
+    switch req.URL.Path {
+    case "/bans", "/bans/list":
+    case "/bans/add", "/bans/remove":
+        var request BanRequest
+        if req.Body == nil || json.NewDecoder(req.Body).Decode(&request) != nil || net.ParseIP(request.IpAddr) == nil {
+            http.Error(w, "Please provide an IpAddr", 400)
+            return
+        }
+        if req.URL.Path == "/bans/remove" {
+            if !nodeInstance.Unban(request.IpAddr) {
+                http.Error(w, request.IpAddr + " is not banned", http.StatusNotFound)
+                return
+            }
+            break
+        }
+        if request.Duration <= 0 {
+            request.Duration = nodeInstance.banDuration()
+        }
+        if request.Reason == "" {
+            request.Reason = "banned by the operator"
+        }
+        nodeInstance.Ban(request.IpAddr, request.Duration, request.Reason)
+    default:
+        http.NotFound(w, req)
+        return
+    }
+
+    // every action answers with the bans in force afterwards
+    jsonBans := new(bytes.Buffer)
+    err := json.NewEncoder(jsonBans).Encode(nodeInstance.Bans())
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonBans.Bytes())
+}
+
+// a ban's end, for messages
+func banEnds(ban Ban) string {
+    return time.Unix(ban.Until, 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,219 @@
+package nodePackage
+
+import (
+    "blockchain"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// a clock for tests that only moves when told to
+type testClock struct {
+    mutex sync.Mutex
+    now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+    clock.mutex.Lock()
+    defer clock.mutex.Unlock()
+    return clock.now
+}
+
+func (clock *testClock) Advance(duration time.Duration) {
+    clock.mutex.Lock()
+    clock.now = clock.now.Add(duration)
+    clock.mutex.Unlock()
+}
+
+// a node keeping its files in a temporary directory, on a clock the test moves
+func newTestNode(t *testing.T) (*Node, *testClock) {
+    clock := &testClock{now: time.Unix(1600000000, 0)}
+    nodeInstance := &Node{
+        DataDir: t.TempDir(),
+        Params: &blockchainPackage.RegTestParams,
+        Clock: clock.Now,
+    }
+    return nodeInstance, clock
+}
+
+// a regtest blockchain with just the genesis block, handed blocks by nodeInstance
+func attachBlockchain(t *testing.T, nodeInstance *Node) *blockchainPackage.Blockchain {
+    bc := &blockchainPackage.Blockchain{
+        Chain: []blockchainPackage.Block{blockchainPackage.RegTestParams.GenesisBlock},
+        DataDir: nodeInstance.DataDir,
+        Params: &blockchainPackage.RegTestParams,
+        MiningThreads: 1,
+        AddBlockChannel: make(chan blockchainPackage.Block),
+        BlockValidateChannel: make(chan error),
+        HeightRequestChannel: make(chan bool),
+        HeightChannel: make(chan int),
+        IndexQueryChannel: make(chan blockchainPackage.IndexQuery),
+        IndexEntryChannel: make(chan blockchainPackage.IndexEntry),
+    }
+    if !bc.WriteChain() {
+        t.Fatal("could not write the genesis block")
+    }
+    nodeInstance.AddBlockChannel = bc.AddBlockChannel
+    nodeInstance.BlockValidateChannel = bc.BlockValidateChannel
+    nodeInstance.HeightRequestChannel = bc.HeightRequestChannel
+    nodeInstance.HeightChannel = bc.HeightChannel
+    nodeInstance.IndexQueryChannel = bc.IndexQueryChannel
+    nodeInstance.IndexEntryChannel = bc.IndexEntryChannel
+    go bc.AddRemoteBlocks()
+    go bc.SendHeight()
+    go bc.SendIndexEntries()
+    return bc
+}
+
+// the blocks of a separate regtest chain mined count blocks past genesis, paying out to address
+func mineTestBlocks(t *testing.T, count int, address string) []blockchainPackage.Block {
+    bc := &blockchainPackage.Blockchain{
+        Chain: []blockchainPackage.Block{blockchainPackage.RegTestParams.GenesisBlock},
+        DataDir: t.TempDir(),
+        Params: &blockchainPackage.RegTestParams,
+        MiningThreads: 1,
+    }
+    if !bc.WriteChain() {
+        t.Fatal("could not write the genesis block")
+    }
+    for i := 0; i < count; i++ {
+        if !bc.AddBlock(context.Background(), address) {
+            t.Fatalf("could not mine block %d", i + 1)
+        }
+    }
+    return bc.Chain[1:]
+}
+
+// value as the JSON a peer would send
+func jsonString(t *testing.T, value interface{}) string {
+    data, err := json.Marshal(value)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestMisbehavingBansAtTheThreshold(t *testing.T) {
+    tests := []struct {
+        name string
+        threshold int
+        points []int
+        wantBanned bool
+    }{
+        {"one invalid block", 0, []int{SCORE_INVALID_BLOCK}, true},
+        {"a few malformed requests", 0, []int{SCORE_MALFORMED_REQUEST, SCORE_MALFORMED_REQUEST}, false},
+        {"adds up to the threshold", 50, []int{SCORE_OVERSIZED_INV, SCORE_OVERSIZED_INV, SCORE_MALFORMED_REQUEST}, true},
+        {"just short of the threshold", 50, []int{SCORE_OVERSIZED_INV, SCORE_OVERSIZED_INV}, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeInstance, _ := newTestNode(t)
+            nodeInstance.BanThreshold = test.threshold
+            for _, points := range test.points {
+                nodeInstance.misbehaving("10.0.0.9", points, "testing")
+            }
+            if nodeInstance.IsBanned("10.0.0.9") != test.wantBanned {
+                t.Errorf("banned is %v, want %v", nodeInstance.IsBanned("10.0.0.9"), test.wantBanned)
+            }
+            if nodeInstance.IsBanned("10.0.0.8") {
+                t.Errorf("a well behaved address was banned")
+            }
+        })
+    }
+}
+
+func TestBanRunsOut(t *testing.T) {
+    nodeInstance, clock := newTestNode(t)
+    nodeInstance.Ban("10.0.0.9", 60, "testing")
+    if !nodeInstance.IsBanned("10.0.0.9") {
+        t.Fatal("not banned right after the ban")
+    }
+
+    clock.Advance(59 * time.Second)
+    if !nodeInstance.IsBanned("10.0.0.9") {
+        t.Errorf("the ban ran out early")
+    }
+    clock.Advance(time.Second)
+    if nodeInstance.IsBanned("10.0.0.9") {
+        t.Errorf("still banned after the ban ran out")
+    }
+    if len(nodeInstance.bans) != 0 {
+        t.Errorf("the ban that ran out is still kept")
+    }
+}
+
+func TestBanListSurvivesRestart(t *testing.T) {
+    nodeInstance, clock := newTestNode(t)
+    nodeInstance.Ban("10.0.0.7", 60, "short")
+    nodeInstance.Ban("10.0.0.8", 3600, "long")
+    nodeInstance.Ban("10.0.0.9", 3600, "lifted")
+    if !nodeInstance.Unban("10.0.0.9") {
+        t.Fatal("couldn't lift a ban")
+    }
+    if nodeInstance.Unban("10.0.0.9") {
+        t.Errorf("lifted a ban that was already lifted")
+    }
+
+    // the short ban runs out while the node is stopped
+    clock.Advance(time.Minute)
+    restarted := &Node{DataDir: nodeInstance.DataDir, Clock: clock.Now}
+    err := restarted.ReadBanList()
+    if err != nil {
+        t.Fatal(err)
+    }
+    bans := restarted.Bans()
+    if len(bans) != 1 || bans[0].IpAddr != "10.0.0.8" || bans[0].Reason != "long" {
+        t.Errorf("read back %v, want only the long ban", bans)
+    }
+}
+
+func TestOnlyBlocksBreakingTheRulesAreScored(t *testing.T) {
+    blocks := mineTestBlocks(t, 2, "")
+    otherBranch := mineTestBlocks(t, 1, "")[0]
+    otherBranch.PreviousHash = strings.Repeat("0", 64)
+    badCoinbase := blocks[0]
+    badCoinbase.Coinbase = "gb1234"
+
+    tests := []struct {
+        name string
+        body string
+        wantStatus int
+        wantScore int
+    }{
+        {"next block", jsonString(t, blocks[0]), http.StatusOK, 0},
+        {"block from further ahead", jsonString(t, blocks[1]), http.StatusNotAcceptable, 0},
+        {"block on another branch", jsonString(t, otherBranch), http.StatusNotAcceptable, 0},
+        {"next block breaking the rules", jsonString(t, badCoinbase), http.StatusNotAcceptable, SCORE_INVALID_BLOCK},
+        {"unreadable block", "{", http.StatusBadRequest, SCORE_MALFORMED_REQUEST},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeInstance, _ := newTestNode(t)
+            bc := attachBlockchain(t, nodeInstance)
+            req := httptest.NewRequest("POST", "/add-block", strings.NewReader(test.body))
+            req.RemoteAddr = "10.0.0.9:40000"
+            w := httptest.NewRecorder()
+
+            nodeInstance.addRemoteBlock(w, req)
+            if w.Code != test.wantStatus {
+                t.Errorf("answered %d, want %d", w.Code, test.wantStatus)
+            }
+            // a ban resets the score, so count a ban as reaching the threshold
+            score := nodeInstance.misbehavior["10.0.0.9"]
+            if nodeInstance.IsBanned("10.0.0.9") {
+                score = nodeInstance.banThreshold()
+            }
+            if score != test.wantScore {
+                t.Errorf("the sender scored %d, want %d", score, test.wantScore)
+            }
+            if test.wantStatus == http.StatusOK && len(bc.Chain) != 2 {
+                t.Errorf("the block wasn't added")
+            }
+        })
+    }
+}
@@ -0,0 +1,405 @@
+package nodePackage
+
+import (
+    "blockchain"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+)
+
+// the kinds of object peers announce to each other
+var INV_BLOCK string = "block"
+var INV_TX string = "tx"
+
+// the most items a single announcement may carry
+var MAX_INV_ITEMS int = 500
+
+// how many times a query that gets no answer is sent
+var PEER_QUERY_ATTEMPTS int = 3
+
+// forget that we've seen an announcement after this long
+var SEEN_INVENTORY_TIMEOUT int64 = 10 * 60
+
+// define an announcement of a single object by its hash
+type InvItem struct {
+    Type string
+    Hash string
+}
+
+// Remember that we've heard about hash. Returns false if we already had, so each
+// object is only fetched and relayed once
+func (nodeInstance *Node) markSeen(hash string) bool {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+
+    now := nodeInstance.now().Unix()
+    if nodeInstance.seenInventory == nil {
+        nodeInstance.seenInventory = map[string]int64{}
+    }
+    if seen, ok := nodeInstance.seenInventory[hash]; ok && now - seen < SEEN_INVENTORY_TIMEOUT {
+        return false
+    }
+    // drop old entries now and then so the table doesn't grow forever
+    if len(nodeInstance.seenInventory) > 10000 {
+        for oldHash, seen := range nodeInstance.seenInventory {
+            if now - seen >= SEEN_INVENTORY_TIMEOUT {
+                delete(nodeInstance.seenInventory, oldHash)
+            }
+        }
+    }
+    nodeInstance.seenInventory[hash] = now
+    return true
+}
+
+// let an object be fetched again, used when fetching it failed
+func (nodeInstance *Node) forgetSeen(hash string) {
+    nodeInstance.PeerMutex.Lock()
+    delete(nodeInstance.seenInventory, hash)
+    nodeInstance.PeerMutex.Unlock()
+}
+
+// the hash of our block at height, empty if we don't have one
+func (nodeInstance *Node) localHash(height int) string {
+    return nodeInstance.lookup(blockchainPackage.IndexQuery{Height: height}).Hash
+}
+
+// hand a block to the blockchain. Returns nil if it was accepted, or the
+// blockchain's reason for turning it down
+func (nodeInstance *Node) submitBlock(block blockchainPackage.Block) error {
+    nodeInstance.addBlockMutex.Lock()
+    defer nodeInstance.addBlockMutex.Unlock()
+    nodeInstance.AddBlockChannel <- block
+    return <-nodeInstance.BlockValidateChannel
+}
+
+// whether our chain has the block with hash
+func (nodeInstance *Node) haveBlock(hash string) bool {
+    return nodeInstance.lookup(blockchainPackage.IndexQuery{Hash: hash}).Found
+}
+
+// A client function to tell other nodes about a block we've accepted. They fetch
+// it if they don't have it. We don't wait for answers, a node that can't use the
+// block sorts that out with its peers
+func (nodeInstance *Node) AnnounceBlock(block blockchainPackage.Block) {
+    hash := nodeInstance.localHash(block.Index)
+    if hash == "" {
+        return
+    }
+    nodeInstance.markSeen(hash)
+    nodeInstance.relay(InvItem{Type: INV_BLOCK, Hash: hash}, block, NodeAddress{})
+}
+
+// Announce an object to every known node except the one we got it from, and to
+// peers that only reach us over sessions they opened. Peers that don't support
+// announcements get the whole block like before
+func (nodeInstance *Node) relay(item InvItem, block blockchainPackage.Block, from NodeAddress) {
+    nodes := nodeInstance.snapshotNodes()
+    skip := map[string]bool{addressKey(from): true}
+    for _, node := range nodes {
+        skip[addressKey(node)] = true
+    }
+
+    jsonItems, _ := json.Marshal([]InvItem{item})
+    jsonBlock, _ := json.Marshal(block)
+    for _, node := range nodes {
+        if addressKey(node) == addressKey(from) {
+            continue
+        }
+        go func(node NodeAddress) {
+            peer, err := nodeInstance.outboundPeer(node)
+            if err != nil {
+                return
+            }
+            var resp *http.Response
+            if peer.HasFeature(FEATURE_INV) {
+                resp, err = nodeInstance.peerPost(node, "/inv", bytes.NewReader(jsonItems))
+            } else {
+                resp, err = nodeInstance.peerPost(node, "/add-block", bytes.NewReader(jsonBlock))
+            }
+            if err == nil {
+                resp.Body.Close()
+            }
+        }(node)
+    }
+
+    nodeInstance.PeerMutex.Lock()
+    streams := []*session{}
+    for _, peer := range nodeInstance.inboundPeers {
+        if peer.stream != nil && !skip[addressKey(peer.Address)] {
+            streams = append(streams, peer.stream)
+        }
+    }
+    nodeInstance.PeerMutex.Unlock()
+    for _, s := range streams {
+        // sessions are newer than announcements, so everyone on one takes /inv
+        go s.call("/inv", jsonItems)
+    }
+}
+
+// Ask a peer for a JSON answer to a JSON request. Queries only read, so one
+// that gets lost on the way is sent again, up to PEER_QUERY_ATTEMPTS times
+func (nodeInstance *Node) peerQuery(node NodeAddress, page string, request interface{}, answer interface{}) error {
+    jsonRequest, err := json.Marshal(request)
+    if err != nil {
+        return err
+    }
+    var resp *http.Response
+    for attempt := 0; attempt < PEER_QUERY_ATTEMPTS; attempt++ {
+        resp, err = nodeInstance.peerPost(node, page, bytes.NewReader(jsonRequest))
+        if err == nil {
+            break
+        }
+    }
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return errors.New(addressKey(node) + page + " answered " + resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(answer)
+}
+
+// the height of a peer's chain
+func (nodeInstance *Node) fetchHeight(node NodeAddress) (int, error) {
+    resp, err := nodeInstance.peerGet(node, "/get-height")
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    var height int
+    err = json.NewDecoder(resp.Body).Decode(&height)
+    if err == nil {
+        nodeInstance.updatePeerTip(node, height)
+    }
+    return height, err
+}
+
+// the block at height on a peer's chain
+func (nodeInstance *Node) fetchBlock(node NodeAddress, height int) (blockchainPackage.Block, error) {
+    var block blockchainPackage.Block
+    err := nodeInstance.peerQuery(node, "/get-block", height, &block)
+    if err == nil && block.Index != height {
+        err = errors.New(addressKey(node) + " does not have block " + strconv.Itoa(height))
+    }
+    return block, err
+}
+
+// the blocks from height from up to to on a peer's chain
+func (nodeInstance *Node) fetchBlocks(node NodeAddress, from int, to int) ([]blockchainPackage.Block, error) {
+    blocks := []blockchainPackage.Block{}
+    for height := from; height < to; height++ {
+        block, err := nodeInstance.fetchBlock(node, height)
+        if err != nil {
+            return nil, err
+        }
+        blocks = append(blocks, block)
+    }
+    return blocks, nil
+}
+
+// Catch up with a peer that is ahead of us or on another branch. We find the
+// last block we share, fetch everything after it and switch to the peer's
+// branch if it has more work. Returns true if our chain changed
+func (nodeInstance *Node) syncFrom(node NodeAddress) bool {
+    // one sync at a time. Whoever is already syncing goes round again for us once
+    // it's done, its sync may have started before the blocks we heard about
+    if !nodeInstance.syncMutex.TryLock() {
+        nodeInstance.PeerMutex.Lock()
+        nodeInstance.pendingSync = &node
+        nodeInstance.PeerMutex.Unlock()
+        return false
+    }
+    changed := nodeInstance.syncOnce(node)
+    nodeInstance.syncMutex.Unlock()
+
+    nodeInstance.PeerMutex.Lock()
+    pending := nodeInstance.pendingSync
+    nodeInstance.pendingSync = nil
+    nodeInstance.PeerMutex.Unlock()
+    if pending != nil && nodeInstance.syncFrom(*pending) {
+        changed = true
+    }
+    return changed
+}
+
+// how many blocks are fetched from a peer before they're checked
+var SYNC_BATCH_SIZE int = 128
+
+// one pass of syncFrom, the caller holds syncMutex
+func (nodeInstance *Node) syncOnce(node NodeAddress) bool {
+    theirHeight, err := nodeInstance.fetchHeight(node)
+    if err != nil {
+        return false
+    }
+    ourHeight, _ := nodeInstance.localTip()
+
+    // once two chains differ they never agree again, so search for the last
+    // shared block. We both have the same genesis block after the handshake
+    shared := 1
+    highest := ourHeight
+    if theirHeight < highest {
+        highest = theirHeight
+    }
+    for shared < highest {
+        middle := (shared + highest + 1) / 2
+        var theirHash string
+        err = nodeInstance.peerQuery(node, "/get-block-hash", middle - 1, &theirHash)
+        if err != nil {
+            return false
+        }
+        if theirHash == nodeInstance.localHash(middle - 1) {
+            shared = middle
+        } else {
+            highest = middle - 1
+        }
+    }
+    if theirHeight <= shared {
+        return false
+    }
+
+    // Fetch the peer's blocks a batch at a time and check each batch as it comes
+    // in, so a peer can't have us hold any number of blocks we haven't checked.
+    // We switch as soon as the blocks have more work than ours, until then
+    // they're kept. We stop at the first bad block and hold it against the peer
+    fork := shared
+    blocks := []blockchainPackage.Block{}
+    var tip blockchainPackage.Block
+    changed := false
+    for next := shared; next < theirHeight; {
+        end := next + SYNC_BATCH_SIZE
+        if end > theirHeight {
+            end = theirHeight
+        }
+        batch, err := nodeInstance.fetchBlocks(node, next, end)
+        if err != nil {
+            fmt.Println(err.Error())
+            break
+        }
+        blocks = append(blocks, batch...)
+        next = end
+
+        nodeInstance.BranchCheckChannel <- blockchainPackage.Branch{ForkHeight: fork, Blocks: blocks}
+        err = <-nodeInstance.BranchCheckResultChannel
+        if invalid, ok := err.(*blockchainPackage.InvalidBlockError); ok {
+            nodeInstance.misbehaving(node.IpAddr, SCORE_INVALID_BLOCK, invalid.Reason)
+            break
+        } else if err != nil {
+            // the peer may have switched branches since we found where we fork, the next sync starts again
+            break
+        }
+        nodeInstance.ReorgChannel <- blockchainPackage.Branch{ForkHeight: fork, Blocks: blocks}
+        if <-nodeInstance.ReorgResultChannel {
+            changed = true
+            tip = blocks[len(blocks) - 1]
+            fork = tip.Index + 1
+            blocks = []blockchainPackage.Block{}
+        }
+    }
+    if !changed {
+        return false
+    }
+    fmt.Println("Synced to block " + strconv.Itoa(tip.Index + 1) + " from " + addressKey(node))
+    nodeInstance.markUseful(node)
+
+    // pass our new tip on to everyone else
+    hash := nodeInstance.localHash(tip.Index)
+    nodeInstance.markSeen(hash)
+    nodeInstance.relay(InvItem{Type: INV_BLOCK, Hash: hash}, tip, node)
+    return true
+}
+
+// Catch up with every known node that is ahead of us or on a branch with more
+// work. Returns true if our chain changed
+func (nodeInstance *Node) SyncFromPeers() bool {
+    nodes := nodeInstance.snapshotNodes()
+
+    changed := false
+    for _, node := range nodes {
+        if nodeInstance.syncFrom(node) {
+            changed = true
+        }
+    }
+    return changed
+}
+
+// Catch up with the nodes in the list that told us they're ahead. Blocks
+// announced before we connected to a node aren't announced again, this is how
+// we get them
+func (nodeInstance *Node) catchUp() {
+    nodes := nodeInstance.snapshotNodes()
+    ourHeight, _ := nodeInstance.localTip()
+    for _, node := range nodes {
+        nodeInstance.PeerMutex.Lock()
+        peer, ok := nodeInstance.outboundPeers[addressKey(node)]
+        ahead := ok && peer.BestHeight > ourHeight
+        nodeInstance.PeerMutex.Unlock()
+        if ahead && nodeInstance.syncFrom(node) {
+            ourHeight, _ = nodeInstance.localTip()
+        }
+    }
+}
+
+// fetch announced objects we don't have from the peer that announced them
+func (nodeInstance *Node) fetchInventory(items []InvItem, from NodeAddress) {
+    for _, item := range items {
+        // there is no transaction pool yet, so there's nothing to do with transactions
+        if item.Type != INV_BLOCK {
+            continue
+        }
+        if !nodeInstance.markSeen(item.Hash) || nodeInstance.haveBlock(item.Hash) {
+            continue
+        }
+
+        var block blockchainPackage.Block
+        err := nodeInstance.peerQuery(from, "/get-block-by-hash", item.Hash, &block)
+        if err != nil {
+            // someone else may announce it and have better luck
+            nodeInstance.forgetSeen(item.Hash)
+            continue
+        }
+
+        err = nodeInstance.submitBlock(block)
+        if err == nil {
+            nodeInstance.markUseful(from)
+            nodeInstance.relay(item, block, from)
+        } else if _, invalid := err.(*blockchainPackage.InvalidBlockError); invalid {
+            nodeInstance.misbehaving(from.IpAddr, SCORE_INVALID_BLOCK, "invalid block " + item.Hash)
+        } else if err == blockchainPackage.ErrBlockDoesNotConnect {
+            // the block doesn't fit on our tip, we're behind or on another branch
+            nodeInstance.syncFrom(from)
+        }
+    }
+}
+
+// a server function to hear about objects a peer has, fetching the ones we lack
+func (nodeInstance *Node) receiveInventory(w http.ResponseWriter, req *http.Request) {
+    if req.Body == nil {
+        http.Error(w, "Please provide a list of inventory items", 400)
+        return
+    }
+    var items []InvItem
+    err := json.NewDecoder(req.Body).Decode(&items)
+    if err != nil {
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable inventory")
+    } else if len(items) > MAX_INV_ITEMS {
+        nodeInstance.misbehavingRequest(req, SCORE_OVERSIZED_INV, strconv.Itoa(len(items)) + " inventory items")
+    }
+    if err != nil || len(items) > MAX_INV_ITEMS {
+        http.Error(w, "Please provide up to " + strconv.Itoa(MAX_INV_ITEMS) + " inventory items", 400)
+        return
+    }
+
+    peer, ok := nodeInstance.sessionPeer(req)
+    if !ok {
+        http.Error(w, "Please shake hands first", http.StatusPreconditionRequired)
+        return
+    }
+
+    // answer right away, the announcer doesn't wait for us to fetch anything
+    w.WriteHeader(http.StatusOK)
+    go nodeInstance.fetchInventory(items, peer.Address)
+}
@@ -0,0 +1,453 @@
+package nodePackage
+
+import (
+    "blockchain"
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+)
+
+// the protocol version we speak, and the oldest one we still accept from peers
+var PROTOCOL_VERSION int = 1
+var MIN_PROTOCOL_VERSION int = 1
+
+// optional parts of the protocol. Peers only use the features both sides list
+var FEATURE_BLOCK_INDEX string = "block-index"
+// announce blocks by hash on /inv instead of posting them whole to /add-block
+var FEATURE_INV string = "inv"
+// keep a long-lived connection open on /session instead of making a request each time
+var FEATURE_SESSIONS string = "sessions"
+var FEATURES = []string{FEATURE_BLOCK_INDEX, FEATURE_INV, FEATURE_SESSIONS}
+
+var DEFAULT_USER_AGENT string = "go_blockchain/" + strconv.Itoa(PROTOCOL_VERSION)
+
+// the header a peer sends its session in after shaking hands
+var SESSION_HEADER string = "X-Peer-Session"
+
+// forget inbound peers that haven't sent anything for this long, they have to shake hands again
+var SESSION_TIMEOUT int64 = 30 * 60
+
+// define the introduction peers exchange before anything else. The answer to a
+// handshake carries the session the caller must send with every other request
+type Handshake struct {
+    ProtocolVersion int
+    MinProtocolVersion int
+    Features []string
+    ChainID string
+    GenesisHash string
+    BestHeight int
+    BestHash string
+    UserAgent string
+    // where the sender accepts peers, empty if it doesn't know yet
+    Address NodeAddress
+    // random for each run of a node, so a node can tell when it has reached itself
+    Nonce string
+    Session string `json:",omitempty"`
+}
+
+// define what we know about a peer we've shaken hands with
+type Peer struct {
+    // the address we connect to for outbound peers, the one they advertised for inbound peers
+    Address NodeAddress
+    Inbound bool
+    // the protocol version and features both sides support
+    ProtocolVersion int
+    Features []string
+    UserAgent string
+    // the peer's tip when it last told us
+    BestHeight int
+    BestHash string
+    ConnectedAt int64
+    LastSeen int64
+    // when the peer last gave us a block we didn't have, 0 if it never has
+    LastBlock int64
+    // whether we're talking over an open session rather than separate HTTP requests
+    Streaming bool
+    session string
+    remoteIP string
+    // the nonce from the peer's handshake, the same for every handshake from one run of it
+    nonce string
+    // the open session with the peer, nil when we use HTTP
+    stream *session
+}
+
+// whether both sides of the connection support feature
+func (peer *Peer) HasFeature(feature string) bool {
+    for _, supported := range peer.Features {
+        if supported == feature {
+            return true
+        }
+    }
+    return false
+}
+
+// the key the peer table uses for an address
+func addressKey(node NodeAddress) string {
+    return net.JoinHostPort(node.IpAddr, strconv.Itoa(node.Port))
+}
+
+// the user agent we introduce ourselves with
+func (nodeInstance *Node) GetUserAgent() string {
+    if nodeInstance.UserAgent == "" {
+        return DEFAULT_USER_AGENT
+    }
+    return nodeInstance.UserAgent
+}
+
+// ask the blockchain for its height
+func (nodeInstance *Node) localHeight() int {
+    nodeInstance.heightMutex.Lock()
+    defer nodeInstance.heightMutex.Unlock()
+    nodeInstance.HeightRequestChannel <- true
+    return <-nodeInstance.HeightChannel
+}
+
+// ask the blockchain to look up a block by hash or height
+func (nodeInstance *Node) lookup(query blockchainPackage.IndexQuery) blockchainPackage.IndexEntry {
+    nodeInstance.indexMutex.Lock()
+    defer nodeInstance.indexMutex.Unlock()
+    nodeInstance.IndexQueryChannel <- query
+    return <-nodeInstance.IndexEntryChannel
+}
+
+// ask the blockchain for its height and the hash of its newest block
+func (nodeInstance *Node) localTip() (int, string) {
+    height := nodeInstance.localHeight()
+    return height, nodeInstance.lookup(blockchainPackage.IndexQuery{Height: height - 1}).Hash
+}
+
+// build our side of a handshake
+func (nodeInstance *Node) ourHandshake() Handshake {
+    nodeInstance.PeerMutex.Lock()
+    if nodeInstance.nonce == "" {
+        nodeInstance.nonce, _ = newSession()
+    }
+    nonce := nodeInstance.nonce
+    nodeInstance.PeerMutex.Unlock()
+
+    height, hash := nodeInstance.localTip()
+    return Handshake{
+        ProtocolVersion: PROTOCOL_VERSION,
+        MinProtocolVersion: MIN_PROTOCOL_VERSION,
+        Features: FEATURES,
+        ChainID: nodeInstance.GetParams().ChainID,
+        GenesisHash: nodeInstance.GetParams().GenesisHash,
+        BestHeight: height,
+        BestHash: hash,
+        UserAgent: nodeInstance.GetUserAgent(),
+        Address: nodeInstance.MyAddress,
+        Nonce: nonce,
+    }
+}
+
+// Check the other side's handshake against ours and work out what the two of us
+// have in common. Returns the peer to record, without its address or session
+func (nodeInstance *Node) negotiate(ours Handshake, theirs Handshake) (*Peer, error) {
+    params := nodeInstance.GetParams()
+    if theirs.Nonce == ours.Nonce {
+        return nil, errors.New("connected to ourselves")
+    }
+    if theirs.ChainID != params.ChainID {
+        return nil, errors.New("the peer is on " + theirs.ChainID + ", not " + params.ChainID)
+    }
+    if theirs.GenesisHash != params.GenesisHash {
+        return nil, errors.New("the peer's chain starts with genesis block " + theirs.GenesisHash + ", not " + params.GenesisHash)
+    }
+
+    // speak the newest version we both know, as long as both sides still accept it
+    version := PROTOCOL_VERSION
+    if theirs.ProtocolVersion < version {
+        version = theirs.ProtocolVersion
+    }
+    if version < MIN_PROTOCOL_VERSION || version < theirs.MinProtocolVersion {
+        return nil, errors.New("no common protocol version, we speak " + strconv.Itoa(MIN_PROTOCOL_VERSION) + " to " +
+                               strconv.Itoa(PROTOCOL_VERSION) + " and the peer speaks " +
+                               strconv.Itoa(theirs.MinProtocolVersion) + " to " + strconv.Itoa(theirs.ProtocolVersion))
+    }
+
+    features := []string{}
+    for _, feature := range FEATURES {
+        for _, theirFeature := range theirs.Features {
+            if feature == theirFeature {
+                features = append(features, feature)
+                break
+            }
+        }
+    }
+
+    now := nodeInstance.now().Unix()
+    return &Peer{
+        Address: theirs.Address,
+        ProtocolVersion: version,
+        Features: features,
+        UserAgent: theirs.UserAgent,
+        BestHeight: theirs.BestHeight,
+        BestHash: theirs.BestHash,
+        ConnectedAt: now,
+        LastSeen: now,
+    }, nil
+}
+
+// A client function to introduce ourselves to another node. The peer is added to
+// the peer table and its session is used for every later request
+func (nodeInstance *Node) Handshake(node NodeAddress) (*Peer, error) {
+    ours := nodeInstance.ourHandshake()
+    jsonHandshake, err := json.Marshal(ours)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := nodeInstance.sendRequest(node, "POST", "/handshake", jsonHandshake, "")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        message := new(bytes.Buffer)
+        message.ReadFrom(resp.Body)
+        return nil, errors.New(addressKey(node) + " refused our handshake: " + string(bytes.TrimSpace(message.Bytes())))
+    }
+
+    var theirs Handshake
+    err = json.NewDecoder(resp.Body).Decode(&theirs)
+    if err != nil {
+        return nil, err
+    }
+    peer, err := nodeInstance.negotiate(ours, theirs)
+    if err != nil {
+        return nil, err
+    }
+    if theirs.Session == "" {
+        return nil, errors.New(addressKey(node) + " did not give us a session")
+    }
+    peer.Address = node
+    peer.session = theirs.Session
+    nodeInstance.Addresses().Good(node)
+
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    if nodeInstance.outboundPeers == nil {
+        nodeInstance.outboundPeers = map[string]*Peer{}
+    }
+    nodeInstance.outboundPeers[addressKey(node)] = peer
+    return peer, nil
+}
+
+// the outbound peer at node, shaking hands first if we haven't yet. We don't talk to banned nodes
+func (nodeInstance *Node) outboundPeer(node NodeAddress) (*Peer, error) {
+    if nodeInstance.IsBanned(node.IpAddr) {
+        return nil, errors.New(addressKey(node) + " is banned")
+    }
+    nodeInstance.PeerMutex.Lock()
+    peer, ok := nodeInstance.outboundPeers[addressKey(node)]
+    nodeInstance.PeerMutex.Unlock()
+    if ok {
+        return peer, nil
+    }
+    return nodeInstance.Handshake(node)
+}
+
+// drop an outbound peer so the next request shakes hands again
+func (nodeInstance *Node) forgetPeer(node NodeAddress) {
+    nodeInstance.PeerMutex.Lock()
+    delete(nodeInstance.outboundPeers, addressKey(node))
+    nodeInstance.PeerMutex.Unlock()
+}
+
+// remember the tip a peer told us about
+func (nodeInstance *Node) updatePeerTip(node NodeAddress, height int) {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    peer, ok := nodeInstance.outboundPeers[addressKey(node)]
+    if ok {
+        peer.BestHeight = height
+        peer.LastSeen = nodeInstance.now().Unix()
+    }
+}
+
+// Every peer we've shaken hands with, outbound first, then inbound
+func (nodeInstance *Node) Peers() []Peer {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+
+    peers := []Peer{}
+    for _, table := range []map[string]*Peer{nodeInstance.outboundPeers, nodeInstance.inboundPeers} {
+        start := len(peers)
+        for _, peer := range table {
+            listed := *peer
+            listed.Streaming = peer.stream != nil
+            peers = append(peers, listed)
+        }
+        group := peers[start:]
+        sort.Slice(group, func(i, j int) bool { return group[i].ConnectedAt < group[j].ConnectedAt })
+    }
+    return peers
+}
+
+// make a random session token
+func newSession() (string, error) {
+    token := make([]byte, 16)
+    _, err := rand.Read(token)
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(token), nil
+}
+
+// Check a handshake from a peer that connected to us and add it to the peer
+// table under a new session. stream is the streaming session the handshake came
+// on, nil if it came over HTTP. Returns our answer, which carries the session
+func (nodeInstance *Node) acceptHandshake(theirs Handshake, remoteIP string, stream *session) (Handshake, *Peer, error) {
+    ours := nodeInstance.ourHandshake()
+    peer, err := nodeInstance.negotiate(ours, theirs)
+    if err != nil {
+        return ours, nil, err
+    }
+
+    peer.Inbound = true
+    peer.remoteIP = remoteIP
+    peer.nonce = theirs.Nonce
+    // a peer that doesn't know its public address can still be reached where it called from
+    if peer.Address.IpAddr == "" {
+        peer.Address.IpAddr = peer.remoteIP
+    }
+    peer.session, err = newSession()
+    if err != nil {
+        return ours, nil, err
+    }
+
+    nodeInstance.PeerMutex.Lock()
+    if nodeInstance.inboundPeers == nil {
+        nodeInstance.inboundPeers = map[string]*Peer{}
+    }
+    // drop HTTP sessions that have gone quiet so the table doesn't grow forever,
+    // and the HTTP session of a peer shaking hands over HTTP again, it only uses
+    // the new one. That one keeps how long the peer's been around and when it
+    // last sent us a block. Only sessions from the same address are replaced, so
+    // a made-up nonce can't push out anyone else. Streams leave the table when
+    // they close
+    for session, inbound := range nodeInstance.inboundPeers {
+        if inbound.stream != nil {
+            continue
+        }
+        if stream == nil && inbound.nonce == peer.nonce && inbound.remoteIP == peer.remoteIP {
+            peer.ConnectedAt = inbound.ConnectedAt
+            peer.LastBlock = inbound.LastBlock
+            delete(nodeInstance.inboundPeers, session)
+        } else if peer.LastSeen - inbound.LastSeen > SESSION_TIMEOUT {
+            delete(nodeInstance.inboundPeers, session)
+        }
+    }
+    // the stream is tied to the peer before anyone else can see it, so closing
+    // it always takes the peer out again. If it closed while we were shaking
+    // hands there's nothing to add
+    if stream != nil {
+        select {
+        case <-stream.closed:
+            nodeInstance.PeerMutex.Unlock()
+            return ours, nil, errors.New("the session closed during the handshake")
+        default:
+        }
+    }
+    evicted, ok := nodeInstance.makeInboundRoom(peer.remoteIP)
+    if ok {
+        if stream != nil {
+            peer.stream = stream
+            stream.peer = peer
+        }
+        nodeInstance.inboundPeers[peer.session] = peer
+    }
+    nodeInstance.PeerMutex.Unlock()
+    if evicted != nil {
+        evicted.close()
+    }
+    if !ok {
+        return ours, nil, errTooManyPeers
+    }
+
+    ours.Session = peer.session
+    return ours, peer, nil
+}
+
+// a server function to shake hands with a new peer and give it a session
+func (nodeInstance *Node) handshake(w http.ResponseWriter, req *http.Request) {
+    if req.Body == nil {
+        http.Error(w, "Please provide a handshake", 400)
+        return
+    }
+    var theirs Handshake
+    err := json.NewDecoder(req.Body).Decode(&theirs)
+    if err != nil {
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable handshake")
+        http.Error(w, "Please provide a handshake", 400)
+        return
+    }
+    remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+    ours, _, err := nodeInstance.acceptHandshake(theirs, remoteIP, nil)
+    if err == errTooManyPeers {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    jsonHandshake := new(bytes.Buffer)
+    err = json.NewEncoder(jsonHandshake).Encode(ours)
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonHandshake.Bytes())
+}
+
+// wrap a server function so it only answers peers that have shaken hands with us
+func (nodeInstance *Node) fromPeer(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+
+        nodeInstance.PeerMutex.Lock()
+        peer, ok := nodeInstance.inboundPeers[req.Header.Get(SESSION_HEADER)]
+        if ok && peer.remoteIP == remoteIP {
+            peer.LastSeen = nodeInstance.now().Unix()
+        }
+        nodeInstance.PeerMutex.Unlock()
+
+        if !ok || peer.remoteIP != remoteIP {
+            http.Error(w, "Please shake hands first", http.StatusPreconditionRequired)
+            return
+        }
+        handler(w, req)
+    }
+}
+
+// the peer that sent a request, found by its session. Requests that came over an
+// open session carry their peer with them
+func (nodeInstance *Node) sessionPeer(req *http.Request) (Peer, bool) {
+    if peer, ok := req.Context().Value(peerContextKey{}).(Peer); ok {
+        return peer, true
+    }
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    peer, ok := nodeInstance.inboundPeers[req.Header.Get(SESSION_HEADER)]
+    if !ok {
+        return Peer{}, false
+    }
+    return *peer, true
+}
+
+// an admin server function to list the peers we've shaken hands with
+func (nodeInstance *Node) sendPeers(w http.ResponseWriter, req *http.Request) {
+    jsonPeers := new(bytes.Buffer)
+    err := json.NewEncoder(jsonPeers).Encode(nodeInstance.Peers())
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonPeers.Bytes())
+}
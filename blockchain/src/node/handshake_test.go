@@ -0,0 +1,92 @@
+package nodePackage
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+    tests := []struct {
+        name string
+        change func(theirs *Handshake)
+        wantErr bool
+        wantVersion int
+        wantFeatures []string
+    }{
+        {"same as ours", func(theirs *Handshake) {}, false, PROTOCOL_VERSION, FEATURES},
+        {"ourselves", func(theirs *Handshake) { theirs.Nonce = "ours" }, true, 0, nil},
+        {"another network", func(theirs *Handshake) { theirs.ChainID = "go_blockchain-main" }, true, 0, nil},
+        {"another genesis block", func(theirs *Handshake) { theirs.GenesisHash = "00" }, true, 0, nil},
+        {"a newer peer that still speaks ours", func(theirs *Handshake) {
+            theirs.ProtocolVersion = PROTOCOL_VERSION + 2
+        }, false, PROTOCOL_VERSION, FEATURES},
+        {"a newer peer that doesn't", func(theirs *Handshake) {
+            theirs.ProtocolVersion = PROTOCOL_VERSION + 2
+            theirs.MinProtocolVersion = PROTOCOL_VERSION + 1
+        }, true, 0, nil},
+        {"an older peer than we accept", func(theirs *Handshake) {
+            theirs.ProtocolVersion = MIN_PROTOCOL_VERSION - 1
+            theirs.MinProtocolVersion = MIN_PROTOCOL_VERSION - 1
+        }, true, 0, nil},
+        {"some features", func(theirs *Handshake) {
+            theirs.Features = []string{"teleport", FEATURES[0]}
+        }, false, PROTOCOL_VERSION, []string{FEATURES[0]}},
+        {"no features", func(theirs *Handshake) { theirs.Features = nil }, false, PROTOCOL_VERSION, []string{}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeInstance, _ := newTestNode(t)
+            ours := peerHandshake("10.0.0.1", "ours")
+            theirs := peerHandshake("10.0.0.9", "theirs")
+            test.change(&theirs)
+
+            peer, err := nodeInstance.negotiate(ours, theirs)
+            if (err != nil) != test.wantErr {
+                t.Fatalf("got %v, want an error: %v", err, test.wantErr)
+            }
+            if test.wantErr {
+                return
+            }
+            if peer.ProtocolVersion != test.wantVersion || !reflect.DeepEqual(peer.Features, test.wantFeatures) {
+                t.Errorf("agreed on version %d with %v, want %d with %v", peer.ProtocolVersion, peer.Features,
+                         test.wantVersion, test.wantFeatures)
+            }
+        })
+    }
+}
+
+func TestFromPeer(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    attachBlockchain(t, nodeInstance)
+    ours, _, err := nodeInstance.acceptHandshake(peerHandshake("10.0.0.9", "theirs"), "10.0.0.9", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name string
+        remoteAddr string
+        session string
+        wantStatus int
+    }{
+        {"the peer", "10.0.0.9:5000", ours.Session, http.StatusOK},
+        {"no session", "10.0.0.9:5000", "", http.StatusPreconditionRequired},
+        {"a made up session", "10.0.0.9:5000", "made up", http.StatusPreconditionRequired},
+        {"the session from elsewhere", "10.0.0.8:5000", ours.Session, http.StatusPreconditionRequired},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            handler := nodeInstance.fromPeer(func(w http.ResponseWriter, req *http.Request) {})
+            req := httptest.NewRequest("GET", "/get-height", nil)
+            req.RemoteAddr = test.remoteAddr
+            req.Header.Set(SESSION_HEADER, test.session)
+            w := httptest.NewRecorder()
+            handler(w, req)
+            if w.Code != test.wantStatus {
+                t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+            }
+        })
+    }
+}
@@ -0,0 +1,175 @@
+package nodePackage
+
+import (
+    "errors"
+    "net"
+    "sort"
+)
+
+// how many nodes we talk to, and how many peers that connect to us we keep, unless told otherwise
+var DEFAULT_TARGET_OUTBOUND int = 8
+var DEFAULT_MAX_INBOUND int = 32
+
+// how many inbound sessions one ip address can hold. A peer on a streaming
+// session usually holds two, the stream and the one its HTTP requests carry
+var MAX_INBOUND_PER_IP int = 4
+
+// how often SyncNodes asks the nodes it talks to for more addresses
+var ADDRESS_REFRESH_INTERVAL int64 = 60
+
+// when the inbound table is full, this many of each kind of peer are kept no
+// matter what: the ones that sent us blocks last and the ones that have been
+// around longest. An attacker can't fake either cheaply
+var PROTECT_BY_BLOCKS int = 4
+var PROTECT_BY_AGE int = 4
+
+// what acceptHandshake gives back when there's no room for another inbound peer
+var errTooManyPeers = errors.New("this node has all the inbound peers it takes")
+
+// how many nodes SyncNodes keeps in the node list and talks to
+func (nodeInstance *Node) targetOutbound() int {
+    if nodeInstance.TargetOutbound <= 0 {
+        return DEFAULT_TARGET_OUTBOUND
+    }
+    return nodeInstance.TargetOutbound
+}
+
+// how many peers that connected to us we keep
+func (nodeInstance *Node) maxInbound() int {
+    if nodeInstance.MaxInbound <= 0 {
+        return DEFAULT_MAX_INBOUND
+    }
+    return nodeInstance.MaxInbound
+}
+
+// Remember that a peer at node just gave us a block we didn't have, which makes
+// it worth keeping when the inbound table fills up
+func (nodeInstance *Node) markUseful(node NodeAddress) {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    now := nodeInstance.now().Unix()
+    key := addressKey(node)
+    if peer, ok := nodeInstance.outboundPeers[key]; ok {
+        peer.LastBlock = now
+    }
+    for _, peer := range nodeInstance.inboundPeers {
+        if addressKey(peer.Address) == key {
+            peer.LastBlock = now
+        }
+    }
+}
+
+// Pick the inbound session we'd miss least and give back its key, or "" if
+// every one of them is protected. After protecting the sessions of peers that
+// sent blocks lately and the oldest ones, we take the newest session from the
+// network group with the most sessions, so one network flooding us with
+// connections only pushes out its own. The caller holds PeerMutex
+func (nodeInstance *Node) leastUsefulInbound() string {
+    candidates := []*Peer{}
+    for _, peer := range nodeInstance.inboundPeers {
+        candidates = append(candidates, peer)
+    }
+
+    // drop the best n candidates by less from the running
+    protect := func(n int, less func(a *Peer, b *Peer) bool) {
+        sort.Slice(candidates, func(i, j int) bool { return less(candidates[i], candidates[j]) })
+        if n > len(candidates) {
+            n = len(candidates)
+        }
+        candidates = candidates[n:]
+    }
+    protect(PROTECT_BY_BLOCKS, func(a *Peer, b *Peer) bool { return a.LastBlock > b.LastBlock })
+    protect(PROTECT_BY_AGE, func(a *Peer, b *Peer) bool { return a.ConnectedAt < b.ConnectedAt })
+    if len(candidates) == 0 {
+        return ""
+    }
+
+    groups := map[string][]*Peer{}
+    biggest := ""
+    for _, peer := range candidates {
+        group := addressGroup(peer.remoteIP)
+        groups[group] = append(groups[group], peer)
+        if biggest == "" || len(groups[group]) > len(groups[biggest]) ||
+           (len(groups[group]) == len(groups[biggest]) && group < biggest) {
+            biggest = group
+        }
+    }
+    newest := groups[biggest][0]
+    for _, peer := range groups[biggest] {
+        if peer.ConnectedAt > newest.ConnectedAt {
+            newest = peer
+        }
+    }
+    return newest.session
+}
+
+// Make room for another inbound session from remoteIP, dropping the least
+// useful session if the table is full. Returns the stream to close, if the
+// dropped session had one, and false if there's no room: remoteIP already holds
+// as many sessions as one address may, or every session is protected. The
+// caller holds PeerMutex
+func (nodeInstance *Node) makeInboundRoom(remoteIP string) (*session, bool) {
+    // local nodes are ours, so a cluster on one machine isn't held to the cap
+    if ip := net.ParseIP(remoteIP); ip == nil || !ip.IsLoopback() {
+        fromIP := 0
+        for _, peer := range nodeInstance.inboundPeers {
+            if peer.remoteIP == remoteIP {
+                fromIP++
+            }
+        }
+        if fromIP >= MAX_INBOUND_PER_IP {
+            return nil, false
+        }
+    }
+    if len(nodeInstance.inboundPeers) < nodeInstance.maxInbound() {
+        return nil, true
+    }
+    evicted := nodeInstance.leastUsefulInbound()
+    if evicted == "" {
+        return nil, false
+    }
+    stream := nodeInstance.inboundPeers[evicted].stream
+    delete(nodeInstance.inboundPeers, evicted)
+    return stream, true
+}
+
+// Whether another inbound session from remoteIP may be opened. Sessions that
+// haven't shaken hands yet count against the per address cap along with the
+// peers from there, and no more of them than the inbound cap are open at once,
+// so opening sessions and never shaking hands can't get round either cap. The
+// caller holds PeerMutex
+func (nodeInstance *Node) roomForSession(remoteIP string) bool {
+    waiting, fromIP := 0, 0
+    for s := range nodeInstance.sessions {
+        if s.inbound && s.peer == nil {
+            waiting++
+            if s.remoteIP() == remoteIP {
+                fromIP++
+            }
+        }
+    }
+    for _, peer := range nodeInstance.inboundPeers {
+        if peer.remoteIP == remoteIP {
+            fromIP++
+        }
+    }
+    if ip := net.ParseIP(remoteIP); (ip == nil || !ip.IsLoopback()) && fromIP >= MAX_INBOUND_PER_IP {
+        return false
+    }
+    return waiting < nodeInstance.maxInbound()
+}
+
+// stop talking to an outbound peer that left the node list, closing its session
+func (nodeInstance *Node) dropOutbound(node NodeAddress) {
+    nodeInstance.PeerMutex.Lock()
+    var stream *session
+    if peer, ok := nodeInstance.outboundPeers[addressKey(node)]; ok {
+        // the session clears this when it closes, so read it under the lock
+        stream = peer.stream
+    }
+    delete(nodeInstance.outboundPeers, addressKey(node))
+    nodeInstance.PeerMutex.Unlock()
+    if stream != nil {
+        stream.close()
+    }
+}
@@ -0,0 +1,165 @@
+package nodePackage
+
+import (
+    "blockchain"
+    "net"
+    "strconv"
+    "testing"
+)
+
+// an inbound session on one end of a pipe, closed when the test ends
+func newTestSession(t *testing.T, nodeInstance *Node) *session {
+    conn, other := net.Pipe()
+    t.Cleanup(func() { other.Close() })
+    s := &session{node: nodeInstance, conn: conn, inbound: true, closed: make(chan bool)}
+    t.Cleanup(s.close)
+    return s
+}
+
+// the handshake a regtest peer at ip sends
+func peerHandshake(ip string, nonce string) Handshake {
+    return Handshake{
+        ProtocolVersion: PROTOCOL_VERSION,
+        MinProtocolVersion: MIN_PROTOCOL_VERSION,
+        Features: FEATURES,
+        ChainID: blockchainPackage.RegTestParams.ChainID,
+        GenesisHash: blockchainPackage.RegTestParams.GenesisHash,
+        Address: NodeAddress{IpAddr: ip, Port: 28080},
+        Nonce: nonce,
+    }
+}
+
+func TestMakeInboundRoom(t *testing.T) {
+    // an inbound peer already in the table
+    type inbound struct {
+        ip string
+        connectedAt int64
+        lastBlock int64
+    }
+    // count peers from ip connected at first, first + 1 and so on
+    fromIP := func(ip string, count int, first int64) []inbound {
+        peers := []inbound{}
+        for i := 0; i < count; i++ {
+            peers = append(peers, inbound{ip, first + int64(i), 0})
+        }
+        return peers
+    }
+
+    tests := []struct {
+        name string
+        maxInbound int
+        peers []inbound
+        from string
+        wantOK bool
+        // the index in peers of the one pushed out, -1 for none
+        wantEvicted int
+    }{
+        {"room left", 4, fromIP("10.0.0.1", 2, 0), "10.0.0.2", true, -1},
+        {"address at its cap", 32, fromIP("10.0.0.9", MAX_INBOUND_PER_IP, 0), "10.0.0.9", false, -1},
+        {"another address", 32, fromIP("10.0.0.9", MAX_INBOUND_PER_IP, 0), "10.0.0.8", true, -1},
+        {"loopback isn't capped", 32, fromIP("127.0.0.1", MAX_INBOUND_PER_IP, 0), "127.0.0.1", true, -1},
+        {"every peer protected", 8, []inbound{
+            {"10.1.0.1", 0, 0}, {"10.1.0.2", 1, 0}, {"10.1.0.3", 2, 0}, {"10.1.0.4", 3, 0},
+            {"10.2.0.1", 4, 50}, {"10.2.0.2", 5, 51}, {"10.2.0.3", 6, 52}, {"10.2.0.4", 7, 53},
+        }, "10.3.0.1", false, -1},
+        {"newest from the biggest group", 12, []inbound{
+            // the oldest four and the four that sent blocks last are kept
+            {"10.1.0.1", 0, 0}, {"10.1.0.2", 1, 0}, {"10.1.0.3", 2, 0}, {"10.1.0.4", 3, 0},
+            {"10.2.0.1", 4, 0}, {"10.2.0.2", 5, 0}, {"10.2.0.3", 6, 0}, {"10.3.0.1", 7, 0},
+            {"10.4.0.1", 8, 50}, {"10.4.0.2", 9, 51}, {"10.4.0.3", 10, 52}, {"10.4.0.4", 11, 53},
+        }, "10.5.0.1", true, 6},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeInstance, _ := newTestNode(t)
+            nodeInstance.MaxInbound = test.maxInbound
+            nodeInstance.inboundPeers = map[string]*Peer{}
+            keys := []string{}
+            for i, peer := range test.peers {
+                key := "session" + strconv.Itoa(i)
+                keys = append(keys, key)
+                nodeInstance.inboundPeers[key] = &Peer{Inbound: true, session: key, remoteIP: peer.ip,
+                                                       ConnectedAt: peer.connectedAt, LastBlock: peer.lastBlock}
+            }
+            if test.wantEvicted >= 0 {
+                nodeInstance.inboundPeers[keys[test.wantEvicted]].stream = newTestSession(t, nodeInstance)
+            }
+
+            stream, ok := nodeInstance.makeInboundRoom(test.from)
+            if ok != test.wantOK {
+                t.Fatalf("got room %v, want %v", ok, test.wantOK)
+            }
+            if test.wantEvicted < 0 {
+                if stream != nil || len(nodeInstance.inboundPeers) != len(test.peers) {
+                    t.Errorf("a peer was pushed out")
+                }
+                return
+            }
+            if _, kept := nodeInstance.inboundPeers[keys[test.wantEvicted]]; kept || len(nodeInstance.inboundPeers) != len(test.peers) - 1 {
+                t.Errorf("peer %d wasn't the one pushed out", test.wantEvicted)
+            }
+            if stream == nil {
+                t.Errorf("the pushed out peer's stream wasn't handed back to close")
+            }
+        })
+    }
+}
+
+func TestReusedNonceCantGetPastTheCap(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    attachBlockchain(t, nodeInstance)
+
+    // one run of a peer opening stream after stream, all with the same nonce
+    for i := 0; i < MAX_INBOUND_PER_IP + 3; i++ {
+        _, _, err := nodeInstance.acceptHandshake(peerHandshake("10.0.0.9", "nonce"), "10.0.0.9", newTestSession(t, nodeInstance))
+        if (err != nil) != (i >= MAX_INBOUND_PER_IP) {
+            t.Errorf("handshake %d gave %v", i + 1, err)
+        }
+    }
+    if len(nodeInstance.inboundPeers) != MAX_INBOUND_PER_IP {
+        t.Errorf("%d sessions from one address, want %d", len(nodeInstance.inboundPeers), MAX_INBOUND_PER_IP)
+    }
+
+    // the same nonce from elsewhere over HTTP mustn't replace those sessions
+    _, _, err := nodeInstance.acceptHandshake(peerHandshake("10.0.0.8", "nonce"), "10.0.0.8", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(nodeInstance.inboundPeers) != MAX_INBOUND_PER_IP + 1 {
+        t.Errorf("%d sessions, want %d", len(nodeInstance.inboundPeers), MAX_INBOUND_PER_IP + 1)
+    }
+    // shaking hands over HTTP again from the same address only replaces its own session
+    _, peer, err := nodeInstance.acceptHandshake(peerHandshake("10.0.0.8", "nonce"), "10.0.0.8", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(nodeInstance.inboundPeers) != MAX_INBOUND_PER_IP + 1 || nodeInstance.inboundPeers[peer.session] != peer {
+        t.Errorf("the new HTTP session didn't replace the old one")
+    }
+}
+
+func TestClosedStreamsLeaveTheInboundTable(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    attachBlockchain(t, nodeInstance)
+
+    s := newTestSession(t, nodeInstance)
+    _, peer, err := nodeInstance.acceptHandshake(peerHandshake("10.0.0.9", "nonce"), "10.0.0.9", s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if peer.stream != s || s.peer != peer {
+        t.Fatal("the peer isn't tied to its stream")
+    }
+    s.close()
+    if len(nodeInstance.inboundPeers) != 0 {
+        t.Errorf("the closed stream's peer is still in the table")
+    }
+
+    // a stream that closes during the handshake never gets in
+    closed := newTestSession(t, nodeInstance)
+    closed.close()
+    _, _, err = nodeInstance.acceptHandshake(peerHandshake("10.0.0.9", "nonce"), "10.0.0.9", closed)
+    if err == nil || len(nodeInstance.inboundPeers) != 0 {
+        t.Errorf("a closed stream was added: %v", err)
+    }
+}
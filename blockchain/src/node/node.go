@@ -1,22 +1,47 @@
 package nodePackage
 
 import (
+    "context"
+    "datadir"
+    "errors"
     "fmt"
     "net/http"
     "encoding/json"
     "blockchain"
     "bytes"
-    "log"
     "strconv"
-//    "net"
+    "io"
+    "net"
 // uncomment for local mining    "strings"
     "time"
     "sync"
     "io/ioutil"
+    "os"
+    "path/filepath"
+    "wallet"
 )
 
 var NODELIST_FILENAME string = "known_nodes.json"
 
+// bump this whenever the way nodes are stored changes, and add a step to nodeListMigrations
+var NODELIST_FORMAT_VERSION int = 2
+
+// Each step upgrades the stored nodes from version i to version i+1
+var nodeListMigrations = []func(nodes []map[string]interface{}) error{
+    // version 0 was a bare list of nodes, the nodes themselves didn't change
+    func(nodes []map[string]interface{}) error {
+        return nil
+    },
+    // version 2 keeps every address in the address manager's tables, the old
+    // list's addresses start out in the new table as if we'd never reached them
+    func(nodes []map[string]interface{}) error {
+        for _, node := range nodes {
+            node["Tried"] = false
+        }
+        return nil
+    },
+}
+
 // define the node address structure of ip and port
 type NodeAddress struct {
     IpAddr string
@@ -24,17 +49,107 @@ type NodeAddress struct {
     LastSeen int64
 }
 
+// define the layout of the node list file. Key is the address manager's bucket key
+type nodeListFile struct {
+    Version int
+    Key string
+    Nodes []KnownAddress
+}
+
+// the layout of a node list file of any version, before its nodes are upgraded
+type rawNodeListFile struct {
+    Version int
+    Nodes []map[string]interface{}
+}
+
+// what the miner reports through the admin endpoints
+type MinerStatus struct {
+    Running bool
+    Threads int
+    BlocksFound int64
+}
+
+// the miner controls the admin endpoints need. The miner package fills this in
+type MinerControl interface {
+    Start() bool
+    Stop() bool
+    SetThreads(threads int) error
+    Status() MinerStatus
+}
+
 // define the node structure with a list of addresses
 // we will add all of the client/server functions to this struct
 type Node struct {
     MyAddress NodeAddress
+    // the nodes we talk to, picked from every address we know by SyncNodes
     NodeList []NodeAddress
+    DataDir string
+    Params *blockchainPackage.NetworkParams
+    // host:port addresses the server accepts peers on
+    ListenAddresses []string
+    // host:port addresses the server accepts admin requests on
+    AdminListenAddresses []string
+    // ip:port of nodes to ask for peers, the network's seed nodes are used when empty
+    SeedPeers []string
+    HeightRequestChannel chan bool
     HeightChannel chan int
     BlockIndexChannel chan int
-    BlockValidateChannel chan bool
+    BlockValidateChannel chan error
     AddBlockChannel chan blockchainPackage.Block
     GetBlockChannel chan blockchainPackage.Block
+    IndexQueryChannel chan blockchainPackage.IndexQuery
+    IndexEntryChannel chan blockchainPackage.IndexEntry
+    GenerateChannel chan blockchainPackage.GenerateRequest
+    GeneratedChannel chan []blockchainPackage.Block
+    ReorgChannel chan blockchainPackage.Branch
+    ReorgResultChannel chan bool
+    BranchCheckChannel chan blockchainPackage.Branch
+    BranchCheckResultChannel chan error
+    // nil on a node that never mines
+    Miner MinerControl
+    // what we call ourselves in handshakes, DEFAULT_USER_AGENT when empty
+    UserAgent string
+    // how we reach other nodes and they reach us, HTTP when nil
+    Transport Transport
+    // when we last saw peers is measured by this, time.Now when nil
+    Clock func() time.Time
+    // the misbehavior score that gets a peer banned and for how many seconds, the defaults when zero
+    BanThreshold int
+    BanDuration int64
+    // how many nodes we talk to and how many peers that connect to us we keep, the defaults when zero
+    TargetOutbound int
+    MaxInbound int
     NodeListMutex sync.Mutex
+    // every address we know, see Addresses
+    addrManager *AddrManager
+    addrManagerMutex sync.Mutex
+    // when SyncNodes last asked for more addresses
+    lastAddressRefresh int64
+    // guards the peer table: outbound peers by address, inbound peers by session
+    PeerMutex sync.Mutex
+    outboundPeers map[string]*Peer
+    inboundPeers map[string]*Peer
+    nonce string
+    // hashes we've been told about lately, and when
+    seenInventory map[string]int64
+    // held while catching up with a peer
+    syncMutex sync.Mutex
+    // a peer to catch up with once the sync that's running is done
+    pendingSync *NodeAddress
+    // open peer sessions in either direction, refused once we start shutting down
+    sessions map[*session]bool
+    sessionsClosed bool
+    servers []TransportServer
+    // guards misbehavior scores and bans, both by ip address
+    banMutex sync.Mutex
+    misbehavior map[string]int
+    bans map[string]Ban
+    banFileMutex sync.Mutex
+    // held from sending a question to the blockchain until its answer comes back,
+    // so two goroutines asking at once can't take each other's answers
+    heightMutex sync.Mutex
+    indexMutex sync.Mutex
+    addBlockMutex sync.Mutex
 }
 
 //***************************************** Generic Functions ************************************************
@@ -47,34 +162,74 @@ func (nodeInstance *Node) SyncNodes () {
     // register this node with the others
     nodeInstance.RegisterNode()
 
-    // get a list of all nodes on the network
-    nodeInstance.GetNodeList()
+    // ask for more addresses now and then, or right away if we're short of them
+    newCount, triedCount := nodeInstance.Addresses().Count()
+    if nodeInstance.now().Unix() - nodeInstance.lastAddressRefresh >= ADDRESS_REFRESH_INTERVAL ||
+       newCount + triedCount < nodeInstance.targetOutbound() {
+        nodeInstance.GetNodeList()
+        nodeInstance.lastAddressRefresh = nodeInstance.now().Unix()
+    }
 
-    // get status of all nodes in list and remove them if they're offline
+    // get status of all nodes in list and replace the ones that are offline
     nodeInstance.GetNodeStatus()
     nodeInstance.RemoveOfflineNodes()
+    nodeInstance.fillNodeList()
 
     // write current node list to disk
     nodeInstance.writeToDisk()
     nodeInstance.NodeListMutex.Unlock()
+
+    // fetch whatever we missed from nodes that are ahead of us. Syncing relays
+    // what it gets, which needs the node list, so this runs after unlocking it
+    nodeInstance.catchUp()
 }
 
-// A function to remove duplicate nodes from the list
-func removeDuplicateNodes(nodeList []NodeAddress)  []NodeAddress {
-    list := []NodeAddress{}
-    for _, node := range nodeList {
-        found := false
-        // check if any entry in list has the same ip and port
-        for _, uniqueNode := range list {
-            if node.IpAddr == uniqueNode.IpAddr && node.Port == uniqueNode.Port {
-                found = true
-            }
-        }
-        if !found {
-            list = append(list, node)
+// the current time by the node's clock
+func (nodeInstance *Node) now() time.Time {
+    if nodeInstance.Clock == nil {
+        return time.Now()
+    }
+    return nodeInstance.Clock()
+}
+
+// the parameters of the network this node is on, mainnet unless told otherwise
+func (nodeInstance *Node) GetParams() *blockchainPackage.NetworkParams {
+    if nodeInstance.Params == nil {
+        return &blockchainPackage.MainNetParams
+    }
+    return nodeInstance.Params
+}
+
+// Turn an "ip:port" string into a node address
+func ParseNodeAddress(address string) (NodeAddress, error) {
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return NodeAddress{}, err
+    }
+    portNumber, err := strconv.Atoi(port)
+    if err != nil || portNumber <= 0 || portNumber > 65535 {
+        return NodeAddress{}, errors.New("bad port in node address " + address)
+    }
+    return NodeAddress{IpAddr: host, Port: portNumber, LastSeen: time.Now().Unix()}, nil
+}
+
+// the seed nodes, used when we don't know of any other nodes yet
+func (nodeInstance *Node) SeedNodes() []NodeAddress {
+    seedPeers := nodeInstance.SeedPeers
+    if len(seedPeers) == 0 {
+        seedPeers = nodeInstance.GetParams().SeedNodes
+    }
+
+    seeds := []NodeAddress{}
+    for _, seed := range seedPeers {
+        address, err := ParseNodeAddress(seed)
+        if err != nil {
+            fmt.Println(err.Error())
+            continue
         }
+        seeds = append(seeds, address)
     }
-    return list
+    return seeds
 }
 
 // Use publicly available api to find the public IP of this node
@@ -105,111 +260,284 @@ func (nodeInstance *Node) GetPublicIP () {
     nodeInstance.MyAddress.IpAddr = string(ip)
 }
 
-// A function to remove nodes from the list that haven't been online lately
+// A function to remove nodes from the list that stopped answering, or that we
+// shouldn't talk to, and any beyond the outbound target. They stay in the
+// address manager for another time
 func (nodeInstance *Node) RemoveOfflineNodes () {
-
-    // remove nodes that haven't been seen for 36000 seconds
-    for i := 0; i < len(nodeInstance.NodeList); i++ {
-        if time.Now().Unix() - nodeInstance.NodeList[i].LastSeen > 36000 {
-            nodeInstance.NodeList[i] = nodeInstance.NodeList[len(nodeInstance.NodeList) - 1] //move to last element
-            nodeInstance.NodeList = nodeInstance.NodeList[:len(nodeInstance.NodeList) - 1] //truncate
+    addresses := nodeInstance.Addresses()
+    kept := []NodeAddress{}
+    for _, node := range nodeInstance.NodeList {
+        if !nodeInstance.usableNode(node) || addresses.Failures(node) >= MAX_ADDRESS_RETRIES ||
+           len(kept) >= nodeInstance.targetOutbound() {
+            nodeInstance.dropOutbound(node)
+            continue
         }
+        kept = append(kept, node)
     }
+    nodeInstance.NodeList = kept
+}
+
+// A copy of the node list that's safe to use while SyncNodes rewrites it. Don't
+// call this while holding NodeListMutex
+func (nodeInstance *Node) snapshotNodes() []NodeAddress {
+    nodeInstance.NodeListMutex.Lock()
+    defer nodeInstance.NodeListMutex.Unlock()
+    nodes := make([]NodeAddress, len(nodeInstance.NodeList))
+    copy(nodes, nodeInstance.NodeList)
+    return nodes
+}
 
-    // remove this node's own address if it got added in
-    for j := 0; j < len(nodeInstance.NodeList); j++ {
-        if nodeInstance.NodeList[j].IpAddr == nodeInstance.MyAddress.IpAddr &&
-           nodeInstance.NodeList[j].Port == nodeInstance.MyAddress.Port {
-            nodeInstance.NodeList[j] = nodeInstance.NodeList[len(nodeInstance.NodeList) - 1] //move to last element
-            nodeInstance.NodeList = nodeInstance.NodeList[:len(nodeInstance.NodeList) - 1] //truncate
+// whether an address is one we'd talk to: not our own and not banned
+func (nodeInstance *Node) usableNode(node NodeAddress) bool {
+    if node.IpAddr == nodeInstance.MyAddress.IpAddr && node.Port == nodeInstance.MyAddress.Port {
+        return false
+    }
+    return !nodeInstance.IsBanned(node.IpAddr)
+}
+
+// Top the node list up to the outbound target from the address manager, falling
+// back on the seed nodes when we don't know anyone that works
+func (nodeInstance *Node) fillNodeList() {
+    target := nodeInstance.targetOutbound()
+    if len(nodeInstance.NodeList) < target {
+        picked := nodeInstance.Addresses().Select(target - len(nodeInstance.NodeList), nodeInstance.NodeList, nodeInstance.usableNode)
+        nodeInstance.NodeList = append(nodeInstance.NodeList, picked...)
+    }
+    if len(nodeInstance.NodeList) == 0 {
+        for _, seed := range nodeInstance.SeedNodes() {
+            if nodeInstance.usableNode(seed) && len(nodeInstance.NodeList) < target {
+                nodeInstance.NodeList = append(nodeInstance.NodeList, seed)
+            }
         }
     }
 }
 
+// Every address this node knows, tested or not
+func (nodeInstance *Node) Addresses() *AddrManager {
+    nodeInstance.addrManagerMutex.Lock()
+    defer nodeInstance.addrManagerMutex.Unlock()
+    if nodeInstance.addrManager == nil {
+        nodeInstance.addrManager = NewAddrManager(nodeInstance.now)
+    }
+    return nodeInstance.addrManager
+}
+
 /******************************************** Disk I/O Functions *****************************************/
 
-// A function to attempt to read the current node list from the disk
-func (nodeInstance *Node) ReadFromDisk() bool {
+// A function to attempt to read the known addresses from the disk and pick a
+// node list from them. A *datadirPackage.FormatError means the file needs
+// migrating and must not be overwritten
+func (nodeInstance *Node) ReadFromDisk() error {
     // declare node list as an empty slice
-    diskNodeList := []NodeAddress{}
+    diskNodeList := nodeListFile{Nodes: []KnownAddress{}}
 
     // try to open the file
-    fileData, err := ioutil.ReadFile(NODELIST_FILENAME)
+    path := filepath.Join(nodeInstance.DataDir, NODELIST_FILENAME)
+    fileData, err := ioutil.ReadFile(path)
     if err != nil {
         // return so the nodelist will just keep it's previous node list
-        return false
+        return err
+    }
+
+    version, err := datadirPackage.FormatVersion(fileData)
+    if err != nil { //we got an error, so the node list was not formatted well
+        return err
+    }
+    if version != NODELIST_FORMAT_VERSION {
+        return &datadirPackage.FormatError{Path: path, Version: version, Want: NODELIST_FORMAT_VERSION}
     }
 
     err = json.Unmarshal(fileData, &diskNodeList)
     if err != nil { //we got an error, so the node list was not formatted well
-        return false
+        return err
     }
 
-    // we successfully read in the file, set the node list
-    nodeInstance.NodeList = diskNodeList
-    return true
+    // we successfully read in the file, set the addresses and pick the node list from them
+    nodeInstance.setAddresses(diskNodeList.Key, diskNodeList.Nodes)
+    if len(diskNodeList.Nodes) == 0 {
+        return errors.New(path + " has no nodes in it")
+    }
+    return nil
+}
+
+// replace the address manager with one holding addresses, and pick a new node list from it
+func (nodeInstance *Node) setAddresses(key string, addresses []KnownAddress) {
+    nodeInstance.addrManagerMutex.Lock()
+    nodeInstance.addrManager = loadAddrManager(key, addresses, nodeInstance.now)
+    nodeInstance.addrManagerMutex.Unlock()
+    nodeInstance.NodeList = []NodeAddress{}
+    nodeInstance.fillNodeList()
 }
 
 func (nodeInstance *Node) writeToDisk() {
-    jsonNodeList, err := json.Marshal(nodeInstance.NodeList)
+    key, addresses := nodeInstance.Addresses().snapshot()
+    jsonNodeList, err := json.Marshal(nodeListFile{Version: NODELIST_FORMAT_VERSION, Key: key, Nodes: addresses})
     if err != nil {
         fmt.Println(err.Error())
         return
     }
-    err = ioutil.WriteFile(NODELIST_FILENAME, jsonNodeList, 0644)
+    err = datadirPackage.WriteFileAtomic(filepath.Join(nodeInstance.DataDir, NODELIST_FILENAME), jsonNodeList, 0644)
     if err != nil {
         fmt.Println(err.Error())
         return
     }
 }
 
-//************************ Client Functions ***********************************
+// Upgrade the stored node list in place to NODELIST_FORMAT_VERSION, keeping a
+// backup of the old file. Returns false if there was nothing to do
+func (nodeInstance *Node) MigrateNodeList() (bool, error) {
+    path := filepath.Join(nodeInstance.DataDir, NODELIST_FILENAME)
+    fileData, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
 
-// A client function to notify other nodes when you find a block
-func (nodeInstance *Node) AddBlock(block blockchainPackage.Block) bool {
-    client := http.Client{
-        Timeout: 10 * time.Second,
+    version, err := datadirPackage.FormatVersion(fileData)
+    if err != nil {
+        return false, errors.New(path + " is not a readable node list: " + err.Error())
+    }
+    if version == NODELIST_FORMAT_VERSION {
+        return false, nil
+    }
+    if version > NODELIST_FORMAT_VERSION {
+        return false, &datadirPackage.FormatError{Path: path, Version: version, Want: NODELIST_FORMAT_VERSION}
     }
 
-    rejectList := []NodeAddress{}
-    for _, node := range nodeInstance.NodeList {
-        // jsonify the block
-        jsonBlock := new(bytes.Buffer)
-        err := json.NewEncoder(jsonBlock).Encode(block)
+    diskNodeList := rawNodeListFile{Version: version}
+    if version == 0 {
+        err = json.Unmarshal(fileData, &diskNodeList.Nodes)
+    } else {
+        err = json.Unmarshal(fileData, &diskNodeList)
+    }
+    if err != nil {
+        return false, errors.New(path + " is not a readable node list: " + err.Error())
+    }
+
+    for diskNodeList.Version < NODELIST_FORMAT_VERSION {
+        err = nodeListMigrations[diskNodeList.Version](diskNodeList.Nodes)
         if err != nil {
-            continue
+            return false, errors.New("upgrading " + path + " from version " + strconv.Itoa(diskNodeList.Version) + ": " + err.Error())
         }
+        diskNodeList.Version++
+    }
+
+    // make sure the upgraded list actually reads back before replacing anything
+    jsonNodes, err := json.Marshal(diskNodeList.Nodes)
+    if err != nil {
+        return false, err
+    }
+    nodes := []KnownAddress{}
+    err = json.Unmarshal(jsonNodes, &nodes)
+    if err != nil {
+        return false, errors.New("upgraded node list is not readable: " + err.Error())
+    }
+
+    backupPath, err := datadirPackage.BackupFile(path, version)
+    if err != nil {
+        return false, err
+    }
+    fmt.Println("Backed up " + path + " to " + backupPath)
+
+    nodeInstance.setAddresses("", nodes)
+    nodeInstance.writeToDisk()
+    return true, nil
+}
+
+//************************ Client Functions ***********************************
+
+// how long the server gives a client to send a request and to read the answer
+var SERVER_READ_HEADER_TIMEOUT time.Duration = 5 * time.Second
+var SERVER_READ_TIMEOUT time.Duration = 10 * time.Second
+var SERVER_WRITE_TIMEOUT time.Duration = 30 * time.Second
+var SERVER_IDLE_TIMEOUT time.Duration = 60 * time.Second
+
+// the header every request and response carries so nodes on different networks can't mix
+var CHAIN_ID_HEADER string = "X-Chain-Id"
+
+// send a request to another node, refusing the answer if it comes from a different network
+func (nodeInstance *Node) sendRequest(node NodeAddress, method string, page string, body []byte, session string) (*http.Response, error) {
+    httpAddress := "http://" + addressKey(node) + page
+    var bodyReader io.Reader
+    if body != nil {
+        bodyReader = bytes.NewReader(body)
+    }
+    req, err := http.NewRequest(method, httpAddress, bodyReader)
+    if err != nil {
+        return nil, err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set(CHAIN_ID_HEADER, nodeInstance.GetParams().ChainID)
+    if session != "" {
+        req.Header.Set(SESSION_HEADER, session)
+    }
+
+    resp, err := nodeInstance.transport().Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.Header.Get(CHAIN_ID_HEADER) != nodeInstance.GetParams().ChainID {
+        resp.Body.Close()
+        return nil, errors.New(httpAddress + " is not on the " + nodeInstance.GetParams().Name + " network")
+    }
+    return resp, nil
+}
 
-        httpAddress := "http://" + node.IpAddr + ":" + strconv.Itoa(node.Port) + "/add-block"
-        resp, err := client.Post(httpAddress, "application/json", jsonBlock)
+// Send a request to a peer, over our open session with it if there is one.
+// Otherwise it goes over HTTP, shaking hands first if we haven't yet. If the
+// peer has forgotten our session we shake hands again and retry once
+func (nodeInstance *Node) peerRequest(node NodeAddress, method string, page string, body io.Reader) (*http.Response, error) {
+    var bodyData []byte
+    if body != nil {
+        var err error
+        bodyData, err = ioutil.ReadAll(body)
         if err != nil {
-            continue
+            return nil, err
         }
-        if resp.StatusCode == 406 {
-            // another node rejected our block
-            rejectList = append(rejectList, node)
+    }
+
+    if s := nodeInstance.liveSession(node); s != nil {
+        resp, err := s.roundTrip(page, bodyData)
+        if err == nil {
+            return resp, nil
         }
+        // the session dropped, HTTP may still get through
     }
 
-    // make sure we haven't had our block rejected
-    if len(rejectList) > (len(nodeInstance.NodeList) / 2) {
-        // more than half of other nodes rejected our block, return false
-        return false
-    } else {
-        return true
+    for attempt := 0; attempt < 2; attempt++ {
+        peer, err := nodeInstance.outboundPeer(node)
+        if err != nil {
+            return nil, err
+        }
+        resp, err := nodeInstance.sendRequest(node, method, page, bodyData, peer.session)
+        if err != nil {
+            return nil, err
+        }
+        if resp.StatusCode != http.StatusPreconditionRequired {
+            return resp, nil
+        }
+        resp.Body.Close()
+        nodeInstance.forgetPeer(node)
     }
+    return nil, errors.New(addressKey(node) + " keeps asking us to shake hands")
+}
+
+func (nodeInstance *Node) peerGet(node NodeAddress, page string) (*http.Response, error) {
+    return nodeInstance.peerRequest(node, "GET", page, nil)
+}
+
+func (nodeInstance *Node) peerPost(node NodeAddress, page string, body io.Reader) (*http.Response, error) {
+    return nodeInstance.peerRequest(node, "POST", page, body)
 }
 
 // A client function to get a list of other nodes to mine with
 func (nodeInstance *Node) GetNodeList() {
-    client := http.Client{
-        Timeout: 10 * time.Second,
-    }
-
     // loop through all known nodes and get their node lists
     for _, node := range nodeInstance.NodeList {
-        httpAddress := "http://" + node.IpAddr + ":" + strconv.Itoa(node.Port) + "/get-nodes"
-        resp, err := client.Get(httpAddress)
+        resp, err := nodeInstance.peerGet(node, "/get-nodes")
         if err != nil {
             continue
         }
@@ -217,25 +545,28 @@ func (nodeInstance *Node) GetNodeList() {
         // convert response body to a slice of NodeAddresses
         var nodeAddresses []NodeAddress
         err = json.NewDecoder(resp.Body).Decode(&nodeAddresses)
+        resp.Body.Close()
         if err != nil { //we got an error, so the node list was not formatted well
             continue
         }
+        if len(nodeAddresses) > MAX_GET_NODES {
+            nodeAddresses = nodeAddresses[:MAX_GET_NODES]
+        }
 
+        // they go in the address manager untested, filed under who told us about them
+        heard := []NodeAddress{}
         for _, nodeAddress := range nodeAddresses {
-              nodeInstance.NodeList = append(nodeInstance.NodeList, nodeAddress)
+            if nodeInstance.usableNode(nodeAddress) {
+                heard = append(heard, nodeAddress)
+            }
         }
-        // remove duplicates from the node list
-        nodeInstance.NodeList = removeDuplicateNodes(nodeInstance.NodeList)
+        nodeInstance.Addresses().Add(heard, node.IpAddr)
     }
     return
 }
 
 // A client function to let other nodes know a new node has joined
 func (nodeInstance *Node) RegisterNode () {
-    client := http.Client{
-        Timeout: 10 * time.Second,
-    }
-
     for _, node := range nodeInstance.NodeList {
         jsonNodeAddr := new(bytes.Buffer)
         err := json.NewEncoder(jsonNodeAddr).Encode(nodeInstance.MyAddress)
@@ -243,41 +574,35 @@ func (nodeInstance *Node) RegisterNode () {
             return
         }
 
-        httpAddress := "http://" + node.IpAddr + ":" + strconv.Itoa(node.Port) + "/register-node"
-        client.Post(httpAddress, "application/json", jsonNodeAddr)
+        resp, err := nodeInstance.peerPost(node, "/register-node", jsonNodeAddr)
+        if err == nil {
+            // we don't need the answer, but the connection isn't let go until it's closed
+            resp.Body.Close()
+        }
     }
 }
 
-// A client function to get the status of all known nodes
+// A client function to get the status of all nodes in the list. Asking for
+// their heights tells us both that they're up and whether they're ahead of us
 func (nodeInstance *Node) GetNodeStatus () {
-    client := http.Client{
-        Timeout: 10 * time.Second,
-    }
-
     for i, node := range nodeInstance.NodeList {
-        httpAddress := "http://" + node.IpAddr + ":" + strconv.Itoa(node.Port) + "/node-status"
-        resp, err := client.Get(httpAddress)
+        _, err := nodeInstance.fetchHeight(node)
         if err != nil {
+            nodeInstance.Addresses().Attempt(node)
             continue
         }
-        if resp.StatusCode == 200 {
-            nodeInstance.NodeList[i].LastSeen = time.Now().Unix()
-        }
+        nodeInstance.NodeList[i].LastSeen = nodeInstance.now().Unix()
+        nodeInstance.Addresses().Good(node)
     }
 }
 
 // A client function to get the blockchain height
 func (nodeInstance *Node) GetHeight() int {
-    client := http.Client{
-        Timeout: 10 * time.Second,
-    }
-
     list := []int{}
 
-    for _, node := range nodeInstance.NodeList {
+    for _, node := range nodeInstance.snapshotNodes() {
         var height int
-        httpAddress := "http://" + node.IpAddr + ":" + strconv.Itoa(node.Port) + "/get-height"
-        resp, err := client.Get(httpAddress)
+        resp, err := nodeInstance.peerGet(node, "/get-height")
         if err != nil {
             list = append(list, -1)
         } else {
@@ -286,6 +611,7 @@ func (nodeInstance *Node) GetHeight() int {
                 list = append(list, -2)
             } else {
                 list = append(list, height)
+                nodeInstance.updatePeerTip(node, height)
             }
         }
     }
@@ -302,25 +628,20 @@ func (nodeInstance *Node) GetHeight() int {
 
 // A client function for requesting a block from another node
 func (nodeInstance *Node) GetBlock(index int) blockchainPackage.Block {
-    client := http.Client{
-        Timeout: 10 * time.Second,
-    }
-
     list := []blockchainPackage.Block{}
 
     errBlock := blockchainPackage.Block {
         Index: -2,
     }
 
-    for _, node := range nodeInstance.NodeList {
+    for _, node := range nodeInstance.snapshotNodes() {
         jsonIndex := new(bytes.Buffer)
         err := json.NewEncoder(jsonIndex).Encode(index)
         if err != nil {
             return errBlock
         }
         var block blockchainPackage.Block
-        httpAddress := "http://" + node.IpAddr + ":" + strconv.Itoa(node.Port) + "/get-block"
-        resp, err := client.Post(httpAddress, "application/json", jsonIndex)
+        resp, err := nodeInstance.peerPost(node, "/get-block", jsonIndex)
         if err != nil {
             // this node didn't work, try another
             continue
@@ -337,6 +658,11 @@ func (nodeInstance *Node) GetBlock(index int) blockchainPackage.Block {
         }
     }
 
+    // no node answered, let the caller know with an error block
+    if len(list) == 0 {
+        return errBlock
+    }
+
     // all blocks might not be the same, so we choose the one that appears most often
     popularBlock := list[0]
     maxCount := 0
@@ -368,24 +694,32 @@ func (nodeInstance *Node) addRemoteBlock(w http.ResponseWriter, req *http.Reques
     var proposedBlock blockchainPackage.Block
     err := json.NewDecoder(req.Body).Decode(&proposedBlock)
     if err != nil { //we got an error, so the block was not formatted properly
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable block")
         http.Error(w, err.Error(), 400)
+        return
     }
 
-    nodeInstance.AddBlockChannel <- proposedBlock
-
-    result := <-nodeInstance.BlockValidateChannel
-    if result {
+    err = nodeInstance.submitBlock(proposedBlock)
+    if err == nil {
+        if peer, ok := nodeInstance.sessionPeer(req); ok {
+            nodeInstance.markUseful(peer.Address)
+        }
         w.WriteHeader(http.StatusOK)
     } else {
+        // only a block that broke the rules counts against the peer
+        if _, invalid := err.(*blockchainPackage.InvalidBlockError); invalid {
+            nodeInstance.misbehavingRequest(req, SCORE_INVALID_BLOCK, "invalid block " + strconv.Itoa(proposedBlock.Index))
+        }
         w.WriteHeader(http.StatusNotAcceptable)
     }
 }
 
-// a server function to send all of the nodes that this node is aware of
+// a server function to send a random sample of the nodes that this node is aware
+// of, so nobody can read our whole address table or tell which nodes we talk to
 func (nodeInstance *Node) sendNodeList(w http.ResponseWriter, req *http.Request) {
     // encode our list of nodes to json
     jsonNodeList := new(bytes.Buffer)
-    err := json.NewEncoder(jsonNodeList).Encode(nodeInstance.NodeList)
+    err := json.NewEncoder(jsonNodeList).Encode(nodeInstance.Addresses().Sample(MAX_GET_NODES))
     if err != nil { //we got an error, so the block was not formatted properly
         http.Error(w, err.Error(), 400)
     }
@@ -402,14 +736,19 @@ func (nodeInstance *Node) addNode(w http.ResponseWriter, req *http.Request) {
     var newAddress NodeAddress
     err := json.NewDecoder(req.Body).Decode(&newAddress)
     if err != nil { //we got an error, so the node address was not formatted well
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable node address")
+        http.Error(w, "Please provide a node address", 400)
+        return
+    }
+    // there's no point passing on addresses nobody should talk to
+    if !nodeInstance.usableNode(newAddress) {
         return
     }
 
-    newAddress.LastSeen = time.Now().Unix()
-    nodeInstance.NodeList = append(nodeInstance.NodeList, newAddress)
-
-    // remove duplicates from the node list
-    nodeInstance.NodeList = removeDuplicateNodes(nodeInstance.NodeList)
+    // it goes in untested, we only know it can reach us, not that we can reach it
+    newAddress.LastSeen = nodeInstance.now().Unix()
+    remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+    nodeInstance.Addresses().Add([]NodeAddress{newAddress}, remoteIP)
 }
 
 // a server function to let other nodes know this node is still online
@@ -419,11 +758,7 @@ func (nodeInstance *Node) nodeStatus(w http.ResponseWriter, req *http.Request) {
 
 // a server function to respond with the blockchain height
 func (nodeInstance *Node) sendHeight(w http.ResponseWriter, req *http.Request) {
-    // send an int to blockchain requesting height
-    nodeInstance.HeightChannel <- 0
-
-    // now wait for response
-    height := <-nodeInstance.HeightChannel
+    height := nodeInstance.localHeight()
     jsonHeight := new(bytes.Buffer)
     err := json.NewEncoder(jsonHeight).Encode(height)
     if err != nil { //we got an error, so the block was not formatted properly
@@ -444,6 +779,7 @@ func (nodeInstance *Node) sendBlock(w http.ResponseWriter, req *http.Request) {
     var blockIndex int
     err := json.NewDecoder(req.Body).Decode(&blockIndex)
     if err != nil {
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable block index")
         http.Error(w, "Please provide a block index as an integer", 400)
         return
     }
@@ -461,13 +797,262 @@ func (nodeInstance *Node) sendBlock(w http.ResponseWriter, req *http.Request) {
     w.Write(jsonBlock.Bytes())
 }
 
-// start the http server and bind server functions to "pages"
-func (nodeInstance *Node) Server() {
-    http.HandleFunc("/add-block", nodeInstance.addRemoteBlock)
-    http.HandleFunc("/get-nodes", nodeInstance.sendNodeList)
-    http.HandleFunc("/register-node", nodeInstance.addNode)
-    http.HandleFunc("/node-status", nodeInstance.nodeStatus)
-    http.HandleFunc("/get-height", nodeInstance.sendHeight)
-    http.HandleFunc("/get-block", nodeInstance.sendBlock)
-    log.Fatal(http.ListenAndServe(":8080", nil))
+// a helper to ask the blockchain for an index entry and write it out
+func (nodeInstance *Node) sendIndexEntry(w http.ResponseWriter, query blockchainPackage.IndexQuery, result func(blockchainPackage.IndexEntry) interface{}) {
+    entry := nodeInstance.lookup(query)
+    if !entry.Found {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    jsonEntry := new(bytes.Buffer)
+    err := json.NewEncoder(jsonEntry).Encode(result(entry))
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonEntry.Bytes())
+}
+
+// a server function to respond with the block that has the requested hash
+func (nodeInstance *Node) sendBlockByHash(w http.ResponseWriter, req *http.Request) {
+    if req.Body == nil {
+        http.Error(w, "Please provide a block hash", 400)
+        return
+    }
+
+    var blockHash string
+    err := json.NewDecoder(req.Body).Decode(&blockHash)
+    if err != nil {
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable block hash")
+        http.Error(w, "Please provide a block hash as a string", 400)
+        return
+    }
+
+    nodeInstance.sendIndexEntry(w, blockchainPackage.IndexQuery{Hash: blockHash},
+        func(entry blockchainPackage.IndexEntry) interface{} { return entry.Block })
+}
+
+// a server function to respond with the hash of the block at the requested height
+func (nodeInstance *Node) sendBlockHash(w http.ResponseWriter, req *http.Request) {
+    if req.Body == nil {
+        http.Error(w, "Please provide a block index", 400)
+        return
+    }
+
+    var blockIndex int
+    err := json.NewDecoder(req.Body).Decode(&blockIndex)
+    if err != nil {
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable block index")
+        http.Error(w, "Please provide a block index as an integer", 400)
+        return
+    }
+
+    nodeInstance.sendIndexEntry(w, blockchainPackage.IndexQuery{Height: blockIndex},
+        func(entry blockchainPackage.IndexEntry) interface{} { return entry.Hash })
+}
+
+// a server function to respond with the location of the requested transaction
+func (nodeInstance *Node) sendTxLocation(w http.ResponseWriter, req *http.Request) {
+    if req.Body == nil {
+        http.Error(w, "Please provide a transaction ID", 400)
+        return
+    }
+
+    var txID string
+    err := json.NewDecoder(req.Body).Decode(&txID)
+    if err != nil || txID == "" {
+        nodeInstance.misbehavingRequest(req, SCORE_MALFORMED_REQUEST, "unreadable transaction ID")
+        http.Error(w, "Please provide a transaction ID as a string", 400)
+        return
+    }
+
+    nodeInstance.sendIndexEntry(w, blockchainPackage.IndexQuery{TxID: txID},
+        func(entry blockchainPackage.IndexEntry) interface{} { return entry.Tx })
+}
+
+// an admin server function to mine blocks right away and announce them to other nodes
+func (nodeInstance *Node) generateBlocks(w http.ResponseWriter, req *http.Request) {
+    if req.Body == nil {
+        http.Error(w, "Please provide the number of blocks and an address", 400)
+        return
+    }
+
+    var request blockchainPackage.GenerateRequest
+    err := json.NewDecoder(req.Body).Decode(&request)
+    if err != nil || request.Blocks <= 0 {
+        http.Error(w, "Please provide a positive number of blocks", 400)
+        return
+    }
+    if request.Address != "" {
+        err = walletPackage.ValidateAddress(request.Address)
+        if err != nil {
+            http.Error(w, err.Error(), 400)
+            return
+        }
+    }
+
+    nodeInstance.GenerateChannel <- request
+
+    // now wait for response
+    blocks := <-nodeInstance.GeneratedChannel
+    // announcing the newest block is enough, peers missing the ones before it fetch them too
+    if len(blocks) > 0 {
+        nodeInstance.AnnounceBlock(blocks[len(blocks) - 1])
+    }
+
+    jsonBlocks := new(bytes.Buffer)
+    err = json.NewEncoder(jsonBlocks).Encode(blocks)
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonBlocks.Bytes())
+}
+
+// an admin server function to report on or control the miner. The action is the last part of the page
+func (nodeInstance *Node) controlMiner(w http.ResponseWriter, req *http.Request) {
+    if nodeInstance.Miner == nil {
+        http.Error(w, "Mining is disabled on this node", http.StatusServiceUnavailable)
+        return
+    }
+
+    switch req.URL.Path {
+    case "/miner/status":
+    case "/miner/start":
+        nodeInstance.Miner.Start()
+    case "/miner/stop":
+        nodeInstance.Miner.Stop()
+    case "/miner/threads":
+        var threads int
+        if req.Body == nil || json.NewDecoder(req.Body).Decode(&threads) != nil {
+            http.Error(w, "Please provide the number of threads as an integer", 400)
+            return
+        }
+        err := nodeInstance.Miner.SetThreads(threads)
+        if err != nil {
+            http.Error(w, err.Error(), 400)
+            return
+        }
+    default:
+        http.NotFound(w, req)
+        return
+    }
+
+    // every action answers with the miner's status afterwards
+    jsonStatus := new(bytes.Buffer)
+    err := json.NewEncoder(jsonStatus).Encode(nodeInstance.Miner.Status())
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonStatus.Bytes())
+}
+
+// an admin server function to list every address we know, tried ones first
+func (nodeInstance *Node) sendAddresses(w http.ResponseWriter, req *http.Request) {
+    jsonAddresses := new(bytes.Buffer)
+    err := json.NewEncoder(jsonAddresses).Encode(nodeInstance.Addresses().Addresses())
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    w.Write(jsonAddresses.Bytes())
+}
+
+// wrap a server function so it only answers nodes on our network
+func (nodeInstance *Node) sameNetwork(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        w.Header().Set(CHAIN_ID_HEADER, nodeInstance.GetParams().ChainID)
+        if req.Header.Get(CHAIN_ID_HEADER) != nodeInstance.GetParams().ChainID {
+            http.Error(w, "This node is on the " + nodeInstance.GetParams().Name + " network", http.StatusForbidden)
+            return
+        }
+        handler(w, req)
+    }
+}
+
+// the server functions peers can reach after shaking hands, over HTTP or a session
+func (nodeInstance *Node) peerPages() map[string]http.HandlerFunc {
+    return map[string]http.HandlerFunc{
+        "/add-block": nodeInstance.addRemoteBlock,
+        "/inv": nodeInstance.receiveInventory,
+        "/get-nodes": nodeInstance.sendNodeList,
+        "/register-node": nodeInstance.addNode,
+        "/node-status": nodeInstance.nodeStatus,
+        "/get-height": nodeInstance.sendHeight,
+        "/get-block": nodeInstance.sendBlock,
+        "/get-block-by-hash": nodeInstance.sendBlockByHash,
+        "/get-block-hash": nodeInstance.sendBlockHash,
+        "/get-tx-location": nodeInstance.sendTxLocation,
+    }
+}
+
+// start the http servers and bind server functions to "pages". Peers are served on
+// every ListenAddresses entry and the admin functions on every AdminListenAddresses
+// entry. Returns once everything is listening, or with an error if an address can't be used
+func (nodeInstance *Node) Server() error {
+    peerMux := http.NewServeMux()
+    peerMux.HandleFunc("/handshake", nodeInstance.sameNetwork(nodeInstance.notBanned(nodeInstance.handshake)))
+    peerMux.HandleFunc("/session", nodeInstance.sameNetwork(nodeInstance.notBanned(nodeInstance.upgradeSession)))
+    // everything else is only for peers that have shaken hands
+    for page, handler := range nodeInstance.peerPages() {
+        peerMux.HandleFunc(page, nodeInstance.sameNetwork(nodeInstance.notBanned(nodeInstance.fromPeer(handler))))
+    }
+
+    adminMux := http.NewServeMux()
+    adminMux.HandleFunc("/miner/", nodeInstance.controlMiner)
+    adminMux.HandleFunc("/peers", nodeInstance.sendPeers)
+    adminMux.HandleFunc("/addresses", nodeInstance.sendAddresses)
+    adminMux.HandleFunc("/bans", nodeInstance.controlBans)
+    adminMux.HandleFunc("/bans/", nodeInstance.controlBans)
+    // blocks can only be made on demand where the difficulty doesn't matter
+    if nodeInstance.GetParams().DeterministicMining {
+        adminMux.HandleFunc("/generate", nodeInstance.generateBlocks)
+    }
+
+    listenAddresses := nodeInstance.ListenAddresses
+    if len(listenAddresses) == 0 {
+        listenAddresses = []string{":" + strconv.Itoa(nodeInstance.MyAddress.Port)}
+    }
+
+    // open every listener before going on so a bad address is reported right away
+    transport := nodeInstance.transport()
+    for i, addresses := range [][]string{listenAddresses, nodeInstance.AdminListenAddresses} {
+        handler := http.Handler(peerMux)
+        if i == 1 {
+            handler = adminMux
+        }
+        for _, address := range addresses {
+            server, err := transport.Listen(address, handler)
+            if err != nil {
+                for _, opened := range nodeInstance.servers {
+                    opened.Shutdown(context.Background())
+                }
+                nodeInstance.servers = nil
+                return err
+            }
+            nodeInstance.servers = append(nodeInstance.servers, server)
+            fmt.Println("Listening on " + server.Addr())
+        }
+    }
+    return nil
+}
+
+// Stop accepting requests, hang up every peer session, wait for the requests in
+// flight to finish (or for ctx to expire) and save the node list
+func (nodeInstance *Node) Shutdown(ctx context.Context) {
+    // the servers don't keep track of connections that became sessions
+    nodeInstance.closeSessions()
+    for _, server := range nodeInstance.servers {
+        err := server.Shutdown(ctx)
+        if err != nil {
+            fmt.Println(err.Error())
+        }
+    }
+    nodeInstance.servers = nil
+
+    // wait for any sync that's still running before writing the list out
+    nodeInstance.NodeListMutex.Lock()
+    nodeInstance.writeToDisk()
+    nodeInstance.NodeListMutex.Unlock()
 }
@@ -0,0 +1,63 @@
+package nodePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestSameNetwork(t *testing.T) {
+    tests := []struct {
+        name string
+        chainID string
+        wantStatus int
+    }{
+        {"our network", "go_blockchain-regtest", http.StatusOK},
+        {"another network", "go_blockchain-main", http.StatusForbidden},
+        {"no network", "", http.StatusForbidden},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeInstance, _ := newTestNode(t)
+            handler := nodeInstance.sameNetwork(func(w http.ResponseWriter, req *http.Request) {})
+
+            req := httptest.NewRequest("GET", "/get-height", nil)
+            if test.chainID != "" {
+                req.Header.Set(CHAIN_ID_HEADER, test.chainID)
+            }
+            w := httptest.NewRecorder()
+            handler(w, req)
+            if w.Code != test.wantStatus {
+                t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+            }
+            // the answer says which network it's from either way, so our side can refuse it too
+            if got := w.Header().Get(CHAIN_ID_HEADER); got != "go_blockchain-regtest" {
+                t.Errorf("the answer carries chain ID %q", got)
+            }
+        })
+    }
+}
+
+func TestShutdownSavesTheNodeList(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    nodeInstance.ListenAddresses = []string{"127.0.0.1:0"}
+    err := nodeInstance.Server()
+    if err != nil {
+        t.Fatal(err)
+    }
+    known := NodeAddress{IpAddr: "10.0.0.9", Port: 28080}
+    nodeInstance.Addresses().Good(known)
+
+    nodeInstance.Shutdown(context.Background())
+
+    restarted, _ := newTestNode(t)
+    restarted.DataDir = nodeInstance.DataDir
+    err = restarted.ReadFromDisk()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(restarted.NodeList) != 1 || addressKey(restarted.NodeList[0]) != addressKey(known) {
+        t.Errorf("read back %v, want [%v]", restarted.NodeList, known)
+    }
+}
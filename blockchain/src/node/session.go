@@ -0,0 +1,657 @@
+package nodePackage
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// the Upgrade header value that turns a /session request into a peer session
+var SESSION_PROTOCOL string = "go_blockchain-session"
+
+// send a ping when the other side has been quiet this long, and hang up when it's been quiet three times as long
+var PING_INTERVAL time.Duration = 20 * time.Second
+var SESSION_IDLE_TIMEOUT time.Duration = 3 * PING_INTERVAL
+
+// how long to wait for the answer to a request on a session
+var SESSION_CALL_TIMEOUT time.Duration = 30 * time.Second
+
+// the largest frame either side will accept, and the largest before the other
+// side has shaken hands, which is all a handshake needs
+var MAX_FRAME_SIZE int = 32 * 1024 * 1024
+var MAX_HANDSHAKE_FRAME_SIZE int = 64 * 1024
+
+// an inbound session is hung up on if it hasn't shaken hands this long after opening
+var SESSION_HANDSHAKE_TIMEOUT time.Duration = 10 * time.Second
+
+// how many requests from one session are served at once. Reading stops until one finishes
+var MAX_SESSION_REQUESTS int = 16
+
+// wait this long before reconnecting a dropped session, doubling up to the maximum on each failure
+var RECONNECT_MIN_DELAY int64 = 5
+var RECONNECT_MAX_DELAY int64 = 5 * 60
+
+// the kinds of message sent on a session
+var MSG_REQUEST string = "request"
+var MSG_REPLY string = "reply"
+var MSG_PING string = "ping"
+var MSG_PONG string = "pong"
+
+// Define a single frame on a session. Requests name one of the peer pages and
+// carry the same body an HTTP request to that page would; replies carry the
+// status and body of the answer. The first request on a session must be /handshake
+type Message struct {
+    ID uint64
+    Kind string
+    Page string `json:",omitempty"`
+    Status int `json:",omitempty"`
+    Body []byte `json:",omitempty"`
+}
+
+// define one end of a long-lived connection to a peer
+type session struct {
+    node *Node
+    conn net.Conn
+    reader *bufio.Reader
+    inbound bool
+    // set once the handshake is done, when handshaken is closed
+    peer *Peer
+    handshaken chan bool
+    writeMutex sync.Mutex
+    mutex sync.Mutex
+    nextID uint64
+    pending map[uint64]chan Message
+    lastReceived int64
+    // holds a value for each request being served
+    requests chan bool
+    closed chan bool
+    closeOnce sync.Once
+}
+
+// when to try connecting to a peer again
+type reconnectState struct {
+    next int64
+    delay int64
+}
+
+// the context key stream requests carry their peer under
+type peerContextKey struct{}
+
+func makeSession(node *Node, conn net.Conn, reader *bufio.Reader, inbound bool) *session {
+    return &session{
+        node: node,
+        conn: conn,
+        reader: reader,
+        inbound: inbound,
+        pending: map[uint64]chan Message{},
+        lastReceived: time.Now().Unix(),
+        handshaken: make(chan bool),
+        requests: make(chan bool, MAX_SESSION_REQUESTS),
+        closed: make(chan bool),
+    }
+}
+
+// the address the other side connected from
+func (s *session) remoteIP() string {
+    remoteIP, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+    return remoteIP
+}
+
+// tie the session to the peer it shook hands with. Requests are only served after this
+func (s *session) setPeer(peer *Peer) {
+    s.node.PeerMutex.Lock()
+    peer.stream = s
+    s.peer = peer
+    s.node.PeerMutex.Unlock()
+    close(s.handshaken)
+}
+
+// write a frame: a 4 byte length, then the message as JSON
+func (s *session) send(msg Message) error {
+    jsonMessage, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    frame := make([]byte, 4 + len(jsonMessage))
+    binary.BigEndian.PutUint32(frame, uint32(len(jsonMessage)))
+    copy(frame[4:], jsonMessage)
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+    s.conn.SetWriteDeadline(time.Now().Add(SESSION_CALL_TIMEOUT))
+    _, err = s.conn.Write(frame)
+    if err != nil {
+        s.close()
+    }
+    return err
+}
+
+// read the next frame
+func (s *session) receive() (Message, error) {
+    var msg Message
+    s.conn.SetReadDeadline(time.Now().Add(SESSION_IDLE_TIMEOUT))
+    header := make([]byte, 4)
+    _, err := io.ReadFull(s.reader, header)
+    if err != nil {
+        return msg, err
+    }
+    length := binary.BigEndian.Uint32(header)
+    maxSize := MAX_HANDSHAKE_FRAME_SIZE
+    select {
+    case <-s.handshaken:
+        maxSize = MAX_FRAME_SIZE
+    default:
+    }
+    if int(length) > maxSize {
+        return msg, errors.New("frame of " + strconv.Itoa(int(length)) + " bytes is too big")
+    }
+    jsonMessage := make([]byte, length)
+    _, err = io.ReadFull(s.reader, jsonMessage)
+    if err != nil {
+        return msg, err
+    }
+    err = json.Unmarshal(jsonMessage, &msg)
+    return msg, err
+}
+
+// Send a request for page and wait for the reply
+func (s *session) call(page string, body []byte) (Message, error) {
+    s.mutex.Lock()
+    s.nextID++
+    id := s.nextID
+    replyChannel := make(chan Message, 1)
+    s.pending[id] = replyChannel
+    s.mutex.Unlock()
+    defer func() {
+        s.mutex.Lock()
+        delete(s.pending, id)
+        s.mutex.Unlock()
+    }()
+
+    err := s.send(Message{ID: id, Kind: MSG_REQUEST, Page: page, Body: body})
+    if err != nil {
+        return Message{}, err
+    }
+    timer := time.NewTimer(SESSION_CALL_TIMEOUT)
+    defer timer.Stop()
+    select {
+    case reply := <-replyChannel:
+        return reply, nil
+    case <-s.closed:
+        return Message{}, errors.New("the session with " + s.conn.RemoteAddr().String() + " closed")
+    case <-timer.C:
+        return Message{}, errors.New(s.conn.RemoteAddr().String() + " did not answer " + page + " in time")
+    }
+}
+
+// Send a request for page and hand back the reply as if it came over HTTP, so
+// callers don't need to care how they reached the peer
+func (s *session) roundTrip(page string, body []byte) (*http.Response, error) {
+    reply, err := s.call(page, body)
+    if err != nil {
+        return nil, err
+    }
+    return &http.Response{
+        StatusCode: reply.Status,
+        Status: strconv.Itoa(reply.Status) + " " + http.StatusText(reply.Status),
+        Header: http.Header{},
+        Body: ioutil.NopCloser(bytes.NewReader(reply.Body)),
+    }, nil
+}
+
+// read frames until the connection fails or is closed
+func (s *session) readLoop() {
+    defer s.close()
+    for {
+        msg, err := s.receive()
+        if err != nil {
+            return
+        }
+        atomic.StoreInt64(&s.lastReceived, time.Now().Unix())
+
+        switch msg.Kind {
+        case MSG_PING:
+            s.send(Message{ID: msg.ID, Kind: MSG_PONG})
+        case MSG_PONG:
+        case MSG_REPLY:
+            s.mutex.Lock()
+            replyChannel, ok := s.pending[msg.ID]
+            s.mutex.Unlock()
+            if ok {
+                replyChannel <- msg
+            }
+        case MSG_REQUEST:
+            handshaken := false
+            select {
+            case <-s.handshaken:
+                handshaken = true
+            default:
+            }
+            if !handshaken && s.inbound {
+                // the handshake has to finish before anything else is read
+                s.serveHandshake(msg)
+                continue
+            }
+            // wait for a free slot, a peer sending requests faster than we answer them just waits
+            select {
+            case s.requests <- true:
+            case <-s.closed:
+                return
+            }
+            go func(msg Message) {
+                defer func() { <-s.requests }()
+                // on our own sessions the answer to our handshake may not have been dealt with yet
+                select {
+                case <-s.handshaken:
+                    s.serveRequest(msg)
+                case <-s.closed:
+                }
+            }(msg)
+        }
+    }
+}
+
+// ping the other side whenever it goes quiet, the read deadline hangs up on it if it stays quiet
+func (s *session) keepalive() {
+    ticker := time.NewTicker(PING_INTERVAL)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.closed:
+            return
+        case <-ticker.C:
+            if time.Now().Unix() - atomic.LoadInt64(&s.lastReceived) >= int64(PING_INTERVAL / time.Second) {
+                s.send(Message{Kind: MSG_PING})
+            }
+        }
+    }
+}
+
+// Hang up and fail any requests still waiting for a reply
+func (s *session) close() {
+    s.closeOnce.Do(func() {
+        close(s.closed)
+        s.conn.Close()
+        s.node.sessionClosed(s)
+    })
+}
+
+// answer the first request on an inbound session, which must be a handshake
+func (s *session) serveHandshake(msg Message) {
+    if msg.Page != "/handshake" {
+        s.send(Message{ID: msg.ID, Kind: MSG_REPLY, Status: http.StatusPreconditionRequired, Body: []byte("Please shake hands first")})
+        return
+    }
+    var theirs Handshake
+    remoteIP := s.remoteIP()
+    err := json.Unmarshal(msg.Body, &theirs)
+    if err != nil {
+        s.node.misbehaving(remoteIP, SCORE_MALFORMED_REQUEST, "unreadable handshake on a session")
+        s.send(Message{ID: msg.ID, Kind: MSG_REPLY, Status: 400, Body: []byte("Please provide a handshake")})
+        return
+    }
+    ours, peer, err := s.node.acceptHandshake(theirs, remoteIP, s)
+    if err != nil {
+        status := 400
+        if err == errTooManyPeers {
+            status = http.StatusServiceUnavailable
+        }
+        s.send(Message{ID: msg.ID, Kind: MSG_REPLY, Status: status, Body: []byte(err.Error())})
+        s.close()
+        return
+    }
+    jsonHandshake, err := json.Marshal(ours)
+    if err != nil {
+        s.close()
+        return
+    }
+    s.setPeer(peer)
+    s.send(Message{ID: msg.ID, Kind: MSG_REPLY, Status: http.StatusOK, Body: jsonHandshake})
+}
+
+// answer a request by running the same server function an HTTP request to the page would
+func (s *session) serveRequest(msg Message) {
+    reply := Message{ID: msg.ID, Kind: MSG_REPLY}
+    // a ban closes the peer's sessions, this catches requests already on the way
+    if s.node.IsBanned(s.remoteIP()) {
+        s.close()
+        return
+    }
+    handler, ok := s.node.peerPages()[msg.Page]
+    if !ok {
+        reply.Status = http.StatusNotFound
+        s.send(reply)
+        return
+    }
+
+    method := "GET"
+    var body io.Reader
+    if msg.Body != nil {
+        method = "POST"
+        body = bytes.NewReader(msg.Body)
+    }
+    req, err := http.NewRequest(method, msg.Page, body)
+    if err != nil {
+        reply.Status = 400
+        s.send(reply)
+        return
+    }
+    req.RemoteAddr = s.conn.RemoteAddr().String()
+    req = req.WithContext(context.WithValue(req.Context(), peerContextKey{}, *s.peer))
+
+    s.node.PeerMutex.Lock()
+    s.peer.LastSeen = time.Now().Unix()
+    s.node.PeerMutex.Unlock()
+
+    w := &bufferedResponse{header: http.Header{}}
+    handler(w, req)
+    reply.Status = w.status
+    if reply.Status == 0 {
+        reply.Status = http.StatusOK
+    }
+    reply.Body = w.body.Bytes()
+    s.send(reply)
+}
+
+// collects what a server function writes so it can be sent back on a session
+type bufferedResponse struct {
+    header http.Header
+    status int
+    body bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+    return w.header
+}
+
+func (w *bufferedResponse) Write(data []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    return w.body.Write(data)
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+}
+
+// a server function that turns the request's connection into a peer session
+func (nodeInstance *Node) upgradeSession(w http.ResponseWriter, req *http.Request) {
+    if req.Header.Get("Upgrade") != SESSION_PROTOCOL {
+        http.Error(w, "Please upgrade to " + SESSION_PROTOCOL, http.StatusUpgradeRequired)
+        return
+    }
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "Sessions are not supported here", 500)
+        return
+    }
+    remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+    nodeInstance.PeerMutex.Lock()
+    room := nodeInstance.roomForSession(remoteIP)
+    nodeInstance.PeerMutex.Unlock()
+    if !room {
+        http.Error(w, errTooManyPeers.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    conn, buffered, err := hijacker.Hijack()
+    if err != nil {
+        return
+    }
+    // the server's request deadlines don't apply to a session
+    conn.SetDeadline(time.Time{})
+    buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+                         "Upgrade: " + SESSION_PROTOCOL + "\r\n" +
+                         "Connection: Upgrade\r\n" +
+                         CHAIN_ID_HEADER + ": " + nodeInstance.GetParams().ChainID + "\r\n\r\n")
+    err = buffered.Flush()
+    if err != nil {
+        conn.Close()
+        return
+    }
+
+    s := makeSession(nodeInstance, conn, buffered.Reader, true)
+    if !nodeInstance.trackSession(s) {
+        conn.Close()
+        return
+    }
+    go s.keepalive()
+    go s.expectHandshake()
+    s.readLoop()
+}
+
+// Open a session with a peer and shake hands on it. From then on requests to the
+// peer go over the session instead of new HTTP requests
+func (nodeInstance *Node) connectSession(node NodeAddress) (*Peer, error) {
+    if nodeInstance.IsBanned(node.IpAddr) {
+        return nil, errors.New(addressKey(node) + " is banned")
+    }
+    transport, ok := nodeInstance.transport().(StreamTransport)
+    if !ok {
+        return nil, errors.New("this transport can't carry sessions")
+    }
+    conn, err := transport.Dial(addressKey(node), CLIENT_TIMEOUT)
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequest("GET", "http://" + addressKey(node) + "/session", nil)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Upgrade", SESSION_PROTOCOL)
+    req.Header.Set(CHAIN_ID_HEADER, nodeInstance.GetParams().ChainID)
+    conn.SetDeadline(time.Now().Add(CLIENT_TIMEOUT))
+    err = req.Write(conn)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get(CHAIN_ID_HEADER) != nodeInstance.GetParams().ChainID {
+        conn.Close()
+        return nil, errors.New(addressKey(node) + " did not open a session: " + resp.Status)
+    }
+    conn.SetDeadline(time.Time{})
+
+    s := makeSession(nodeInstance, conn, reader, false)
+    if !nodeInstance.trackSession(s) {
+        conn.Close()
+        return nil, errors.New("shutting down")
+    }
+    go s.readLoop()
+
+    ours := nodeInstance.ourHandshake()
+    jsonHandshake, err := json.Marshal(ours)
+    if err != nil {
+        s.close()
+        return nil, err
+    }
+    reply, err := s.call("/handshake", jsonHandshake)
+    if err != nil {
+        s.close()
+        return nil, err
+    }
+    if reply.Status != http.StatusOK {
+        s.close()
+        return nil, errors.New(addressKey(node) + " refused our handshake: " + string(reply.Body))
+    }
+    var theirs Handshake
+    err = json.Unmarshal(reply.Body, &theirs)
+    if err != nil {
+        s.close()
+        return nil, err
+    }
+    peer, err := nodeInstance.negotiate(ours, theirs)
+    if err != nil {
+        s.close()
+        return nil, err
+    }
+    peer.Address = node
+    peer.session = theirs.Session
+    s.setPeer(peer)
+    nodeInstance.Addresses().Good(node)
+
+    nodeInstance.PeerMutex.Lock()
+    if nodeInstance.outboundPeers == nil {
+        nodeInstance.outboundPeers = map[string]*Peer{}
+    }
+    nodeInstance.outboundPeers[addressKey(node)] = peer
+    nodeInstance.PeerMutex.Unlock()
+
+    go s.keepalive()
+    return peer, nil
+}
+
+// hang up on an inbound session that doesn't shake hands in time
+func (s *session) expectHandshake() {
+    timer := time.NewTimer(SESSION_HANDSHAKE_TIMEOUT)
+    defer timer.Stop()
+    select {
+    case <-s.handshaken:
+    case <-s.closed:
+    case <-timer.C:
+        s.close()
+    }
+}
+
+// Remember a session so it can be closed on shutdown. Returns false if we're
+// shutting down, or for an inbound session there's no room for
+func (nodeInstance *Node) trackSession(s *session) bool {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    if nodeInstance.sessionsClosed {
+        return false
+    }
+    // checked again now the connection is ours, others may have opened sessions meanwhile
+    if s.inbound && !nodeInstance.roomForSession(s.remoteIP()) {
+        return false
+    }
+    if nodeInstance.sessions == nil {
+        nodeInstance.sessions = map[*session]bool{}
+    }
+    nodeInstance.sessions[s] = true
+    return true
+}
+
+// forget a session that has closed. An outbound peer falls back to HTTP, an
+// inbound one leaves the peer table so it doesn't hold a place there
+func (nodeInstance *Node) sessionClosed(s *session) {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    delete(nodeInstance.sessions, s)
+    if s.peer != nil && s.peer.stream == s {
+        s.peer.stream = nil
+        if s.peer.Inbound && nodeInstance.inboundPeers[s.peer.session] == s.peer {
+            delete(nodeInstance.inboundPeers, s.peer.session)
+        }
+    }
+}
+
+// the open session with node, whichever side opened it. nil if there isn't one
+func (nodeInstance *Node) liveSession(node NodeAddress) *session {
+    nodeInstance.PeerMutex.Lock()
+    defer nodeInstance.PeerMutex.Unlock()
+    key := addressKey(node)
+    if peer, ok := nodeInstance.outboundPeers[key]; ok && peer.stream != nil {
+        return peer.stream
+    }
+    for _, peer := range nodeInstance.inboundPeers {
+        if peer.stream != nil && addressKey(peer.Address) == key {
+            return peer.stream
+        }
+    }
+    return nil
+}
+
+// Keep a session open with every known node, reconnecting dropped ones with a
+// growing delay. Runs until ctx is cancelled, or returns right away if the
+// transport can't carry sessions
+func (nodeInstance *Node) MaintainSessions(ctx context.Context) {
+    if _, ok := nodeInstance.transport().(StreamTransport); !ok {
+        return
+    }
+    retries := map[string]*reconnectState{}
+    ticker := time.NewTicker(time.Duration(RECONNECT_MIN_DELAY) * time.Second)
+    defer ticker.Stop()
+
+    for ctx.Err() == nil {
+        nodes := nodeInstance.snapshotNodes()
+        now := time.Now().Unix()
+        // forget the delays of nodes that left the list
+        listed := map[string]bool{}
+        for _, node := range nodes {
+            listed[addressKey(node)] = true
+        }
+        for key := range retries {
+            if !listed[key] {
+                delete(retries, key)
+            }
+        }
+        for _, node := range nodes {
+            key := addressKey(node)
+            retry, ok := retries[key]
+            if !ok {
+                retry = &reconnectState{delay: RECONNECT_MIN_DELAY}
+                retries[key] = retry
+            }
+            if nodeInstance.liveSession(node) != nil || now < retry.next {
+                continue
+            }
+
+            _, err := nodeInstance.connectSession(node)
+            if err != nil {
+                retry.next = now + retry.delay
+                retry.delay *= 2
+                if retry.delay > RECONNECT_MAX_DELAY {
+                    retry.delay = RECONNECT_MAX_DELAY
+                }
+                continue
+            }
+            fmt.Println("Opened a session with " + key)
+            retry.delay = RECONNECT_MIN_DELAY
+        }
+
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+        }
+    }
+}
+
+// hang up every session and refuse new ones
+func (nodeInstance *Node) closeSessions() {
+    nodeInstance.PeerMutex.Lock()
+    nodeInstance.sessionsClosed = true
+    sessions := []*session{}
+    for s := range nodeInstance.sessions {
+        sessions = append(sessions, s)
+    }
+    nodeInstance.PeerMutex.Unlock()
+
+    for _, s := range sessions {
+        s.close()
+    }
+}
@@ -0,0 +1,158 @@
+package nodePackage
+
+import (
+    "bufio"
+    "bytes"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// a pipe end that says it's connected from ip
+type addrConn struct {
+    net.Conn
+    remote net.Addr
+}
+
+func (conn addrConn) RemoteAddr() net.Addr {
+    return conn.remote
+}
+
+// two sessions talking over a pipe, the first inbound from ip. Both are closed when the test ends
+func newSessionPair(t *testing.T, nodeInstance *Node, ip string) (*session, *session) {
+    a, b := net.Pipe()
+    inbound := makeSession(nodeInstance, addrConn{a, &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}}, bufio.NewReader(a), true)
+    outbound := makeSession(nodeInstance, b, bufio.NewReader(b), false)
+    t.Cleanup(inbound.close)
+    t.Cleanup(outbound.close)
+    return inbound, outbound
+}
+
+func TestFramesGoBothWays(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    inbound, outbound := newSessionPair(t, nodeInstance, "10.0.0.9")
+
+    sent := Message{ID: 7, Kind: MSG_REQUEST, Page: "/height", Body: []byte("{}")}
+    go outbound.send(sent)
+    got, err := inbound.receive()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.ID != sent.ID || got.Kind != sent.Kind || got.Page != sent.Page || !bytes.Equal(got.Body, sent.Body) {
+        t.Errorf("got %+v, want %+v", got, sent)
+    }
+}
+
+func TestFrameLimits(t *testing.T) {
+    tests := []struct {
+        name string
+        handshaken bool
+        size int
+        wantErr bool
+    }{
+        {"small before the handshake", false, 1024, false},
+        {"big before the handshake", false, MAX_HANDSHAKE_FRAME_SIZE + 1, true},
+        {"big after the handshake", true, MAX_HANDSHAKE_FRAME_SIZE + 1, false},
+        {"too big after the handshake", true, MAX_FRAME_SIZE + 1, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            nodeInstance, _ := newTestNode(t)
+            inbound, outbound := newSessionPair(t, nodeInstance, "10.0.0.9")
+            if test.handshaken {
+                close(inbound.handshaken)
+            }
+            // the body is base64 in the JSON, a third bigger
+            go outbound.send(Message{Kind: MSG_REQUEST, Page: "/height", Body: make([]byte, test.size * 3 / 4)})
+            _, err := inbound.receive()
+            if (err != nil) != test.wantErr {
+                t.Errorf("got %v, want an error: %v", err, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestWaitingSessionsCountAgainstTheCaps(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    attachBlockchain(t, nodeInstance)
+    nodeInstance.MaxInbound = MAX_INBOUND_PER_IP + 2
+
+    // sessions that never shake hands can't go past the cap for their address
+    for i := 0; i < MAX_INBOUND_PER_IP + 1; i++ {
+        s, _ := newSessionPair(t, nodeInstance, "10.0.0.9")
+        if nodeInstance.trackSession(s) != (i < MAX_INBOUND_PER_IP) {
+            t.Errorf("waiting session %d from one address was let in: %v", i + 1, i < MAX_INBOUND_PER_IP)
+        }
+    }
+    // nor past the inbound cap between them
+    for i := 0; i < 3; i++ {
+        s, _ := newSessionPair(t, nodeInstance, "10.1.0." + string(rune('1' + i)))
+        if nodeInstance.trackSession(s) != (i < 2) {
+            t.Errorf("waiting session %d from another address was let in: %v", i + 1, i < 2)
+        }
+    }
+
+    // a session that shook hands stops waiting, but still counts for its address
+    nodeInstance.MaxInbound = 32
+    s, _ := newSessionPair(t, nodeInstance, "10.2.0.1")
+    if !nodeInstance.trackSession(s) {
+        t.Fatal("a session was refused with room left")
+    }
+    _, _, err := nodeInstance.acceptHandshake(peerHandshake("10.2.0.1", "nonce"), "10.2.0.1", s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 1; i < MAX_INBOUND_PER_IP; i++ {
+        s, _ := newSessionPair(t, nodeInstance, "10.2.0.1")
+        if !nodeInstance.trackSession(s) {
+            t.Errorf("waiting session %d was refused", i + 1)
+        }
+    }
+    s, _ = newSessionPair(t, nodeInstance, "10.2.0.1")
+    if nodeInstance.trackSession(s) {
+        t.Errorf("a session past the address cap was let in")
+    }
+}
+
+func TestRequestsOnASession(t *testing.T) {
+    nodeInstance, _ := newTestNode(t)
+    attachBlockchain(t, nodeInstance)
+    inbound, outbound := newSessionPair(t, nodeInstance, "10.0.0.9")
+    go inbound.readLoop()
+    go outbound.readLoop()
+
+    // only a handshake is answered until there's been one
+    reply, err := outbound.call("/get-height", nil)
+    if err != nil || reply.Status != http.StatusPreconditionRequired {
+        t.Fatalf("a request before the handshake got %+v, %v", reply, err)
+    }
+    reply, err = outbound.call("/handshake", []byte(jsonString(t, peerHandshake("10.0.0.9", "theirs"))))
+    if err != nil || reply.Status != http.StatusOK {
+        t.Fatalf("the handshake got %+v, %v", reply, err)
+    }
+    nodeInstance.PeerMutex.Lock()
+    tied := inbound.peer != nil && inbound.peer.stream == inbound
+    nodeInstance.PeerMutex.Unlock()
+    if !tied {
+        t.Errorf("the session isn't tied to the peer it shook hands with")
+    }
+
+    tests := []struct {
+        page string
+        wantStatus int
+        wantBody string
+    }{
+        {"/get-height", http.StatusOK, "1"},
+        {"/no-such-page", http.StatusNotFound, ""},
+    }
+    for _, test := range tests {
+        reply, err := outbound.call(test.page, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if reply.Status != test.wantStatus || strings.TrimSpace(string(reply.Body)) != test.wantBody {
+            t.Errorf("%s got %d %q, want %d %q", test.page, reply.Status, reply.Body, test.wantStatus, test.wantBody)
+        }
+    }
+}
@@ -0,0 +1,251 @@
+package nodePackage
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// how long a client waits for a peer to answer a request
+var CLIENT_TIMEOUT time.Duration = 10 * time.Second
+
+// Transport carries requests between nodes. Requests are addressed to
+// "http://ip:port/page" whatever the transport, and served by the same server
+// functions, so the rest of the node doesn't care how they get there
+type Transport interface {
+    // send a request to the node in its URL and wait for the answer
+    Do(req *http.Request) (*http.Response, error)
+    // serve handler to other nodes on address until the server is shut down
+    Listen(address string, handler http.Handler) (TransportServer, error)
+}
+
+// A transport that can also open raw connections, which peer sessions need.
+// Nodes on other transports send every request separately
+type StreamTransport interface {
+    Transport
+    Dial(address string, timeout time.Duration) (net.Conn, error)
+}
+
+// what Listen hands back
+type TransportServer interface {
+    // the address the server ended up on, with the port filled in
+    Addr() string
+    // stop accepting requests and wait for the ones in flight, or for ctx to expire
+    Shutdown(ctx context.Context) error
+}
+
+// the transport this node talks over, HTTP unless told otherwise
+func (nodeInstance *Node) transport() Transport {
+    if nodeInstance.Transport == nil {
+        return &HTTPTransport{}
+    }
+    return nodeInstance.Transport
+}
+
+//***************************************** HTTP ************************************************
+
+// Define the transport real nodes use: HTTP over TCP
+type HTTPTransport struct {
+    // nil for a client with CLIENT_TIMEOUT
+    Client *http.Client
+}
+
+func (transport *HTTPTransport) Do(req *http.Request) (*http.Response, error) {
+    client := transport.Client
+    if client == nil {
+        client = &http.Client{Timeout: CLIENT_TIMEOUT}
+    }
+    return client.Do(req)
+}
+
+// pick tcp4 or tcp6 for literal addresses so "0.0.0.0:port" and "[::]:port" can both be used at once
+func listenNetwork(address string) string {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return "tcp"
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return "tcp"
+    }
+    if ip.To4() != nil {
+        return "tcp4"
+    }
+    return "tcp6"
+}
+
+// an http.Server and the listener it serves
+type httpServer struct {
+    server *http.Server
+    listener net.Listener
+}
+
+func (server *httpServer) Addr() string {
+    return server.listener.Addr().String()
+}
+
+func (server *httpServer) Shutdown(ctx context.Context) error {
+    return server.server.Shutdown(ctx)
+}
+
+func (transport *HTTPTransport) Listen(address string, handler http.Handler) (TransportServer, error) {
+    listener, err := net.Listen(listenNetwork(address), address)
+    if err != nil {
+        return nil, err
+    }
+    server := &httpServer{
+        server: &http.Server{
+            Handler: handler,
+            ReadHeaderTimeout: SERVER_READ_HEADER_TIMEOUT,
+            ReadTimeout: SERVER_READ_TIMEOUT,
+            WriteTimeout: SERVER_WRITE_TIMEOUT,
+            IdleTimeout: SERVER_IDLE_TIMEOUT,
+        },
+        listener: listener,
+    }
+    go func() {
+        err := server.server.Serve(listener)
+        if err != nil && err != http.ErrServerClosed {
+            log.Println(err.Error())
+        }
+    }()
+    return server, nil
+}
+
+func (transport *HTTPTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+    dialer := net.Dialer{Timeout: timeout}
+    return dialer.Dial("tcp", address)
+}
+
+//***************************************** In memory ************************************************
+
+// Define a network that only exists inside this process, so many nodes can run
+// side by side in tests and simulations. Each node gets its own Host on it
+type MemoryNetwork struct {
+    mutex sync.Mutex
+    handlers map[string]http.Handler
+    nextPort int
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+    return &MemoryNetwork{handlers: map[string]http.Handler{}, nextPort: 49152}
+}
+
+// The transport for a node at ip on the network. Requests it sends come from ip
+// and it listens on ip whatever host its listen addresses name
+func (network *MemoryNetwork) Host(ip string) Transport {
+    return &memoryTransport{network: network, ip: ip}
+}
+
+// a port for the sending side of a request, like the ones the OS hands out
+func (network *MemoryNetwork) ephemeralPort() int {
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+    network.nextPort++
+    if network.nextPort > 65535 {
+        network.nextPort = 49152
+    }
+    return network.nextPort
+}
+
+// one node's end of a memory network
+type memoryTransport struct {
+    network *MemoryNetwork
+    ip string
+}
+
+// Hand the request straight to the server function listening at its address.
+// The answer is collected the same way answers on sessions are
+func (transport *memoryTransport) Do(req *http.Request) (*http.Response, error) {
+    transport.network.mutex.Lock()
+    handler, ok := transport.network.handlers[req.URL.Host]
+    transport.network.mutex.Unlock()
+    if !ok {
+        return nil, errors.New("dial " + req.URL.Host + ": connection refused")
+    }
+
+    var body []byte
+    if req.Body != nil {
+        var err error
+        body, err = ioutil.ReadAll(req.Body)
+        req.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+    }
+    ctx, cancel := context.WithTimeout(req.Context(), CLIENT_TIMEOUT)
+    defer cancel()
+    serverReq := req.Clone(ctx)
+    serverReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+    serverReq.ContentLength = int64(len(body))
+    serverReq.RemoteAddr = net.JoinHostPort(transport.ip, strconv.Itoa(transport.network.ephemeralPort()))
+    serverReq.RequestURI = req.URL.RequestURI()
+
+    w := &bufferedResponse{header: http.Header{}}
+    done := make(chan bool)
+    go func() {
+        handler.ServeHTTP(w, serverReq)
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-ctx.Done():
+        return nil, errors.New(req.URL.String() + ": " + ctx.Err().Error())
+    }
+
+    status := w.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    return &http.Response{
+        StatusCode: status,
+        Status: strconv.Itoa(status) + " " + http.StatusText(status),
+        Proto: "HTTP/1.1",
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Header: w.header,
+        Body: ioutil.NopCloser(bytes.NewReader(w.body.Bytes())),
+        ContentLength: int64(w.body.Len()),
+        Request: req,
+    }, nil
+}
+
+func (transport *memoryTransport) Listen(address string, handler http.Handler) (TransportServer, error) {
+    _, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return nil, err
+    }
+    key := net.JoinHostPort(transport.ip, port)
+
+    transport.network.mutex.Lock()
+    defer transport.network.mutex.Unlock()
+    if _, taken := transport.network.handlers[key]; taken {
+        return nil, errors.New("listen " + key + ": address already in use")
+    }
+    transport.network.handlers[key] = handler
+    return &memoryServer{network: transport.network, address: key}, nil
+}
+
+// a handler registered on a memory network
+type memoryServer struct {
+    network *MemoryNetwork
+    address string
+}
+
+func (server *memoryServer) Addr() string {
+    return server.address
+}
+
+func (server *memoryServer) Shutdown(ctx context.Context) error {
+    server.network.mutex.Lock()
+    delete(server.network.handlers, server.address)
+    server.network.mutex.Unlock()
+    return nil
+}
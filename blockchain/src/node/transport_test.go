@@ -0,0 +1,129 @@
+package nodePackage
+
+import (
+    "context"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// answers with where the request came from and what it carried
+func echoHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        body, _ := ioutil.ReadAll(req.Body)
+        if req.URL.Path == "/teapot" {
+            w.WriteHeader(http.StatusTeapot)
+        }
+        w.Write([]byte(req.RemoteAddr + " " + req.URL.Path + " " + string(body)))
+    })
+}
+
+func TestMemoryTransport(t *testing.T) {
+    network := NewMemoryNetwork()
+    server, err := network.Host("10.0.0.1").Listen("0.0.0.0:3000", echoHandler())
+    if err != nil {
+        t.Fatal(err)
+    }
+    // it listens on its own ip whatever the address says
+    if server.Addr() != "10.0.0.1:3000" {
+        t.Errorf("listening on %s, want 10.0.0.1:3000", server.Addr())
+    }
+
+    tests := []struct {
+        name string
+        url string
+        body string
+        wantErr bool
+        wantStatus int
+        wantBody string
+    }{
+        {"request with a body", "http://10.0.0.1:3000/echo", "hello", false, http.StatusOK, "/echo hello"},
+        {"status is passed back", "http://10.0.0.1:3000/teapot", "", false, http.StatusTeapot, "/teapot "},
+        {"nobody on that port", "http://10.0.0.1:3001/echo", "", true, 0, ""},
+        {"nobody at that ip", "http://10.0.0.3:3000/echo", "", true, 0, ""},
+    }
+    client := network.Host("10.0.0.2")
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            req, err := http.NewRequest("POST", test.url, strings.NewReader(test.body))
+            if err != nil {
+                t.Fatal(err)
+            }
+            resp, err := client.Do(req)
+            if (err != nil) != test.wantErr {
+                t.Fatalf("got %v, want an error: %v", err, test.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            defer resp.Body.Close()
+            body, _ := ioutil.ReadAll(resp.Body)
+            from, rest := splitFrom(string(body))
+            host, _, _ := net.SplitHostPort(from)
+            if resp.StatusCode != test.wantStatus || rest != test.wantBody || host != "10.0.0.2" {
+                t.Errorf("got %d %q, want %d %q from 10.0.0.2", resp.StatusCode, body, test.wantStatus, test.wantBody)
+            }
+        })
+    }
+}
+
+// split what echoHandler sent back into the sender's address and the rest
+func splitFrom(body string) (string, string) {
+    parts := strings.SplitN(body, " ", 2)
+    if len(parts) < 2 {
+        return body, ""
+    }
+    return parts[0], parts[1]
+}
+
+func TestMemoryRequestsComeFromDifferentPorts(t *testing.T) {
+    network := NewMemoryNetwork()
+    _, err := network.Host("10.0.0.1").Listen(":3000", echoHandler())
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := network.Host("10.0.0.2")
+    seen := map[string]bool{}
+    for i := 0; i < 3; i++ {
+        req, _ := http.NewRequest("GET", "http://10.0.0.1:3000/", nil)
+        resp, err := client.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        body, _ := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        from, _ := splitFrom(string(body))
+        if seen[from] {
+            t.Errorf("two requests came from %s", from)
+        }
+        seen[from] = true
+    }
+}
+
+func TestMemoryListenAndShutdown(t *testing.T) {
+    network := NewMemoryNetwork()
+    host := network.Host("10.0.0.1")
+    server, err := host.Listen(":3000", echoHandler())
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = host.Listen(":3000", echoHandler())
+    if err == nil {
+        t.Errorf("two servers listened on one address")
+    }
+    if _, err := host.Listen("no port", echoHandler()); err == nil {
+        t.Errorf("an address without a port was accepted")
+    }
+
+    server.Shutdown(context.Background())
+    req, _ := http.NewRequest("GET", "http://10.0.0.1:3000/", nil)
+    if _, err := network.Host("10.0.0.2").Do(req); err == nil {
+        t.Errorf("a request was answered after the server shut down")
+    }
+    // and the address is free again
+    if _, err := host.Listen(":3000", echoHandler()); err != nil {
+        t.Errorf("couldn't listen again after shutting down: %v", err)
+    }
+}
@@ -0,0 +1,290 @@
+package simnetPackage
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "math/rand"
+    "net/http"
+    "node"
+    "sync"
+    "time"
+)
+
+// how long a reordered message is held back, on top of any delay, so the ones after it overtake it
+var REORDER_DELAY time.Duration = 20 * time.Millisecond
+
+// Define what can go wrong with messages from one group of hosts to another.
+// Chances are between 0 and 1, and each message is judged on its own
+type FaultRule struct {
+    // the hosts sending and receiving the messages the rule applies to, empty for every host
+    From []string
+    To []string
+    // the message never arrives, or arrives but its answer is lost
+    Drop float64
+    // the message arrives twice
+    Duplicate float64
+    // the message is held back so messages sent after it arrive first
+    Reorder float64
+    // every message takes at least Delay, and up to Jitter longer
+    Delay time.Duration
+    Jitter time.Duration
+}
+
+// Split hosts into groups that can't reach each other from From until Until on
+// the simulated clock. A zero Until lasts until Heal. Hosts in no group can
+// reach everyone
+type Partition struct {
+    Groups [][]string
+    From time.Time
+    Until time.Time
+}
+
+// how many messages each kind of fault has hit
+type FaultStats struct {
+    Sent int
+    Dropped int
+    Duplicated int
+    Reordered int
+    Delayed int
+    Partitioned int
+}
+
+// Define the faults on a simulated network. Every host's transport is wrapped
+// with Wrap, and all of them draw from one seeded random source so a run can
+// be repeated
+type Faults struct {
+    clock func() time.Time
+    mutex sync.Mutex
+    random *rand.Rand
+    rules []FaultRule
+    partitions []Partition
+    stats FaultStats
+}
+
+func NewFaults(seed int64, clock func() time.Time) *Faults {
+    return &Faults{clock: clock, random: rand.New(rand.NewSource(seed))}
+}
+
+// start drawing from seed again, so the faults that follow repeat from run to run
+func (faults *Faults) Seed(seed int64) {
+    faults.mutex.Lock()
+    faults.random = rand.New(rand.NewSource(seed))
+    faults.mutex.Unlock()
+}
+
+func (faults *Faults) AddRule(rule FaultRule) {
+    faults.mutex.Lock()
+    faults.rules = append(faults.rules, rule)
+    faults.mutex.Unlock()
+}
+
+// let every message through again, partitions stay
+func (faults *Faults) ClearRules() {
+    faults.mutex.Lock()
+    faults.rules = nil
+    faults.mutex.Unlock()
+}
+
+func (faults *Faults) AddPartition(partition Partition) {
+    faults.mutex.Lock()
+    faults.partitions = append(faults.partitions, partition)
+    faults.mutex.Unlock()
+}
+
+// end every partition
+func (faults *Faults) Heal() {
+    faults.mutex.Lock()
+    faults.partitions = nil
+    faults.mutex.Unlock()
+}
+
+// the groups of the partitions in force right now, nil if there aren't any
+func (faults *Faults) activeGroups() [][]string {
+    faults.mutex.Lock()
+    defer faults.mutex.Unlock()
+    now := faults.clock()
+    groups := [][]string{}
+    for _, partition := range faults.partitions {
+        if !now.Before(partition.From) && (partition.Until.IsZero() || now.Before(partition.Until)) {
+            groups = append(groups, partition.Groups...)
+        }
+    }
+    if len(groups) == 0 {
+        return nil
+    }
+    return groups
+}
+
+func (faults *Faults) Stats() FaultStats {
+    faults.mutex.Lock()
+    defer faults.mutex.Unlock()
+    return faults.stats
+}
+
+// whether host is listed, an empty list holds every host
+func listed(hosts []string, host string) bool {
+    if len(hosts) == 0 {
+        return true
+    }
+    for _, listedHost := range hosts {
+        if listedHost == host {
+            return true
+        }
+    }
+    return false
+}
+
+// the group of a partition host is in, -1 for none
+func groupOf(partition Partition, host string) int {
+    for i, group := range partition.Groups {
+        for _, member := range group {
+            if member == host {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+// what happens to one message
+type fate struct {
+    partitioned bool
+    drop bool
+    // the message is delivered but the answer is lost
+    dropAnswer bool
+    duplicate bool
+    delay time.Duration
+}
+
+// Decide everything that happens to a message from one host to another up front,
+// so the random draws happen in the order messages are sent
+func (faults *Faults) judge(from string, to string) fate {
+    faults.mutex.Lock()
+    defer faults.mutex.Unlock()
+
+    var decided fate
+    faults.stats.Sent++
+    now := faults.clock()
+    for _, partition := range faults.partitions {
+        if now.Before(partition.From) || (!partition.Until.IsZero() && !now.Before(partition.Until)) {
+            continue
+        }
+        fromGroup := groupOf(partition, from)
+        toGroup := groupOf(partition, to)
+        if fromGroup != -1 && toGroup != -1 && fromGroup != toGroup {
+            faults.stats.Partitioned++
+            decided.partitioned = true
+            return decided
+        }
+    }
+
+    for _, rule := range faults.rules {
+        if !listed(rule.From, from) || !listed(rule.To, to) {
+            continue
+        }
+        if faults.random.Float64() < rule.Drop {
+            decided.drop = true
+            decided.dropAnswer = faults.random.Intn(2) == 0
+        }
+        if faults.random.Float64() < rule.Duplicate {
+            decided.duplicate = true
+        }
+        if rule.Delay > 0 || rule.Jitter > 0 {
+            decided.delay += rule.Delay
+            if rule.Jitter > 0 {
+                decided.delay += time.Duration(faults.random.Int63n(int64(rule.Jitter)))
+            }
+        }
+        if faults.random.Float64() < rule.Reorder {
+            decided.delay += REORDER_DELAY
+            faults.stats.Reordered++
+        }
+    }
+    if decided.drop {
+        faults.stats.Dropped++
+    }
+    if decided.duplicate {
+        faults.stats.Duplicated++
+    }
+    if decided.delay > 0 {
+        faults.stats.Delayed++
+    }
+    return decided
+}
+
+// Wrap the transport of the host at ip so messages it sends suffer the faults
+func (faults *Faults) Wrap(ip string, transport nodePackage.Transport) nodePackage.Transport {
+    return &faultyTransport{faults: faults, ip: ip, transport: transport}
+}
+
+// a host's transport with faults between it and everyone else
+type faultyTransport struct {
+    faults *Faults
+    ip string
+    transport nodePackage.Transport
+}
+
+// a copy of req with its own body, so a message can be sent twice
+func copyRequest(req *http.Request, body []byte) *http.Request {
+    sent := req.Clone(req.Context())
+    if body != nil {
+        sent.Body = ioutil.NopCloser(bytes.NewReader(body))
+    }
+    return sent
+}
+
+func (transport *faultyTransport) Do(req *http.Request) (*http.Response, error) {
+    to := req.URL.Hostname()
+    decided := transport.faults.judge(transport.ip, to)
+    if decided.partitioned {
+        return nil, errors.New("dial " + req.URL.Host + ": network is unreachable")
+    }
+
+    var body []byte
+    if req.Body != nil {
+        var err error
+        body, err = ioutil.ReadAll(req.Body)
+        req.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+    }
+    if decided.delay > 0 {
+        timer := time.NewTimer(decided.delay)
+        select {
+        case <-timer.C:
+        case <-req.Context().Done():
+            timer.Stop()
+            return nil, req.Context().Err()
+        }
+    }
+    lost := errors.New(req.URL.String() + ": " + context.DeadlineExceeded.Error())
+    if decided.drop && !decided.dropAnswer {
+        return nil, lost
+    }
+
+    if decided.duplicate {
+        // the copy's answer goes nowhere
+        go func() {
+            resp, err := transport.transport.Do(copyRequest(req, body))
+            if err == nil {
+                resp.Body.Close()
+            }
+        }()
+    }
+    resp, err := transport.transport.Do(copyRequest(req, body))
+    if err != nil {
+        return nil, err
+    }
+    if decided.dropAnswer {
+        resp.Body.Close()
+        return nil, lost
+    }
+    return resp, nil
+}
+
+func (transport *faultyTransport) Listen(address string, handler http.Handler) (nodePackage.TransportServer, error) {
+    return transport.transport.Listen(address, handler)
+}
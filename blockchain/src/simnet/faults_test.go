@@ -0,0 +1,46 @@
+package simnetPackage
+
+import (
+    "testing"
+    "time"
+)
+
+func TestPartitions(t *testing.T) {
+    start := time.Unix(1000, 0)
+    now := start
+    faults := NewFaults(1, func() time.Time { return now })
+    faults.AddPartition(Partition{
+        Groups: [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.3"}},
+        From: start,
+        Until: start.Add(time.Minute),
+    })
+
+    tests := []struct {
+        name string
+        at time.Time
+        from string
+        to string
+        wantCut bool
+    }{
+        {"same group", start, "10.0.0.1", "10.0.0.2", false},
+        {"across groups", start, "10.0.0.1", "10.0.0.3", true},
+        {"across groups the other way", start, "10.0.0.3", "10.0.0.2", true},
+        {"host in no group", start, "10.0.0.4", "10.0.0.3", false},
+        {"before the partition", start.Add(-time.Second), "10.0.0.1", "10.0.0.3", false},
+        {"after the partition", start.Add(time.Minute), "10.0.0.1", "10.0.0.3", false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            now = test.at
+            if got := faults.judge(test.from, test.to).partitioned; got != test.wantCut {
+                t.Errorf("cut off is %v, want %v", got, test.wantCut)
+            }
+        })
+    }
+
+    now = start
+    faults.Heal()
+    if faults.judge("10.0.0.1", "10.0.0.3").partitioned {
+        t.Errorf("still cut off after healing")
+    }
+}
@@ -0,0 +1,422 @@
+package simnetPackage
+
+import (
+    "blockchain"
+    "context"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "errors"
+    "io/ioutil"
+    "net"
+    "node"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "wallet"
+)
+
+// how often WaitForConvergence looks at the nodes' tips
+var CONVERGENCE_POLL_INTERVAL time.Duration = 50 * time.Millisecond
+
+// Define a clock that only moves when told to. Every node on a simulated network
+// reads the same one, so block timestamps are the same from run to run
+type Clock struct {
+    mutex sync.Mutex
+    now time.Time
+}
+
+func NewClock(start time.Time) *Clock {
+    return &Clock{now: start}
+}
+
+func (clock *Clock) Now() time.Time {
+    clock.mutex.Lock()
+    defer clock.mutex.Unlock()
+    return clock.now
+}
+
+func (clock *Clock) Advance(duration time.Duration) {
+    clock.mutex.Lock()
+    clock.now = clock.now.Add(duration)
+    clock.mutex.Unlock()
+}
+
+// define one blockchain and node pair on a simulated network
+type SimNode struct {
+    Name string
+    Address nodePackage.NodeAddress
+    // where the blocks this node mines pay, the same for a given name every run
+    Payout string
+    Blockchain *blockchainPackage.Blockchain
+    Node *nodePackage.Node
+}
+
+// a node's best block
+type Tip struct {
+    Name string
+    Height int
+    Hash string
+}
+
+// Define a network of nodes running in this process on regtest. They talk over
+// an in-memory transport and keep their chains in a temporary directory that
+// Close removes
+type Network struct {
+    Params *blockchainPackage.NetworkParams
+    Clock *Clock
+    Transport *nodePackage.MemoryNetwork
+    // what goes wrong between nodes, nothing until rules or partitions are added
+    Faults *Faults
+    Nodes []*SimNode
+    dir string
+    ctx context.Context
+    cancel context.CancelFunc
+}
+
+// Start a network of count nodes that don't know about each other yet
+func New(count int) (*Network, error) {
+    dir, err := ioutil.TempDir("", "simnet")
+    if err != nil {
+        return nil, err
+    }
+    params := &blockchainPackage.RegTestParams
+    ctx, cancel := context.WithCancel(context.Background())
+    // start at the genesis block, every block moves the clock on
+    clock := NewClock(time.Unix(params.GenesisBlock.Timestamp, 0))
+    network := &Network{
+        Params: params,
+        Clock: clock,
+        Transport: nodePackage.NewMemoryNetwork(),
+        Faults: NewFaults(1, clock.Now),
+        dir: dir,
+        ctx: ctx,
+        cancel: cancel,
+    }
+    for i := 0; i < count; i++ {
+        _, err = network.AddNode()
+        if err != nil {
+            network.Close()
+            return nil, err
+        }
+    }
+    return network, nil
+}
+
+// a payout address made from name, so the same node pays the same address every run
+func payoutFor(name string) string {
+    seed := sha256.Sum256([]byte(name))
+    privateKey := ed25519.NewKeyFromSeed(seed[:])
+    return walletPackage.AddressFromPublicKey(privateKey.Public().(ed25519.PublicKey))
+}
+
+// Start another node on the network. Node i is called "node<i>" and listens on
+// 10.0.0.<i+1> at the network's default port
+func (network *Network) AddNode() (*SimNode, error) {
+    number := len(network.Nodes)
+    name := "node" + strconv.Itoa(number)
+    ip := "10.0." + strconv.Itoa((number + 1) / 256) + "." + strconv.Itoa((number + 1) % 256)
+    address := nodePackage.NodeAddress{IpAddr: ip, Port: network.Params.DefaultPort}
+    dataDir := filepath.Join(network.dir, name)
+    err := os.MkdirAll(dataDir, 0700)
+    if err != nil {
+        return nil, err
+    }
+
+    // the same channels runNode sets up, one set per node
+    heightRequestChannel := make(chan bool)
+    heightChannel := make(chan int)
+    blockIndexChannel := make(chan int)
+    getBlockChannel := make(chan blockchainPackage.Block)
+    addBlockChannel := make(chan blockchainPackage.Block)
+    blockValidateChannel := make(chan error)
+    indexQueryChannel := make(chan blockchainPackage.IndexQuery)
+    indexEntryChannel := make(chan blockchainPackage.IndexEntry)
+    generateChannel := make(chan blockchainPackage.GenerateRequest)
+    generatedChannel := make(chan []blockchainPackage.Block)
+    reorgChannel := make(chan blockchainPackage.Branch)
+    reorgResultChannel := make(chan bool)
+    branchCheckChannel := make(chan blockchainPackage.Branch)
+    branchCheckResultChannel := make(chan error)
+
+    blockchainInstance := &blockchainPackage.Blockchain{
+        DataDir: dataDir,
+        Params: network.Params,
+        MiningThreads: 1,
+        Clock: network.Clock.Now,
+        HeightRequestChannel: heightRequestChannel,
+        HeightChannel: heightChannel,
+        GetBlockChannel: getBlockChannel,
+        AddBlockChannel: addBlockChannel,
+        BlockIndexChannel: blockIndexChannel,
+        BlockValidateChannel: blockValidateChannel,
+        IndexQueryChannel: indexQueryChannel,
+        IndexEntryChannel: indexEntryChannel,
+        GenerateChannel: generateChannel,
+        GeneratedChannel: generatedChannel,
+        ReorgChannel: reorgChannel,
+        ReorgResultChannel: reorgResultChannel,
+        BranchCheckChannel: branchCheckChannel,
+        BranchCheckResultChannel: branchCheckResultChannel,
+    }
+    nodeInstance := &nodePackage.Node{
+        MyAddress: address,
+        DataDir: dataDir,
+        Params: network.Params,
+        ListenAddresses: []string{net.JoinHostPort(ip, strconv.Itoa(address.Port))},
+        UserAgent: nodePackage.DEFAULT_USER_AGENT + " (simnet " + name + ")",
+        Transport: network.Faults.Wrap(ip, network.Transport.Host(ip)),
+        Clock: network.Clock.Now,
+        HeightRequestChannel: heightRequestChannel,
+        HeightChannel: heightChannel,
+        GetBlockChannel: getBlockChannel,
+        AddBlockChannel: addBlockChannel,
+        BlockValidateChannel: blockValidateChannel,
+        BlockIndexChannel: blockIndexChannel,
+        IndexQueryChannel: indexQueryChannel,
+        IndexEntryChannel: indexEntryChannel,
+        GenerateChannel: generateChannel,
+        GeneratedChannel: generatedChannel,
+        ReorgChannel: reorgChannel,
+        ReorgResultChannel: reorgResultChannel,
+        BranchCheckChannel: branchCheckChannel,
+        BranchCheckResultChannel: branchCheckResultChannel,
+    }
+
+    blockchainInstance.Chain = []blockchainPackage.Block{network.Params.GenesisBlock}
+    go blockchainInstance.SendHeight()
+    go blockchainInstance.SendBlocks()
+    go blockchainInstance.AddRemoteBlocks()
+    go blockchainInstance.SendIndexEntries()
+    go blockchainInstance.GenerateBlocks(network.ctx)
+    go blockchainInstance.ReorganizeBlocks()
+    go blockchainInstance.CheckBranches()
+
+    err = nodeInstance.Server()
+    if err != nil {
+        return nil, err
+    }
+
+    simNode := &SimNode{
+        Name: name,
+        Address: address,
+        Payout: payoutFor(name),
+        Blockchain: blockchainInstance,
+        Node: nodeInstance,
+    }
+    network.Nodes = append(network.Nodes, simNode)
+    return simNode, nil
+}
+
+// add address to a node's list of peers
+func addPeer(simNode *SimNode, address nodePackage.NodeAddress) {
+    simNode.Node.NodeListMutex.Lock()
+    defer simNode.Node.NodeListMutex.Unlock()
+    for _, known := range simNode.Node.NodeList {
+        if known.IpAddr == address.IpAddr && known.Port == address.Port {
+            return
+        }
+    }
+    simNode.Node.NodeList = append(simNode.Node.NodeList, address)
+}
+
+// drop address from a node's list of peers
+func removePeer(simNode *SimNode, address nodePackage.NodeAddress) {
+    simNode.Node.NodeListMutex.Lock()
+    defer simNode.Node.NodeListMutex.Unlock()
+    kept := []nodePackage.NodeAddress{}
+    for _, known := range simNode.Node.NodeList {
+        if known.IpAddr != address.IpAddr || known.Port != address.Port {
+            kept = append(kept, known)
+        }
+    }
+    simNode.Node.NodeList = kept
+}
+
+// Let two nodes know about each other. They hear each other's next
+// announcements, call Sync to have them catch up on blocks mined before
+func (network *Network) Connect(a *SimNode, b *SimNode) {
+    addPeer(a, b.Address)
+    addPeer(b, a.Address)
+}
+
+// connect every node to every other node
+func (network *Network) ConnectAll() {
+    for i, a := range network.Nodes {
+        for _, b := range network.Nodes[i + 1:] {
+            network.Connect(a, b)
+        }
+    }
+}
+
+// Make two nodes forget each other so they stop passing blocks along
+func (network *Network) Disconnect(a *SimNode, b *SimNode) {
+    removePeer(a, b.Address)
+    removePeer(b, a.Address)
+}
+
+// the hosts of nodes, for fault rules and partitions
+func Hosts(nodes ...*SimNode) []string {
+    hosts := []string{}
+    for _, simNode := range nodes {
+        hosts = append(hosts, simNode.Address.IpAddr)
+    }
+    return hosts
+}
+
+// Split the nodes into groups that can't reach each other from now until Heal
+func (network *Network) Partition(groups ...[]*SimNode) {
+    network.PartitionBetween(network.Clock.Now(), time.Time{}, groups...)
+}
+
+// Split the nodes into groups that can't reach each other while the simulated
+// clock is between from and until, a zero until lasts until Heal
+func (network *Network) PartitionBetween(from time.Time, until time.Time, groups ...[]*SimNode) {
+    partition := Partition{From: from, Until: until}
+    for _, group := range groups {
+        partition.Groups = append(partition.Groups, Hosts(group...))
+    }
+    network.Faults.AddPartition(partition)
+}
+
+// end every partition
+func (network *Network) Heal() {
+    network.Faults.Heal()
+}
+
+// have every node catch up with the nodes it knows about, until nothing changes
+func (network *Network) Sync() {
+    for changed := true; changed; {
+        changed = false
+        for _, simNode := range network.Nodes {
+            if simNode.Node.SyncFromPeers() {
+                changed = true
+            }
+        }
+    }
+}
+
+// Mine count blocks on a node, moving the clock on by the block time before each
+// one, and announce each block to the node's peers as it's found
+func (network *Network) Mine(simNode *SimNode, count int) ([]blockchainPackage.Block, error) {
+    mined := []blockchainPackage.Block{}
+    for i := 0; i < count; i++ {
+        network.Clock.Advance(time.Duration(network.Params.BlockTime) * time.Second)
+        blocks := simNode.Blockchain.Generate(network.ctx, 1, simNode.Payout)
+        if len(blocks) == 0 {
+            return mined, errors.New(simNode.Name + " could not mine block " + strconv.Itoa(len(mined) + 1) + " of " + strconv.Itoa(count))
+        }
+        simNode.Node.AnnounceBlock(blocks[0])
+        mined = append(mined, blocks[0])
+    }
+    return mined, nil
+}
+
+// define one step of a mining script: Node mines Blocks blocks
+type MiningStep struct {
+    Node int
+    Blocks int
+}
+
+// Run each step of a mining script in order
+func (network *Network) RunScript(steps []MiningStep) error {
+    for _, step := range steps {
+        if step.Node < 0 || step.Node >= len(network.Nodes) {
+            return errors.New("there is no node " + strconv.Itoa(step.Node) + " on a network of " + strconv.Itoa(len(network.Nodes)))
+        }
+        _, err := network.Mine(network.Nodes[step.Node], step.Blocks)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// the best block of each of nodes
+func tips(nodes []*SimNode) []Tip {
+    tips := []Tip{}
+    for _, simNode := range nodes {
+        bc := simNode.Blockchain
+        bc.BlockMutex.Lock()
+        height := len(bc.Chain)
+        hash := bc.HashBlock(bc.Chain[height - 1])
+        bc.BlockMutex.Unlock()
+        tips = append(tips, Tip{Name: simNode.Name, Height: height, Hash: hash})
+    }
+    return tips
+}
+
+// every node's best block
+func (network *Network) Tips() []Tip {
+    return tips(network.Nodes)
+}
+
+// whether every node has the same best block
+func (network *Network) Converged() bool {
+    return agree(tips(network.Nodes))
+}
+
+func agree(tips []Tip) bool {
+    for _, tip := range tips {
+        if tip.Hash != tips[0].Hash {
+            return false
+        }
+    }
+    return true
+}
+
+// Wait until every node has the same best block. Returns an error listing the
+// tips if they still differ after timeout
+func (network *Network) WaitForConvergence(timeout time.Duration) error {
+    return network.WaitForAgreement(network.Nodes, timeout)
+}
+
+// Wait until nodes have the same best block, for checking part of a network
+func (network *Network) WaitForAgreement(nodes []*SimNode, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for !agree(tips(nodes)) {
+        if time.Now().After(deadline) {
+            lines := []string{}
+            for _, tip := range tips(nodes) {
+                lines = append(lines, tip.Name + " is at block " + strconv.Itoa(tip.Height - 1) + " " + tip.Hash)
+            }
+            return errors.New("the nodes did not converge within " + timeout.String() + ":\n" + strings.Join(lines, "\n"))
+        }
+        time.Sleep(CONVERGENCE_POLL_INTERVAL)
+    }
+    return nil
+}
+
+// Give messages time to arrive after mining: wait until each group of nodes
+// that can reach each other agrees on a tip, or until timeout. With messages
+// being lost they may never agree, so returns whether they did
+func (network *Network) Settle(timeout time.Duration) bool {
+    groups := network.Faults.activeGroups()
+    if len(groups) == 0 {
+        return network.WaitForConvergence(timeout) == nil
+    }
+    deadline := time.Now().Add(timeout)
+    for _, hosts := range groups {
+        group := []*SimNode{}
+        for _, simNode := range network.Nodes {
+            if listed(hosts, simNode.Address.IpAddr) {
+                group = append(group, simNode)
+            }
+        }
+        if len(group) > 0 && network.WaitForAgreement(group, deadline.Sub(time.Now())) != nil {
+            return false
+        }
+    }
+    return true
+}
+
+// Stop every node and delete their data
+func (network *Network) Close() {
+    network.cancel()
+    for _, simNode := range network.Nodes {
+        simNode.Node.Shutdown(context.Background())
+    }
+    os.RemoveAll(network.dir)
+}
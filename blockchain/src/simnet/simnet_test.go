@@ -0,0 +1,244 @@
+package simnetPackage
+
+import (
+    "node"
+    "sync"
+    "testing"
+    "time"
+)
+
+// a network of count nodes that is closed when the test ends
+func newTestNetwork(t *testing.T, count int) *Network {
+    network, err := New(count)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(network.Close)
+    return network
+}
+
+// connect each node in nodes to every other one of them
+func connectGroup(network *Network, nodes []*SimNode) {
+    for i, a := range nodes {
+        for _, b := range nodes[i + 1:] {
+            network.Connect(a, b)
+        }
+    }
+}
+
+func TestConvergence(t *testing.T) {
+    tests := []struct {
+        name string
+        nodes int
+        // blocks mined on each side of the split before the halves are joined
+        firstBlocks int
+        lastBlocks int
+    }{
+        {"two nodes, second branch longer", 2, 2, 4},
+        {"four nodes, second branch longer", 4, 3, 5},
+        {"four nodes, first branch longer", 4, 5, 2},
+        {"five nodes, same length", 5, 3, 3},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            network := newTestNetwork(t, test.nodes)
+            half := test.nodes / 2
+            groups := [][]*SimNode{network.Nodes[:half], network.Nodes[half:]}
+            for _, group := range groups {
+                connectGroup(network, group)
+            }
+            first := network.Nodes[0]
+            last := network.Nodes[test.nodes - 1]
+
+            err := network.RunScript([]MiningStep{
+                {Node: 0, Blocks: test.firstBlocks},
+                {Node: test.nodes - 1, Blocks: test.lastBlocks},
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, group := range groups {
+                err = network.WaitForAgreement(group, 10 * time.Second)
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if network.Converged() {
+                t.Fatal("the halves agree before they were joined")
+            }
+
+            // join the halves, and break any tie with one more block
+            network.Connect(first, last)
+            network.Sync()
+            _, err = network.Mine(first, 1)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = network.WaitForConvergence(10 * time.Second)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            longest := test.firstBlocks
+            if test.lastBlocks > longest {
+                longest = test.lastBlocks
+            }
+            for _, tip := range network.Tips() {
+                if tip.Height != longest + 2 {
+                    t.Errorf("%s has %d blocks, want %d", tip.Name, tip.Height, longest + 2)
+                }
+            }
+            for _, simNode := range network.Nodes {
+                if report := simNode.Blockchain.Verify(); report.FirstInvalid != -1 {
+                    t.Errorf("%s's block %d is invalid: %s", simNode.Name, report.FirstInvalid, report.Reason)
+                }
+            }
+        })
+    }
+}
+
+func TestConvergenceAfterAPartitionEnds(t *testing.T) {
+    network := newTestNetwork(t, 4)
+    network.ConnectAll()
+    left := network.Nodes[:2]
+    right := network.Nodes[2:]
+    blockTime := time.Duration(network.Params.BlockTime) * time.Second
+    // cut off for the second and third rounds only
+    start := network.Clock.Now().Add(2 * blockTime)
+    network.PartitionBetween(start, start.Add(4 * blockTime), left, right)
+
+    for round := 0; round < 4; round++ {
+        err := network.RunScript([]MiningStep{{Node: 0, Blocks: 1}, {Node: 3, Blocks: 1}})
+        if err != nil {
+            t.Fatal(err)
+        }
+        // the halves can end up tied once they're joined again, so they needn't agree yet
+        network.Settle(time.Second)
+        if round == 1 && network.Converged() {
+            t.Fatal("the halves agree while they're cut off from each other")
+        }
+    }
+    if network.Faults.Stats().Partitioned == 0 {
+        t.Fatal("no message was cut off by the partition")
+    }
+
+    network.Sync()
+    _, err := network.Mine(network.Nodes[3], 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = network.WaitForConvergence(10 * time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMiningIsRepeatable(t *testing.T) {
+    script := []MiningStep{{Node: 0, Blocks: 2}, {Node: 1, Blocks: 1}}
+    var hashes []string
+    for run := 0; run < 2; run++ {
+        network := newTestNetwork(t, 2)
+        network.ConnectAll()
+        err := network.RunScript(script)
+        if err != nil {
+            t.Fatal(err)
+        }
+        err = network.WaitForConvergence(10 * time.Second)
+        if err != nil {
+            t.Fatal(err)
+        }
+        hashes = append(hashes, network.Tips()[0].Hash)
+    }
+    if hashes[0] != hashes[1] {
+        t.Errorf("the same script gave tips %s and %s", hashes[0], hashes[1])
+    }
+}
+
+func TestRunScriptRefusesUnknownNodes(t *testing.T) {
+    network := newTestNetwork(t, 2)
+    if network.RunScript([]MiningStep{{Node: 2, Blocks: 1}}) == nil {
+        t.Errorf("mined on node 2 of a network of 2")
+    }
+}
+
+func TestHonestNodesAreNeverBanned(t *testing.T) {
+    tests := []struct {
+        name string
+        nodes int
+        rounds int
+    }{
+        {"four nodes", 4, 5},
+        {"six nodes", 6, 5},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            network := newTestNetwork(t, test.nodes)
+            network.ConnectAll()
+            first := network.Nodes[0]
+            last := network.Nodes[test.nodes - 1]
+
+            // two miners racing each other keep blocks arriving late and branches switching
+            for round := 0; round < test.rounds; round++ {
+                var wait sync.WaitGroup
+                errs := make([]error, 2)
+                for i, miner := range []*SimNode{first, last} {
+                    wait.Add(1)
+                    go func(i int, miner *SimNode) {
+                        defer wait.Done()
+                        _, errs[i] = network.Mine(miner, 1)
+                    }(i, miner)
+                }
+                wait.Wait()
+                for _, err := range errs {
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                }
+                network.Settle(300 * time.Millisecond)
+            }
+
+            network.Sync()
+            _, err := network.Mine(last, 1)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = network.WaitForConvergence(10 * time.Second)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, simNode := range network.Nodes {
+                if bans := simNode.Node.Bans(); len(bans) != 0 {
+                    t.Errorf("%s banned an honest node: %v", simNode.Name, bans)
+                }
+            }
+        })
+    }
+}
+
+func TestSyncStopsAtTheFirstBadBatch(t *testing.T) {
+    batchSize := nodePackage.SYNC_BATCH_SIZE
+    nodePackage.SYNC_BATCH_SIZE = 3
+    t.Cleanup(func() { nodePackage.SYNC_BATCH_SIZE = batchSize })
+
+    network := newTestNetwork(t, 2)
+    honest, liar := network.Nodes[0], network.Nodes[1]
+    _, err := network.Mine(liar, 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // block 7 pays an address that can't exist, which lands in the batch of blocks 7 to 9
+    liar.Blockchain.BlockMutex.Lock()
+    liar.Blockchain.Chain[7].Coinbase = "not an address"
+    liar.Blockchain.BlockMutex.Unlock()
+
+    network.Connect(honest, liar)
+    if !honest.Node.SyncFromPeers() {
+        t.Fatal("none of the good batches were taken")
+    }
+    if height, _ := honest.Blockchain.Tip(); height != 7 {
+        t.Errorf("synced to height %d, want the 7 blocks before the bad batch", height)
+    }
+    if !honest.Node.IsBanned(liar.Address.IpAddr) {
+        t.Errorf("the peer that sent a bad block wasn't banned")
+    }
+}
@@ -0,0 +1,129 @@
+package walletPackage
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "datadir"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "strings"
+)
+
+// every address starts with this, followed by 20 bytes of key hash and 4 bytes of checksum in hex
+var ADDRESS_PREFIX string = "gb"
+var ADDRESS_HASH_LENGTH int = 20
+var ADDRESS_CHECKSUM_LENGTH int = 4
+
+// bump this whenever the way keys are stored changes
+var WALLET_FORMAT_VERSION int = 1
+
+// define a key pair and the address it pays to
+type Key struct {
+    Address string
+    PublicKey string
+    PrivateKey string
+}
+
+// define the wallet structure, a list of keys saved in the data directory
+type Wallet struct {
+    Version int
+    Keys []Key
+    path string
+}
+
+// the checksum at the end of an address
+func addressChecksum(hash []byte) []byte {
+    first := sha256.Sum256(hash)
+    second := sha256.Sum256(first[:])
+    return second[:ADDRESS_CHECKSUM_LENGTH]
+}
+
+// Work out the address for a public key
+func AddressFromPublicKey(publicKey ed25519.PublicKey) string {
+    keyHash := sha256.Sum256(publicKey)
+    hash := keyHash[:ADDRESS_HASH_LENGTH]
+    return ADDRESS_PREFIX + hex.EncodeToString(hash) + hex.EncodeToString(addressChecksum(hash))
+}
+
+// Check that an address is well formed and its checksum matches, so a typo can't send coins nowhere
+func ValidateAddress(address string) error {
+    if !strings.HasPrefix(address, ADDRESS_PREFIX) {
+        return errors.New("address " + address + " does not start with " + ADDRESS_PREFIX)
+    }
+    decoded, err := hex.DecodeString(address[len(ADDRESS_PREFIX):])
+    if err != nil || len(decoded) != ADDRESS_HASH_LENGTH + ADDRESS_CHECKSUM_LENGTH {
+        return errors.New("address " + address + " is not the right length or has characters that aren't hex")
+    }
+    hash := decoded[:ADDRESS_HASH_LENGTH]
+    if hex.EncodeToString(addressChecksum(hash)) != hex.EncodeToString(decoded[ADDRESS_HASH_LENGTH:]) {
+        return errors.New("address " + address + " has a bad checksum")
+    }
+    return nil
+}
+
+// Read the wallet at path, or start an empty one if there isn't a file yet
+func Load(path string) (*Wallet, error) {
+    wallet := &Wallet{Version: WALLET_FORMAT_VERSION, Keys: []Key{}, path: path}
+
+    fileData, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return wallet, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    version, err := datadirPackage.FormatVersion(fileData)
+    if err != nil {
+        return nil, errors.New(path + " is not a readable wallet: " + err.Error())
+    }
+    if version != WALLET_FORMAT_VERSION {
+        return nil, &datadirPackage.FormatError{Path: path, Version: version, Want: WALLET_FORMAT_VERSION}
+    }
+    err = json.Unmarshal(fileData, wallet)
+    if err != nil {
+        return nil, errors.New(path + " is not a readable wallet: " + err.Error())
+    }
+    return wallet, nil
+}
+
+// Write the wallet back to its file, readable only by us since it holds private keys
+func (wallet *Wallet) Save() error {
+    jsonWallet, err := json.MarshalIndent(wallet, "", "    ")
+    if err != nil {
+        return err
+    }
+    return datadirPackage.WriteFileAtomic(wallet.path, jsonWallet, 0600)
+}
+
+// Make a new key pair, add it to the wallet and save it. Returns the new address
+func (wallet *Wallet) NewAddress() (string, error) {
+    publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return "", err
+    }
+    key := Key{
+        Address: AddressFromPublicKey(publicKey),
+        PublicKey: hex.EncodeToString(publicKey),
+        PrivateKey: hex.EncodeToString(privateKey.Seed()),
+    }
+    wallet.Keys = append(wallet.Keys, key)
+    err = wallet.Save()
+    if err != nil {
+        wallet.Keys = wallet.Keys[:len(wallet.Keys) - 1]
+        return "", err
+    }
+    return key.Address, nil
+}
+
+// every address in the wallet, oldest first
+func (wallet *Wallet) Addresses() []string {
+    addresses := []string{}
+    for _, key := range wallet.Keys {
+        addresses = append(addresses, key.Address)
+    }
+    return addresses
+}
@@ -0,0 +1,79 @@
+package walletPackage
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+    wallet, err := Load(filepath.Join(t.TempDir(), "wallet.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    good, err := wallet.NewAddress()
+    if err != nil {
+        t.Fatal(err)
+    }
+    // flip the last hex digit so only the checksum is wrong
+    last := good[len(good) - 1]
+    flipped := byte('0')
+    if last == '0' {
+        flipped = '1'
+    }
+
+    tests := []struct {
+        name string
+        address string
+        wantErr bool
+    }{
+        {"new address", good, false},
+        {"wrong prefix", "xx" + good[len(ADDRESS_PREFIX):], true},
+        {"bad checksum", good[:len(good) - 1] + string(flipped), true},
+        {"too short", good[:len(good) - 2], true},
+        {"not hex", ADDRESS_PREFIX + "zz" + good[len(ADDRESS_PREFIX) + 2:], true},
+        {"empty", "", true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            err := ValidateAddress(test.address)
+            if (err != nil) != test.wantErr {
+                t.Errorf("got %v, want an error: %v", err, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestWalletFileIsPrivate(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "wallet.json")
+    // a temp file left world readable by a crash mustn't pass that on
+    err := ioutil.WriteFile(path + ".tmp", []byte("{}"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    wallet, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    address, err := wallet.NewAddress()
+    if err != nil {
+        t.Fatal(err)
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("wallet file has permissions %v, want 0600", info.Mode().Perm())
+    }
+
+    reloaded, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if addresses := reloaded.Addresses(); len(addresses) != 1 || addresses[0] != address {
+        t.Errorf("reloaded wallet has %v, want [%s]", addresses, address)
+    }
+}